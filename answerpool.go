@@ -0,0 +1,233 @@
+package main
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/kaspanet/kaspad/app/appmessage"
+	"github.com/miekg/dns"
+)
+
+const (
+	// answerPoolRefreshInterval is the interval in which the answer
+	// pools are rebuilt if node state changed.
+	answerPoolRefreshInterval = time.Second
+
+	// answerPoolMaxAge is the age after which the answer pools are
+	// rebuilt even if no node state changed, so that nodes going stale
+	// are removed from them.
+	answerPoolMaxAge = 30 * time.Second
+)
+
+// poolQueryTypes are the query types answer pools are built for
+var poolQueryTypes = []uint16{dns.TypeA, dns.TypeAAAA, dns.TypeSRV}
+
+// poolEntry is a good node in an answer pool, together with its prebuilt
+// address record and the groups it is capped by
+type poolEntry struct {
+	node     *Node
+	rr       dns.RR
+	netgroup string
+	asn      uint32
+}
+
+// record returns a copy of the entry's address record owned by name
+func (e *poolEntry) record(name string, ttl uint32) dns.RR {
+	switch rr := e.rr.(type) {
+	case *dns.A:
+		a := *rr
+		a.Hdr.Name = name
+		a.Hdr.Ttl = ttl
+		return &a
+	case *dns.AAAA:
+		aaaa := *rr
+		aaaa.Hdr.Name = name
+		aaaa.Hdr.Ttl = ttl
+		return &aaaa
+	}
+	return nil
+}
+
+// hasMatch returns whether any entry of the pool passes filter
+func (p *answerPool) hasMatch(filter *AddressFilter) bool {
+	for _, entry := range p.entries {
+		if filter.matches(entry.node) {
+			return true
+		}
+	}
+	return false
+}
+
+// answerPoolKey identifies an answer pool. subnetwork is empty for the pool
+// of all subnetworks, and holds the subnetwork ID as a string otherwise,
+// with "n" standing for full nodes. region is empty for the pool of nodes
+// from anywhere, and holds one of the keys returned by geoLocation.regions
+// otherwise.
+type answerPoolKey struct {
+	qtype      uint16
+	subnetwork string
+	region     string
+}
+
+// answerPool holds the entries of a pool along with the running sum of
+// their selection weights
+type answerPool struct {
+	entries           []*poolEntry
+	cumulativeWeights []float64
+}
+
+// add appends entry to the pool
+func (p *answerPool) add(entry *poolEntry) {
+	weight := selectionWeight(entry.node)
+	if len(p.cumulativeWeights) > 0 {
+		weight += p.cumulativeWeights[len(p.cumulativeWeights)-1]
+	}
+	p.entries = append(p.entries, entry)
+	p.cumulativeWeights = append(p.cumulativeWeights, weight)
+}
+
+// answerPools is an immutable snapshot of the good nodes, grouped by the
+// query type they can answer and by subnetwork. nodeCount and goodCount
+// are the numbers of known nodes and of good ones when it was built.
+// srvTargets maps the IPs of the nodes in the SRV pools to their ports.
+type answerPools struct {
+	pools      map[answerPoolKey]*answerPool
+	srvTargets map[string]uint16
+	builtAt    time.Time
+	nodeCount  int
+	goodCount  int
+}
+
+func subnetworkPoolKey(filter *AddressFilter) string {
+	if filter.IncludeAllSubnetworks {
+		return ""
+	}
+	if filter.SubnetworkID == nil {
+		return "n"
+	}
+	return filter.SubnetworkID.String()
+}
+
+// buildAnswerPools builds answer pools from the manager's nodes. It must be
+// called with mtx held.
+func (m *Manager) buildAnswerPools(now time.Time) *answerPools {
+	p := &answerPools{
+		pools:      make(map[answerPoolKey]*answerPool),
+		srvTargets: make(map[string]uint16),
+		builtAt:    now,
+		nodeCount:  len(m.nodes),
+	}
+
+	// Add the nodes in a fixed order, so that the selection only depends
+	// on the peer selector's source of randomness.
+	keys := make([]string, 0, len(m.nodes))
+	for key := range m.nodes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		node := m.nodes[key]
+		var entry *poolEntry
+		for _, qtype := range poolQueryTypes {
+			if !m.isGoodForQuery(node, qtype, now) {
+				continue
+			}
+			if entry == nil {
+				nodeCopy := *node
+				entry = &poolEntry{
+					node:     &nodeCopy,
+					rr:       addressRR("", node.Addr, 0),
+					netgroup: netgroup(node.Addr.IP),
+					asn:      m.selector.asns.lookup(node.Addr.IP),
+				}
+				p.goodCount++
+			}
+			if qtype == dns.TypeSRV {
+				p.srvTargets[node.Addr.IP.String()] = node.Addr.Port
+			}
+			subnetwork := subnetworkPoolKey(&AddressFilter{SubnetworkID: node.SubnetworkID})
+			regions := []string{""}
+			if location := m.selector.locate(node.Addr.IP); location != nil {
+				regions = append(regions, location.regions()...)
+			}
+			for _, region := range regions {
+				p.add(answerPoolKey{qtype, "", region}, entry)
+				p.add(answerPoolKey{qtype, subnetwork, region}, entry)
+			}
+		}
+	}
+	return p
+}
+
+// add appends entry to the pool identified by key
+func (p *answerPools) add(key answerPoolKey, entry *poolEntry) {
+	pool, ok := p.pools[key]
+	if !ok {
+		pool = &answerPool{}
+		p.pools[key] = pool
+	}
+	pool.add(entry)
+}
+
+// pool returns the pool matching qtype, filter's subnetwork and region
+func (p *answerPools) pool(qtype uint16, filter *AddressFilter, region string) *answerPool {
+	pool, ok := p.pools[answerPoolKey{qtype, subnetworkPoolKey(filter), region}]
+	if !ok {
+		return &answerPool{}
+	}
+	return pool
+}
+
+// hasSRVTarget returns whether address is the address of a node in the SRV
+// pools, and may thus be the target of an SRV answer
+func (p *answerPools) hasSRVTarget(address *appmessage.NetAddress) bool {
+	port, ok := p.srvTargets[address.IP.String()]
+	return ok && port == address.Port
+}
+
+// AnswerPools returns the latest snapshot of the answer pools
+func (m *Manager) AnswerPools() *answerPools {
+	return m.answerPools.Load().(*answerPools)
+}
+
+// markAnswerPoolsDirty records that node state changed and the answer pools
+// need to be rebuilt
+func (m *Manager) markAnswerPoolsDirty() {
+	atomic.StoreInt32(&m.answerPoolsDirty, 1)
+}
+
+// maybeRefreshAnswerPools rebuilds the answer pools if node state changed
+// or they are older than answerPoolMaxAge.
+func (m *Manager) maybeRefreshAnswerPools() {
+	if atomic.SwapInt32(&m.answerPoolsDirty, 0) == 1 ||
+		time.Since(m.AnswerPools().builtAt) > answerPoolMaxAge {
+		m.refreshAnswerPools()
+	}
+}
+
+// refreshAnswerPools rebuilds the answer pools from the current node state
+func (m *Manager) refreshAnswerPools() {
+	m.mtx.RLock()
+	pools := m.buildAnswerPools(time.Now())
+	m.mtx.RUnlock()
+
+	m.answerPools.Store(pools)
+}
+
+// sampleAnswerPool returns up to maxAddresses entries of the latest answer
+// pools matching qtype and filter, chosen by the manager's peer selector.
+// If near is not nil, nodes in the same region are preferred.
+func (m *Manager) sampleAnswerPool(qtype uint16, filter *AddressFilter, near *geoLocation,
+	maxAddresses int) []*poolEntry {
+
+	pools := m.AnswerPools()
+	var localPools []*answerPool
+	if near != nil {
+		for _, region := range near.regions() {
+			localPools = append(localPools, pools.pool(qtype, filter, region))
+		}
+	}
+	return m.selector.sample(pools.pool(qtype, filter, ""), localPools, filter, maxAddresses)
+}
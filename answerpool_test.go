@@ -0,0 +1,209 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/kaspanet/kaspad/app/appmessage"
+	"github.com/kaspanet/kaspad/domain/dagconfig"
+	"github.com/miekg/dns"
+)
+
+// testPort is the default port of the test network
+const testPort = 1313
+
+// testNetParams returns the parameters of the test network, which accepts
+// unroutable addresses
+func testNetParams() *dagconfig.Params {
+	netParams := dagconfig.DevnetParams
+	netParams.DefaultPort = "1313"
+	return &netParams
+}
+
+func setupAnswerPoolManager(tb testing.TB, nodeCount int, selector *peerSelector) *Manager {
+	m, err := NewManager(tb.TempDir(), testNetParams(), defaultStaleTimeout, defaultPruneExpireTimeout,
+		defaultMaxFailures, selector)
+	if err != nil {
+		tb.Fatalf("NewManager: %s", err)
+	}
+	for i := 0; i < nodeCount; i++ {
+		ip := net.IP{byte(1 + i%223), byte(i / 223), 0, 1}
+		if i%2 == 1 {
+			ip = net.ParseIP(fmt.Sprintf("2001:db8::%x", i))
+		}
+		m.AddAddresses([]*appmessage.NetAddress{appmessage.NewNetAddressIPPort(ip, testPort)})
+		m.Good(ip, nil)
+	}
+	m.refreshAnswerPools()
+	return m
+}
+
+func TestAnswerPools(t *testing.T) {
+	m := setupAnswerPoolManager(t, 10, newPeerSelector(0, 0, nil, nil, 0, rand.New(rand.NewSource(1))))
+	ip := net.IP{100, 0, 0, 100}
+	m.AddAddresses([]*appmessage.NetAddress{appmessage.NewNetAddressIPPort(ip, 4444)})
+	m.Good(ip, nil)
+
+	if len(m.AnswerPools().pool(dns.TypeSRV, &AddressFilter{}, "").entries) != 10 {
+		t.Fatalf("expected the new node to be served only after a refresh")
+	}
+	m.maybeRefreshAnswerPools()
+
+	tests := []struct {
+		qtype uint16
+		want  int
+	}{
+		{dns.TypeA, 5},
+		{dns.TypeAAAA, 5},
+		{dns.TypeSRV, 11},
+	}
+	for _, test := range tests {
+		entries := m.sampleAnswerPool(test.qtype, &AddressFilter{}, nil, 100)
+		if len(entries) != test.want {
+			t.Fatalf("qtype %d: expected %d entries, got %d", test.qtype, test.want, len(entries))
+		}
+		seen := make(map[string]bool)
+		for _, entry := range entries {
+			rr := entry.record("seed.example.org.", defaultTTL)
+			if test.qtype != dns.TypeSRV && rr.Header().Rrtype != test.qtype {
+				t.Fatalf("qtype %d: got record %s", test.qtype, rr)
+			}
+			if seen[rr.String()] {
+				t.Fatalf("qtype %d: record %s returned twice", test.qtype, rr)
+			}
+			seen[rr.String()] = true
+		}
+	}
+
+	if len(m.sampleAnswerPool(dns.TypeA, &AddressFilter{}, nil, 3)) != 3 {
+		t.Fatalf("expected the sample to be limited to 3 entries")
+	}
+	if len(m.sampleAnswerPool(dns.TypeA, &AddressFilter{MinProtocolVersion: 1}, nil, 3)) != 0 {
+		t.Fatalf("expected the filter to be applied to sampled entries")
+	}
+
+	entry := m.sampleAnswerPool(dns.TypeA, &AddressFilter{}, nil, 1)[0]
+	first := entry.record("a.seed.example.org.", defaultTTL)
+	entry.record("b.seed.example.org.", defaultTTL)
+	if first.Header().Name != "a.seed.example.org." {
+		t.Fatalf("records built from the same entry share their header")
+	}
+}
+
+// oldGoodAddresses is GoodAddresses as it was before answer pools were
+// introduced. It walks the node map until it has found maxAddresses good
+// nodes, which is the whole map for queries that few nodes match.
+func oldGoodAddresses(m *Manager, qtype uint16, filter *AddressFilter, maxAddresses int) []*appmessage.NetAddress {
+	addrs := make([]*appmessage.NetAddress, 0, maxAddresses)
+	i := maxAddresses
+
+	if qtype != dns.TypeA && qtype != dns.TypeAAAA && qtype != dns.TypeSRV {
+		return addrs
+	}
+
+	now := time.Now()
+	m.mtx.RLock()
+	for _, node := range m.nodes {
+		if i == 0 {
+			break
+		}
+
+		if qtype != dns.TypeSRV && node.Addr.Port != m.defaultPort {
+			continue
+		}
+
+		if !filter.matches(node) {
+			continue
+		}
+
+		if qtype == dns.TypeA && node.Addr.IP.To4() == nil {
+			continue
+		} else if qtype == dns.TypeAAAA && node.Addr.IP.To4() != nil {
+			continue
+		}
+
+		if node.LastSuccess.IsZero() ||
+			now.Sub(node.LastSuccess) > m.staleTimeout {
+			continue
+		}
+
+		addrs = append(addrs, node.Addr)
+		i--
+	}
+	m.mtx.RUnlock()
+
+	return addrs
+}
+
+// benchmarkFilters are the queries benchmarked: one that all nodes match,
+// and one that only a few match.
+var benchmarkFilters = []struct {
+	name   string
+	filter *AddressFilter
+}{
+	{"all", &AddressFilter{IncludeAllSubnetworks: true}},
+	{"filtered", &AddressFilter{IncludeAllSubnetworks: true, MinProtocolVersion: 1}},
+}
+
+// setupBenchmarkManager returns a manager of 10000 good nodes, of which 8
+// IPv4 nodes have protocol version 1.
+func setupBenchmarkManager(b *testing.B, selector *peerSelector) *Manager {
+	m := setupAnswerPoolManager(b, 10000, selector)
+	matching := 0
+	for _, node := range m.nodes {
+		if matching < 8 && node.Addr.IP.To4() != nil {
+			node.ProtocolVersion = 1
+			matching++
+		}
+	}
+	m.refreshAnswerPools()
+	return m
+}
+
+// reportQueriesPerSecond reports the rate at which the benchmark answered
+// queries since start.
+func reportQueriesPerSecond(b *testing.B, start time.Time) {
+	b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "queries/s")
+}
+
+// BenchmarkGoodAddressesScan measures the per-query cost of the old path:
+// scanning the node map and building records through string parsing.
+func BenchmarkGoodAddressesScan(b *testing.B) {
+	m := setupBenchmarkManager(b, newPeerSelector(0, 0, nil, nil, 0, globalRand{}))
+	for _, benchmark := range benchmarkFilters {
+		filter := benchmark.filter
+		b.Run(benchmark.name, func(b *testing.B) {
+			start := time.Now()
+			for i := 0; i < b.N; i++ {
+				for _, a := range oldGoodAddresses(m, dns.TypeA, filter, defaultMaxAddresses) {
+					_, err := dns.NewRR(fmt.Sprintf("%s %d IN A %s", "seed.example.org.", defaultTTL, a.IP.String()))
+					if err != nil {
+						b.Fatalf("NewRR: %s", err)
+					}
+				}
+			}
+			reportQueriesPerSecond(b, start)
+		})
+	}
+}
+
+// BenchmarkAnswerPoolSample measures the per-query cost of sampling records
+// from the precomputed answer pools.
+func BenchmarkAnswerPoolSample(b *testing.B) {
+	m := setupBenchmarkManager(b, newPeerSelector(defaultNetgroupCap, 0, nil, nil, 0, globalRand{}))
+	for _, benchmark := range benchmarkFilters {
+		filter := benchmark.filter
+		b.Run(benchmark.name, func(b *testing.B) {
+			start := time.Now()
+			for i := 0; i < b.N; i++ {
+				for _, entry := range m.sampleAnswerPool(dns.TypeA, filter, nil, defaultMaxAddresses) {
+					entry.record("seed.example.org.", defaultTTL)
+				}
+			}
+			reportQueriesPerSecond(b, start)
+		})
+	}
+}
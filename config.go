@@ -9,9 +9,12 @@ import (
 	"net"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/kaspanet/kaspad/domain/dagconfig"
 	"github.com/kaspanet/kaspad/infrastructure/config"
 
 	"github.com/kaspanet/dnsseeder/version"
@@ -22,12 +25,32 @@ import (
 )
 
 const (
-	defaultConfigFilename = "dnsseeder.conf"
-	defaultLogFilename    = "dnsseeder.log"
-	defaultErrLogFilename = "dnsseeder_err.log"
-	defaultListenPort     = "5354"
-	defaultGrpcListenPort = "3737"
-	defaultLogLevel       = "info"
+	defaultConfigFilename  = "dnsseeder.conf"
+	defaultLogFilename     = "dnsseeder.log"
+	defaultErrLogFilename  = "dnsseeder_err.log"
+	defaultListenPort      = "5354"
+	defaultGrpcListenPort  = "3737"
+	defaultTLSListenPort   = "853"
+	defaultHTTPSListenPort = "443"
+	defaultNotifyPort      = "53"
+	defaultLogLevel        = "info"
+	defaultSOARefresh      = 3600
+	defaultSOAMinimum      = 60
+	defaultRRLRate         = 20
+	defaultRRLNegRate      = 10
+	defaultRRLCookieRate   = 200
+	defaultRRLSlip         = 2
+	defaultDNSQueue        = 1024
+	defaultDNSTapSample    = 1
+	defaultDNSTapBuffer    = 4096
+	defaultNetgroupCap     = 1
+	defaultASNCap          = 2
+	defaultTTL             = 30
+	defaultNSTTL           = 86400
+	defaultGeoGlobalShare  = 0.25
+
+	// maxTTL is the largest TTL allowed by RFC 2181.
+	maxTTL = 1<<31 - 1
 )
 
 var (
@@ -46,19 +69,99 @@ func ActiveConfig() *ConfigFlags {
 
 // ConfigFlags holds the configurations set by the command line argument
 type ConfigFlags struct {
-	AppDir      string `short:"b" long:"appdir" description:"Directory to store data"`
-	KnownPeers  string `short:"p" long:"peers" description:"List of already known peer addresses"`
-	ShowVersion bool   `short:"V" long:"version" description:"Display version information and exit"`
-	Host        string `short:"H" long:"host" description:"Seed DNS address"`
-	Listen      string `long:"listen" short:"l" description:"Listen on address:port"`
-	Nameserver  string `short:"n" long:"nameserver" description:"hostname of nameserver"`
-	Seeder      string `short:"s" long:"default-seeder" description:"IP address of a working node, optionally with a port specifier"`
-	Profile     string `long:"profile" description:"Enable HTTP profiling on given port -- NOTE port must be between 1024 and 65536"`
-	GRPCListen  string `long:"grpclisten" description:"Listen gRPC requests on address:port"`
-	NetSuffix   uint16 `long:"netsuffix" description:"Testnet network suffix number"`
-	NoLogFiles  bool   `long:"nologfiles" description:"Disable logging to file"`
-	LogLevel    string `long:"loglevel" description:"Loglevel for stdout (console). Default: info"`
+	AppDir           string        `short:"b" long:"appdir" description:"Directory to store data"`
+	KnownPeers       string        `short:"p" long:"peers" description:"List of already known peer addresses"`
+	ShowVersion      bool          `short:"V" long:"version" description:"Display version information and exit"`
+	Host             string        `short:"H" long:"host" description:"Seed DNS address"`
+	Listen           []string      `long:"listen" short:"l" description:"Listen on address:port (may be used multiple times to listen on several addresses, including IPv6 ones)"`
+	Nameserver       string        `short:"n" long:"nameserver" description:"hostname of nameserver"`
+	Seeder           string        `short:"s" long:"default-seeder" description:"IP address of a working node, optionally with a port specifier"`
+	Profile          string        `long:"profile" description:"Enable HTTP profiling on given port -- NOTE port must be between 1024 and 65536"`
+	GRPCListen       string        `long:"grpclisten" description:"Listen gRPC requests on address:port"`
+	TLSListen        []string      `long:"tlslisten" description:"Listen for DNS-over-TLS queries on address:port (may be used multiple times)"`
+	HTTPSListen      []string      `long:"httpslisten" description:"Listen for DNS-over-HTTPS queries on address:port (may be used multiple times)"`
+	TLSCert          string        `long:"tlscert" description:"File containing the certificate chain for DNS-over-TLS and DNS-over-HTTPS, reloaded when it changes"`
+	TLSKey           string        `long:"tlskey" description:"File containing the private key for DNS-over-TLS and DNS-over-HTTPS, reloaded when it changes"`
+	NetSuffix        uint16        `long:"netsuffix" description:"Testnet network suffix number"`
+	NoLogFiles       bool          `long:"nologfiles" description:"Disable logging to file"`
+	LogLevel         string        `long:"loglevel" description:"Loglevel for stdout (console). Default: info"`
+	SOASerial        uint32        `long:"soaserial" description:"Serial number of the zone's SOA record (default: startup time)"`
+	SOARefresh       uint32        `long:"soarefresh" description:"Refresh interval of the zone's SOA record in seconds"`
+	SOAMinimum       uint32        `long:"soaminimum" description:"Negative caching TTL of the zone's SOA record in seconds"`
+	RRLRate          float64       `long:"rrlrate" description:"Positive responses per second allowed to each client /24 (IPv4) or /56 (IPv6) prefix over UDP; 0 disables the limit"`
+	RRLNegRate       float64       `long:"rrlnegrate" description:"Negative responses per second allowed to each client prefix over UDP; 0 disables the limit"`
+	RRLCookieRate    float64       `long:"rrlcookierate" description:"Responses per second allowed over UDP to each client address that sent a valid DNS server cookie; 0 disables the limit"`
+	RRLSlip          uint64        `long:"rrlslip" description:"Send every n-th rate limited response as a truncated one instead of dropping it; 0 drops all of them"`
+	CookieSecretFile string        `long:"cookiesecretfile" description:"File holding the hex encoded secret DNS server cookies are derived from, created if missing; share it between instances serving the same zones (default: a random secret per run)"`
+	NoCookies        bool          `long:"nocookies" description:"Disable DNS Cookies"`
+	DNSWorkers       int           `long:"dnsworkers" description:"Number of workers handling UDP DNS queries"`
+	DNSQueue         int           `long:"dnsqueue" description:"Number of UDP DNS queries that may wait for a worker; further queries are dropped"`
+	DNSTap           string        `long:"dnstap" description:"Log queries and responses in dnstap format to the given file, or to a Unix socket given as unix:<path>"`
+	DNSTapSample     uint64        `long:"dnstapsample" description:"Log one in n queries to dnstap"`
+	DNSTapBuffer     int           `long:"dnstapbuffer" description:"Number of queries that may wait to be written to dnstap; further queries are not logged"`
+	DNSSEC           bool          `long:"dnssec" description:"Sign responses with the zone's DNSSEC keys (K<host>+<alg>+<tag>.key/.private) found in the app directory"`
+	NetgroupCap      int           `long:"netgroupcap" description:"Maximum number of peers from the same IPv4 /16 or IPv6 /32 in one answer; 0 disables the cap"`
+	ASNFile          string        `long:"asnfile" description:"File mapping IP prefixes to autonomous systems, one \"<prefix> <asn>\" pair per line"`
+	ASNCap           int           `long:"asncap" description:"Maximum number of peers from the same autonomous system in one answer if --asnfile is set; 0 disables the cap"`
+	GeoIPDB          string        `long:"geoipdb" description:"MaxMind GeoIP2 or GeoLite2 Country or City database (.mmdb) used to answer clients with peers from their country or continent"`
+	GeoGlobalShare   float64       `long:"geoglobalshare" description:"Share of each answer filled with peers from anywhere if --geoipdb is set, between 0 and 1"`
+	TTL              uint32        `long:"ttl" description:"TTL of the records listing peers, in seconds"`
+	NSTTL            uint32        `long:"nsttl" description:"TTL of the zone's NS record, in seconds"`
+	MaxAddresses     int           `long:"maxaddresses" description:"Number of peers in a DNS answer limited to 512 bytes, scaled up for clients with larger buffers, and of each IP family in a gRPC reply"`
+	StaleTimeout     time.Duration `long:"staletimeout" description:"Time after the last successful connection in which a peer is handed out and not crawled again"`
+	PruneExpire      time.Duration `long:"pruneexpire" description:"Time after which a peer that was never successfully connected to and is no longer seen is forgotten"`
+	MaxFailures      int           `long:"maxfailures" description:"Number of consecutive failed connection attempts, retried with exponential backoff, after which a peer is forgotten"`
+	Zones            []string      `long:"zone" description:"Serve an additional zone for another network, as <host>,<nameserver>,<network>[,<seeder>] where network is mainnet, testnet, testnet-11, devnet or simnet (may be used multiple times)"`
+	TSIGKeys         []string      `long:"tsigkey" description:"Key for signing zone transfers and NOTIFY messages, as [algorithm:]name:base64secret where algorithm is hmac-sha1, hmac-sha256 (default) or hmac-sha512; transfer requests must be signed with one of the keys if any is set (may be used multiple times)"`
+	TransferAllow    []string      `long:"transferallow" description:"Allow zone transfers from the given IP address or CIDR network (may be used multiple times)"`
+	Notify           []string      `long:"notify" description:"Send NOTIFY messages to the secondary nameserver at address[:port] when a zone changes (may be used multiple times)"`
+	CrawlWorkers     int           `long:"crawlers" description:"Number of peers the crawler of each network polls at once"`
+	CrawlRate        float64       `long:"crawlrate" description:"New peer connections per second opened by the crawlers of all networks together"`
+	CrawlTimeout     time.Duration `long:"crawltimeout" description:"Time allowed for connecting to a peer, completing the handshake and receiving its addresses"`
+	Proxy            string        `long:"proxy" description:"Connect to peers and resolve DNS seeds through the SOCKS5 proxy at host[:port], Tor's port 9050 by default"`
+	ProxyUser        string        `long:"proxyuser" description:"User name for the SOCKS5 proxy"`
+	ProxyPass        string        `long:"proxypass" description:"Password for the SOCKS5 proxy"`
+	OnionProxy       string        `long:"onion" description:"Connect to .onion hosts through the SOCKS5 proxy at host[:port] instead of --proxy"`
+	NoOnion          bool          `long:"noonion" description:"Disable .onion hosts, and resolve host names with the system resolver rather than through --proxy"`
+	TorIsolation     bool          `long:"torisolation" description:"Use a separate Tor circuit for each connection by authenticating to the proxy with random credentials"`
 	config.NetworkFlags
+
+	zones    []*ZoneConfig
+	transfer *TransferConfig
+	dialer   *peerDialer
+}
+
+// ZoneConfig describes a seed zone and the network whose nodes it lists
+type ZoneConfig struct {
+	Host         string
+	Nameserver   string
+	Seeder       string
+	KnownPeers   string
+	AppDir       string
+	NetworkFlags config.NetworkFlags
+}
+
+// NetParams returns the network parameters of the zone's network
+func (z *ZoneConfig) NetParams() *dagconfig.Params {
+	return z.NetworkFlags.NetParams()
+}
+
+// SeedZones returns the configured zones. The zone set by --host,
+// --nameserver and the network flags comes first.
+func (cfg *ConfigFlags) SeedZones() []*ZoneConfig {
+	return cfg.zones
+}
+
+// Transfer returns the zone transfer settings, or nil if zone transfers are
+// disabled.
+func (cfg *ConfigFlags) Transfer() *TransferConfig {
+	return cfg.transfer
+}
+
+// Dialer returns the dialer crawler connections and DNS seed lookups go
+// through
+func (cfg *ConfigFlags) Dialer() *peerDialer {
+	return cfg.dialer
 }
 
 // cleanAndExpandPath expands environment variables and leading ~ in the
@@ -101,10 +204,31 @@ func createPathIfNeeded(path string) error {
 func loadConfig() (*ConfigFlags, error) {
 	// Default config.
 	activeConfig = &ConfigFlags{
-		AppDir:     DefaultAppDir,
-		Listen:     normalizeAddress("localhost", defaultListenPort),
-		GRPCListen: normalizeAddress("localhost", defaultGrpcListenPort),
-		LogLevel:   defaultLogLevel,
+		AppDir:         DefaultAppDir,
+		GRPCListen:     normalizeAddress("localhost", defaultGrpcListenPort),
+		LogLevel:       defaultLogLevel,
+		SOARefresh:     defaultSOARefresh,
+		SOAMinimum:     defaultSOAMinimum,
+		RRLRate:        defaultRRLRate,
+		RRLNegRate:     defaultRRLNegRate,
+		RRLCookieRate:  defaultRRLCookieRate,
+		RRLSlip:        defaultRRLSlip,
+		DNSWorkers:     4 * runtime.NumCPU(),
+		DNSQueue:       defaultDNSQueue,
+		DNSTapSample:   defaultDNSTapSample,
+		DNSTapBuffer:   defaultDNSTapBuffer,
+		NetgroupCap:    defaultNetgroupCap,
+		ASNCap:         defaultASNCap,
+		GeoGlobalShare: defaultGeoGlobalShare,
+		TTL:            defaultTTL,
+		NSTTL:          defaultNSTTL,
+		MaxAddresses:   defaultMaxAddresses,
+		StaleTimeout:   defaultStaleTimeout,
+		PruneExpire:    defaultPruneExpireTimeout,
+		MaxFailures:    defaultMaxFailures,
+		CrawlWorkers:   defaultCrawlWorkers,
+		CrawlRate:      defaultCrawlRate,
+		CrawlTimeout:   defaultCrawlTimeout,
 	}
 
 	preCfg := activeConfig
@@ -165,27 +289,46 @@ func loadConfig() (*ConfigFlags, error) {
 		return nil, err
 	}
 
-	activeConfig.Listen = normalizeAddress(activeConfig.Listen, defaultListenPort)
+	if len(activeConfig.Listen) == 0 {
+		activeConfig.Listen = []string{"localhost"}
+	}
+	for i, listen := range activeConfig.Listen {
+		activeConfig.Listen[i] = normalizeAddress(listen, defaultListenPort)
+	}
+
+	for i, listen := range activeConfig.TLSListen {
+		activeConfig.TLSListen[i] = normalizeAddress(listen, defaultTLSListenPort)
+	}
+	for i, listen := range activeConfig.HTTPSListen {
+		activeConfig.HTTPSListen[i] = normalizeAddress(listen, defaultHTTPSListenPort)
+	}
+	if len(activeConfig.TLSListen) > 0 || len(activeConfig.HTTPSListen) > 0 {
+		if activeConfig.TLSCert == "" || activeConfig.TLSKey == "" {
+			return nil, errors.New("DNS-over-TLS and DNS-over-HTTPS require --tlscert and --tlskey")
+		}
+		activeConfig.TLSCert = cleanAndExpandPath(activeConfig.TLSCert)
+		activeConfig.TLSKey = cleanAndExpandPath(activeConfig.TLSKey)
+	}
 
 	err = activeConfig.ResolveNetwork(parser)
 	if err != nil {
 		return nil, err
 	}
 
-	// Manually enforce testnet 11 net params so we do not have to 
+	// Manually enforce testnet 11 net params so we do not have to
 	// support this special network in kaspad.
 	if activeConfig.NetSuffix != 0 {
 		if !activeConfig.Testnet {
 			return nil, errors.New("The net suffix can only be used with testnet")
 		}
-		if activeConfig.NetSuffix != 11 {
-			return nil, errors.New("The only supported explicit testnet net suffix is 11")
+		err = applyNetSuffix(&activeConfig.NetworkFlags, activeConfig.NetSuffix)
+		if err != nil {
+			return nil, err
 		}
-		activeConfig.NetParams().DefaultPort = "16311";
-		activeConfig.NetParams().Name = "kaspa-testnet-11";
 	}
 
 	activeConfig.AppDir = cleanAndExpandPath(activeConfig.AppDir)
+	baseAppDir := activeConfig.AppDir
 	// Append the network type to the app directory so it is "namespaced"
 	// per network.
 	// All data is specific to a network, so namespacing the data directory
@@ -193,14 +336,141 @@ func loadConfig() (*ConfigFlags, error) {
 	// worry about changing names per network and such.
 	activeConfig.AppDir = filepath.Join(activeConfig.AppDir, activeConfig.NetParams().Name)
 
+	activeConfig.zones = []*ZoneConfig{{
+		Host:         activeConfig.Host,
+		Nameserver:   activeConfig.Nameserver,
+		Seeder:       activeConfig.Seeder,
+		KnownPeers:   activeConfig.KnownPeers,
+		AppDir:       activeConfig.AppDir,
+		NetworkFlags: activeConfig.NetworkFlags,
+	}}
+	for _, zone := range activeConfig.Zones {
+		zoneConfig, err := parseZone(zone, baseAppDir)
+		if err != nil {
+			return nil, err
+		}
+		activeConfig.zones = append(activeConfig.zones, zoneConfig)
+	}
+	hosts := make(map[string]bool)
+	networks := make(map[string]bool)
+	for _, zone := range activeConfig.zones {
+		host := strings.ToLower(strings.TrimSuffix(zone.Host, "."))
+		if hosts[host] {
+			return nil, errors.Errorf("The zone %s is configured more than once", zone.Host)
+		}
+		hosts[host] = true
+		if networks[zone.NetParams().Name] {
+			return nil, errors.Errorf("More than one zone serves the %s network", zone.NetParams().Name)
+		}
+		networks[zone.NetParams().Name] = true
+
+		err = createPathIfNeeded(zone.AppDir)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	appLogFile := filepath.Join(activeConfig.AppDir, defaultLogFilename)
 	appErrLogFile := filepath.Join(activeConfig.AppDir, defaultErrLogFilename)
 
-	err = createPathIfNeeded(activeConfig.AppDir)
+	if activeConfig.RRLRate < 0 || activeConfig.RRLNegRate < 0 || activeConfig.RRLCookieRate < 0 {
+		return nil, errors.New("The response rate limits must not be negative")
+	}
+
+	if activeConfig.CookieSecretFile != "" {
+		if activeConfig.NoCookies {
+			return nil, errors.New("--cookiesecretfile and --nocookies cannot be used together")
+		}
+		activeConfig.CookieSecretFile = cleanAndExpandPath(activeConfig.CookieSecretFile)
+	}
+
+	if activeConfig.DNSWorkers < 1 {
+		return nil, errors.New("There must be at least one DNS worker")
+	}
+	if activeConfig.DNSQueue < 1 {
+		return nil, errors.New("The DNS queue must hold at least one query")
+	}
+
+	if activeConfig.DNSTap != "" {
+		if strings.HasPrefix(activeConfig.DNSTap, dnstapSocketPrefix) {
+			activeConfig.DNSTap = dnstapSocketPrefix +
+				cleanAndExpandPath(strings.TrimPrefix(activeConfig.DNSTap, dnstapSocketPrefix))
+		} else {
+			activeConfig.DNSTap = cleanAndExpandPath(activeConfig.DNSTap)
+		}
+	}
+	if activeConfig.DNSTapSample < 1 {
+		return nil, errors.New("The dnstap sample rate must be at least 1")
+	}
+	if activeConfig.DNSTapBuffer < 1 {
+		return nil, errors.New("The dnstap buffer must hold at least one query")
+	}
+
+	if activeConfig.NetgroupCap < 0 || activeConfig.ASNCap < 0 {
+		return nil, errors.New("The netgroup and ASN caps must not be negative")
+	}
+	if activeConfig.ASNFile != "" {
+		activeConfig.ASNFile = cleanAndExpandPath(activeConfig.ASNFile)
+	}
+	if activeConfig.GeoIPDB != "" {
+		activeConfig.GeoIPDB = cleanAndExpandPath(activeConfig.GeoIPDB)
+	}
+	if activeConfig.GeoGlobalShare < 0 || activeConfig.GeoGlobalShare > 1 {
+		return nil, errors.New("The global share of answers must be between 0 and 1")
+	}
+
+	activeConfig.transfer, err = parseTransferConfig(activeConfig.TSIGKeys, activeConfig.TransferAllow,
+		activeConfig.Notify)
 	if err != nil {
 		return nil, err
 	}
 
+	if activeConfig.TTL > maxTTL || activeConfig.NSTTL > maxTTL {
+		return nil, errors.Errorf("TTLs must not be larger than %d seconds", maxTTL)
+	}
+	if activeConfig.MaxAddresses < 1 || activeConfig.MaxAddresses > maxAddressesPerResponse {
+		return nil, errors.Errorf("The maximum number of addresses must be between 1 and %d",
+			maxAddressesPerResponse)
+	}
+	if activeConfig.StaleTimeout <= 0 {
+		return nil, errors.New("The stale timeout must be positive")
+	}
+	if activeConfig.PruneExpire < activeConfig.StaleTimeout {
+		return nil, errors.New("The prune expire time must not be shorter than the stale timeout")
+	}
+
+	if activeConfig.MaxFailures < 1 {
+		return nil, errors.New("The failure budget must be at least one attempt")
+	}
+
+	if activeConfig.CrawlWorkers < 1 {
+		return nil, errors.New("There must be at least one crawl worker")
+	}
+	if activeConfig.CrawlRate <= 0 {
+		return nil, errors.New("The crawl rate must be positive")
+	}
+	if activeConfig.CrawlTimeout <= 0 {
+		return nil, errors.New("The crawl timeout must be positive")
+	}
+
+	if activeConfig.OnionProxy != "" && activeConfig.NoOnion {
+		return nil, errors.New("--onion and --noonion cannot be used together")
+	}
+	if activeConfig.TorIsolation && activeConfig.Proxy == "" && activeConfig.OnionProxy == "" {
+		return nil, errors.New("--torisolation requires --proxy or --onion")
+	}
+	if (activeConfig.ProxyUser != "" || activeConfig.ProxyPass != "") && activeConfig.Proxy == "" {
+		return nil, errors.New("--proxyuser and --proxypass require --proxy")
+	}
+	if activeConfig.Proxy != "" {
+		activeConfig.Proxy = normalizeAddress(activeConfig.Proxy, defaultProxyPort)
+	}
+	if activeConfig.OnionProxy != "" {
+		activeConfig.OnionProxy = normalizeAddress(activeConfig.OnionProxy, defaultProxyPort)
+	}
+	activeConfig.dialer = newPeerDialer(activeConfig.Proxy, activeConfig.ProxyUser, activeConfig.ProxyPass,
+		activeConfig.OnionProxy, activeConfig.NoOnion, activeConfig.TorIsolation)
+
 	if activeConfig.Profile != "" {
 		profilePort, err := strconv.Atoi(activeConfig.Profile)
 		if err != nil || profilePort < 1024 || profilePort > 65535 {
@@ -214,11 +484,118 @@ func loadConfig() (*ConfigFlags, error) {
 }
 
 // normalizeAddress returns addr with the passed default port appended if
-// there is not already a port specified.
+// there is not already a port specified. IPv6 literals may be given with or
+// without brackets.
 func normalizeAddress(addr, defaultPort string) string {
 	_, _, err := net.SplitHostPort(addr)
 	if err != nil {
-		return net.JoinHostPort(addr, defaultPort)
+		host := strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+		return net.JoinHostPort(host, defaultPort)
 	}
 	return addr
 }
+
+// parseTransferConfig parses the zone transfer flags. Transfers are enabled
+// if any key or allowed network is given.
+func parseTransferConfig(tsigKeys, allow, notify []string) (*TransferConfig, error) {
+	if len(tsigKeys) == 0 && len(allow) == 0 {
+		if len(notify) > 0 {
+			return nil, errors.New("--notify requires --tsigkey or --transferallow")
+		}
+		return nil, nil
+	}
+
+	transfer := &TransferConfig{}
+	for _, s := range tsigKeys {
+		key, err := parseTSIGKey(s)
+		if err != nil {
+			return nil, err
+		}
+		transfer.TSIGKeys = append(transfer.TSIGKeys, key)
+	}
+	for _, s := range allow {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, errors.Errorf("Invalid address %s allowed to transfer zones", s)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			transfer.Allow = append(transfer.Allow, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, errors.Errorf("Invalid network %s allowed to transfer zones", s)
+		}
+		transfer.Allow = append(transfer.Allow, ipNet)
+	}
+	for _, s := range notify {
+		transfer.Notify = append(transfer.Notify, normalizeAddress(s, defaultNotifyPort))
+	}
+	return transfer, nil
+}
+
+// applyNetSuffix switches the testnet parameters in networkFlags to those
+// of the testnet with the given suffix. The parameters are copied, so that
+// other zones on the default testnet are not affected.
+func applyNetSuffix(networkFlags *config.NetworkFlags, netSuffix uint16) error {
+	if netSuffix != 11 {
+		return errors.New("The only supported explicit testnet net suffix is 11")
+	}
+	netParams := *networkFlags.ActiveNetParams
+	netParams.DefaultPort = "16311"
+	netParams.Name = "kaspa-testnet-11"
+	networkFlags.ActiveNetParams = &netParams
+	return nil
+}
+
+// parseZone parses the value of a --zone flag. The zone's data is stored
+// in a subdirectory of baseAppDir named after its network.
+func parseZone(zone, baseAppDir string) (*ZoneConfig, error) {
+	fields := strings.Split(zone, ",")
+	if len(fields) != 3 && len(fields) != 4 {
+		return nil, errors.Errorf("Invalid zone %s: expected <host>,<nameserver>,<network>[,<seeder>]", zone)
+	}
+	zoneConfig := &ZoneConfig{
+		Host:       fields[0],
+		Nameserver: fields[1],
+	}
+	if len(fields) == 4 {
+		zoneConfig.Seeder = fields[3]
+	}
+	if zoneConfig.Host == "" || zoneConfig.Nameserver == "" {
+		return nil, errors.Errorf("Invalid zone %s: the host and nameserver must not be empty", zone)
+	}
+
+	var netSuffix uint16
+	switch fields[2] {
+	case "mainnet":
+	case "testnet":
+		zoneConfig.NetworkFlags.Testnet = true
+	case "testnet-11":
+		zoneConfig.NetworkFlags.Testnet = true
+		netSuffix = 11
+	case "devnet":
+		zoneConfig.NetworkFlags.Devnet = true
+	case "simnet":
+		zoneConfig.NetworkFlags.Simnet = true
+	default:
+		return nil, errors.Errorf("Invalid zone %s: unknown network %s", zone, fields[2])
+	}
+	err := zoneConfig.NetworkFlags.ResolveNetwork(nil)
+	if err != nil {
+		return nil, err
+	}
+	if netSuffix != 0 {
+		err = applyNetSuffix(&zoneConfig.NetworkFlags, netSuffix)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	zoneConfig.AppDir = filepath.Join(baseAppDir, zoneConfig.NetParams().Name)
+	return zoneConfig, nil
+}
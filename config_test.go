@@ -0,0 +1,28 @@
+package main
+
+import "testing"
+
+func TestNormalizeAddress(t *testing.T) {
+	tests := []struct {
+		addr string
+		want string
+	}{
+		{"127.0.0.1", "127.0.0.1:5354"},
+		{"127.0.0.1:53", "127.0.0.1:53"},
+		{"localhost", "localhost:5354"},
+		{"localhost:53", "localhost:53"},
+		{"", ":5354"},
+		{":53", ":53"},
+		{"::1", "[::1]:5354"},
+		{"[::1]", "[::1]:5354"},
+		{"[::1]:53", "[::1]:53"},
+		{"2001:db8::1", "[2001:db8::1]:5354"},
+		{"[2001:db8::1]", "[2001:db8::1]:5354"},
+		{"[2001:db8::1]:53", "[2001:db8::1]:53"},
+	}
+	for _, test := range tests {
+		if addr := normalizeAddress(test.addr, "5354"); addr != test.want {
+			t.Errorf("%q: expected %q, got %q", test.addr, test.want, addr)
+		}
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"math/bits"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+const (
+	// clientCookieSize is the size of a client cookie, and
+	// minServerCookieSize and maxServerCookieSize bound the size of the
+	// server cookies a client may send, as defined in RFC 7873.
+	clientCookieSize    = 8
+	minServerCookieSize = 8
+	maxServerCookieSize = 32
+
+	// serverCookieSize and serverCookieVersion describe the server
+	// cookies made by the seeder, which follow the format of RFC 9018:
+	// a version, three reserved bytes, a timestamp and a SipHash-2-4 of
+	// the client cookie, the preceding fields and the client's IP.
+	serverCookieSize    = 16
+	serverCookieVersion = 1
+
+	// serverCookieLifetime is the age after which a server cookie is no
+	// longer accepted, and serverCookieMaxSkew is how far in the future
+	// its timestamp may be to tolerate instances with skewed clocks.
+	serverCookieLifetime = time.Hour
+	serverCookieMaxSkew  = 5 * time.Minute
+
+	// cookieSecretRotation is the period after which the secret server
+	// cookies are made with is replaced. The secret of each period is
+	// derived from the master secret, so instances sharing it rotate in
+	// step.
+	cookieSecretRotation = 24 * time.Hour
+
+	// cookieMasterSecretSize is the size of a generated master secret.
+	cookieMasterSecretSize = 32
+)
+
+// cookieStatus describes the DNS COOKIE option of a query
+type cookieStatus int
+
+const (
+	cookieMissing cookieStatus = iota
+	cookieMalformed
+	cookieClientOnly
+	cookieInvalid
+	cookieValid
+)
+
+// cookieSecret is the secret of one rotation period
+type cookieSecret struct {
+	period uint32
+	key    [16]byte
+}
+
+// cookieSecrets makes and verifies server cookies (RFC 7873) with secrets
+// that rotate every cookieSecretRotation. The secret of a cookie is found
+// by the timestamp it carries, so cookies stay valid across a rotation.
+type cookieSecrets struct {
+	master []byte
+
+	// latest caches the secret of the latest period in use.
+	latest atomic.Value
+}
+
+// newCookieSecrets returns cookie secrets derived from master.
+func newCookieSecrets(master []byte) *cookieSecrets {
+	return &cookieSecrets{master: master}
+}
+
+// loadCookieSecrets reads the hex encoded master secret from path. If the
+// file does not exist, a random secret is written to it, so that it can be
+// copied to other instances serving the same zones.
+func loadCookieSecrets(path string) (*cookieSecrets, error) {
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		master := make([]byte, cookieMasterSecretSize)
+		_, err = rand.Read(master)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		err = os.WriteFile(path, []byte(hex.EncodeToString(master)+"\n"), 0600)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		log.Infof("Generated a new DNS cookie secret in %s", path)
+		return newCookieSecrets(master), nil
+	}
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	master, err := hex.DecodeString(strings.TrimSpace(string(content)))
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid DNS cookie secret in %s", path)
+	}
+	if len(master) < 16 {
+		return nil, errors.Errorf("the DNS cookie secret in %s must be at least 16 bytes long", path)
+	}
+	return newCookieSecrets(master), nil
+}
+
+// randomCookieSecrets returns cookie secrets derived from a random master
+// secret, for a single instance.
+func randomCookieSecrets() (*cookieSecrets, error) {
+	master := make([]byte, cookieMasterSecretSize)
+	_, err := rand.Read(master)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return newCookieSecrets(master), nil
+}
+
+// secret returns the secret of the rotation period timestamp falls into
+func (s *cookieSecrets) secret(timestamp uint32) [16]byte {
+	period := timestamp / uint32(cookieSecretRotation/time.Second)
+	latest, _ := s.latest.Load().(*cookieSecret)
+	if latest != nil && latest.period == period {
+		return latest.key
+	}
+
+	mac := hmac.New(sha256.New, s.master)
+	var periodBytes [4]byte
+	binary.BigEndian.PutUint32(periodBytes[:], period)
+	mac.Write(periodBytes[:])
+	secret := &cookieSecret{period: period}
+	copy(secret.key[:], mac.Sum(nil))
+	if latest == nil || period > latest.period {
+		s.latest.Store(secret)
+	}
+	return secret.key
+}
+
+// serverCookie returns the server cookie for a client with the given client
+// cookie and IP, made at timestamp.
+func (s *cookieSecrets) serverCookie(clientCookie []byte, ip net.IP, timestamp uint32) []byte {
+	cookie := make([]byte, serverCookieSize)
+	cookie[0] = serverCookieVersion
+	binary.BigEndian.PutUint32(cookie[4:], timestamp)
+
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	input := make([]byte, 0, clientCookieSize+8+net.IPv6len)
+	input = append(input, clientCookie...)
+	input = append(input, cookie[:8]...)
+	input = append(input, ip...)
+	binary.LittleEndian.PutUint64(cookie[8:], siphash24(s.secret(timestamp), input))
+	return cookie
+}
+
+// verify returns whether serverCookie was made by the seeder for the given
+// client cookie and IP, and has not expired at now.
+func (s *cookieSecrets) verify(clientCookie, serverCookie []byte, ip net.IP, now time.Time) bool {
+	if len(serverCookie) != serverCookieSize || serverCookie[0] != serverCookieVersion {
+		return false
+	}
+	made := time.Unix(int64(binary.BigEndian.Uint32(serverCookie[4:])), 0)
+	if now.Sub(made) > serverCookieLifetime || made.Sub(now) > serverCookieMaxSkew {
+		return false
+	}
+	expected := s.serverCookie(clientCookie, ip, binary.BigEndian.Uint32(serverCookie[4:]))
+	return hmac.Equal(expected, serverCookie)
+}
+
+// queryCookie returns the client and server cookies of dnsMsg's COOKIE
+// option, along with its status. The server cookie is not verified.
+func queryCookie(dnsMsg *dns.Msg) (clientCookie, serverCookie []byte, status cookieStatus) {
+	opt := dnsMsg.IsEdns0()
+	if opt == nil {
+		return nil, nil, cookieMissing
+	}
+	for _, option := range opt.Option {
+		cookie, ok := option.(*dns.EDNS0_COOKIE)
+		if !ok {
+			continue
+		}
+		b, err := hex.DecodeString(cookie.Cookie)
+		if err != nil || len(b) < clientCookieSize ||
+			(len(b) > clientCookieSize && len(b) < clientCookieSize+minServerCookieSize) ||
+			len(b) > clientCookieSize+maxServerCookieSize {
+			return nil, nil, cookieMalformed
+		}
+		if len(b) == clientCookieSize {
+			return b, nil, cookieClientOnly
+		}
+		return b[:clientCookieSize], b[clientCookieSize:], cookieInvalid
+	}
+	return nil, nil, cookieMissing
+}
+
+// checkCookie returns the status of the COOKIE option of the query dnsMsg
+// received from addr. It is cookieMissing if cookies are disabled.
+func (d *DNSServer) checkCookie(addr net.Addr, dnsMsg *dns.Msg, now time.Time) cookieStatus {
+	if d.cookies == nil {
+		return cookieMissing
+	}
+	clientCookie, serverCookie, status := queryCookie(dnsMsg)
+	if status == cookieInvalid && d.cookies.verify(clientCookie, serverCookie, addrIP(addr), now) {
+		return cookieValid
+	}
+	return status
+}
+
+// setServerCookie adds a COOKIE option with a fresh server cookie to the
+// response to dnsMsg if the query carried a well-formed client cookie.
+func (d *DNSServer) setServerCookie(addr net.Addr, dnsMsg *dns.Msg, respMsg *dns.Msg) {
+	if d.cookies == nil {
+		return
+	}
+	clientCookie, _, status := queryCookie(dnsMsg)
+	respOpt := respMsg.IsEdns0()
+	if status == cookieMissing || status == cookieMalformed || respOpt == nil {
+		return
+	}
+	serverCookie := d.cookies.serverCookie(clientCookie, addrIP(addr), uint32(time.Now().Unix()))
+	respOpt.Option = append(respOpt.Option, &dns.EDNS0_COOKIE{
+		Code:   dns.EDNS0COOKIE,
+		Cookie: hex.EncodeToString(clientCookie) + hex.EncodeToString(serverCookie),
+	})
+}
+
+// hasCookie returns whether respMsg carries a COOKIE option
+func hasCookie(respMsg *dns.Msg) bool {
+	opt := respMsg.IsEdns0()
+	if opt == nil {
+		return false
+	}
+	for _, option := range opt.Option {
+		if _, ok := option.(*dns.EDNS0_COOKIE); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// siphash24 returns the SipHash-2-4 of msg under key
+func siphash24(key [16]byte, msg []byte) uint64 {
+	k0 := binary.LittleEndian.Uint64(key[:8])
+	k1 := binary.LittleEndian.Uint64(key[8:])
+	v0 := k0 ^ 0x736f6d6570736575
+	v1 := k1 ^ 0x646f72616e646f6d
+	v2 := k0 ^ 0x6c7967656e657261
+	v3 := k1 ^ 0x7465646279746573
+
+	round := func() {
+		v0 += v1
+		v1 = bits.RotateLeft64(v1, 13)
+		v1 ^= v0
+		v0 = bits.RotateLeft64(v0, 32)
+		v2 += v3
+		v3 = bits.RotateLeft64(v3, 16)
+		v3 ^= v2
+		v0 += v3
+		v3 = bits.RotateLeft64(v3, 21)
+		v3 ^= v0
+		v2 += v1
+		v1 = bits.RotateLeft64(v1, 17)
+		v1 ^= v2
+		v2 = bits.RotateLeft64(v2, 32)
+	}
+
+	length := len(msg)
+	for ; len(msg) >= 8; msg = msg[8:] {
+		m := binary.LittleEndian.Uint64(msg)
+		v3 ^= m
+		round()
+		round()
+		v0 ^= m
+	}
+	var last [8]byte
+	copy(last[:], msg)
+	last[7] = byte(length)
+	m := binary.LittleEndian.Uint64(last[:])
+	v3 ^= m
+	round()
+	round()
+	v0 ^= m
+
+	v2 ^= 0xff
+	round()
+	round()
+	round()
+	round()
+	return v0 ^ v1 ^ v2 ^ v3
+}
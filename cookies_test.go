@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/hex"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestSipHash24(t *testing.T) {
+	// Test vector from the SipHash paper.
+	var key [16]byte
+	msg := make([]byte, 15)
+	for i := range key {
+		key[i] = byte(i)
+	}
+	for i := range msg {
+		msg[i] = byte(i)
+	}
+	if hash := siphash24(key, msg); hash != 0xa129ca6149be45e5 {
+		t.Fatalf("expected 0xa129ca6149be45e5, got %#x", hash)
+	}
+}
+
+// queryWithCookie sends an A query for testZone carrying cookie, hex
+// encoded, to d from ip and returns the response and whether the server
+// cookie was valid.
+func queryWithCookie(t *testing.T, d *DNSServer, ip net.IP, cookie string, transport dnsTransport) (*dns.Msg, bool) {
+	query := new(dns.Msg)
+	query.SetQuestion(testZone, dns.TypeA)
+	query.SetEdns0(ednsMaxUDPSize, false)
+	opt := query.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: cookie})
+	b, err := query.Pack()
+	if err != nil {
+		t.Fatalf("Pack: %s", err)
+	}
+	respBytes, hasValidCookie, err := d.answerDNSRequest(&net.UDPAddr{IP: ip}, b, transport)
+	if err != nil {
+		t.Fatalf("answerDNSRequest: %s", err)
+	}
+	resp := new(dns.Msg)
+	err = resp.Unpack(respBytes)
+	if err != nil {
+		t.Fatalf("Unpack: %s", err)
+	}
+	return resp, hasValidCookie
+}
+
+// responseCookie returns the hex encoded cookie of resp
+func responseCookie(resp *dns.Msg) string {
+	if opt := resp.IsEdns0(); opt != nil {
+		for _, option := range opt.Option {
+			if cookie, ok := option.(*dns.EDNS0_COOKIE); ok {
+				return cookie.Cookie
+			}
+		}
+	}
+	return ""
+}
+
+func TestDNSCookies(t *testing.T) {
+	newServer := func(master string) *DNSServer {
+		cfg := testDNSServerConfig()
+		cfg.Cookies = newCookieSecrets([]byte(master))
+		return NewDNSServer(cfg, []*DNSZoneConfig{{
+			Hostname:   testZone,
+			Nameserver: "ns.example.org",
+			Manager:    setupAnswerPoolManager(t, 2, newPeerSelector(0, 0, nil, nil, 0, globalRand{})),
+		}}, nil)
+	}
+	d := newServer("shared cookie secret")
+	clientIP := net.IPv4(192, 0, 2, 1)
+	clientCookie := "0102030405060708"
+
+	resp, hasValidCookie := queryWithCookie(t, d, clientIP, clientCookie, transportUDP)
+	cookie := responseCookie(resp)
+	if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) == 0 || hasValidCookie {
+		t.Fatalf("expected a normal answer to a client cookie, got:\n%s", resp)
+	}
+	if len(cookie) != 2*(clientCookieSize+serverCookieSize) || cookie[:16] != clientCookie {
+		t.Fatalf("expected the client cookie followed by a server cookie, got %s", cookie)
+	}
+
+	resp, hasValidCookie = queryWithCookie(t, d, clientIP, cookie, transportUDP)
+	if resp.Rcode != dns.RcodeSuccess || !hasValidCookie {
+		t.Fatalf("expected the server cookie to be valid, got:\n%s", resp)
+	}
+
+	// Instances sharing the secret accept each other's cookies.
+	_, hasValidCookie = queryWithCookie(t, newServer("shared cookie secret"), clientIP, cookie, transportUDP)
+	if !hasValidCookie {
+		t.Fatalf("expected a server cookie of another instance with the same secret to be valid")
+	}
+
+	tests := []struct {
+		name   string
+		ip     net.IP
+		cookie string
+	}{
+		{"other client IP", net.IPv4(192, 0, 2, 2), cookie},
+		{"other client cookie", clientIP, "1102030405060708" + cookie[16:]},
+		{"other secret", clientIP, cookie},
+	}
+	for i, test := range tests {
+		server := d
+		if i == 2 {
+			server = newServer("another cookie secret")
+		}
+		resp, hasValidCookie = queryWithCookie(t, server, test.ip, test.cookie, transportUDP)
+		if resp.Rcode != dns.RcodeBadCookie || hasValidCookie || len(resp.Answer) != 0 {
+			t.Fatalf("%s: expected BADCOOKIE, got:\n%s", test.name, resp)
+		}
+		if fresh := responseCookie(resp); len(fresh) != len(cookie) || fresh == test.cookie {
+			t.Fatalf("%s: expected a fresh server cookie, got %s", test.name, fresh)
+		}
+		resp, _ = queryWithCookie(t, server, test.ip, test.cookie, transportTCP)
+		if resp.Rcode != dns.RcodeSuccess {
+			t.Fatalf("%s: expected a normal answer over TCP, got:\n%s", test.name, resp)
+		}
+	}
+
+	resp, _ = queryWithCookie(t, d, clientIP, "01020304", transportUDP)
+	if resp.Rcode != dns.RcodeFormatError || responseCookie(resp) != "" {
+		t.Fatalf("expected FORMERR for a malformed cookie, got:\n%s", resp)
+	}
+
+	// Rate limited responses to clients with cookies carry BADCOOKIE
+	// rather than the TC flag.
+	resp, _ = queryWithCookie(t, d, clientIP, clientCookie, transportUDP)
+	respBytes, err := resp.Pack()
+	if err != nil {
+		t.Fatalf("Pack: %s", err)
+	}
+	slipped, err := slipResponse(respBytes)
+	if err != nil {
+		t.Fatalf("slipResponse: %s", err)
+	}
+	err = resp.Unpack(slipped)
+	if err != nil {
+		t.Fatalf("Unpack: %s", err)
+	}
+	if resp.Rcode != dns.RcodeBadCookie || resp.Truncated || responseCookie(resp) == "" {
+		t.Fatalf("expected a slipped BADCOOKIE response with a server cookie, got:\n%s", resp)
+	}
+
+	// Without secrets, cookies are disabled and ignored.
+	disabled := NewDNSServer(testDNSServerConfig(), []*DNSZoneConfig{{
+		Hostname:   testZone,
+		Nameserver: "ns.example.org",
+		Manager:    setupAnswerPoolManager(t, 2, newPeerSelector(0, 0, nil, nil, 0, globalRand{})),
+	}}, nil)
+	resp, hasValidCookie = queryWithCookie(t, disabled, clientIP, "1102030405060708"+cookie[16:], transportUDP)
+	if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) == 0 || hasValidCookie || responseCookie(resp) != "" {
+		t.Fatalf("expected a normal answer without a cookie, got:\n%s", resp)
+	}
+}
+
+func TestServerCookieLifetime(t *testing.T) {
+	s := newCookieSecrets([]byte("cookie secret"))
+	clientCookie, _ := hex.DecodeString("0102030405060708")
+	ip := net.IPv4(192, 0, 2, 1)
+
+	// The secret rotates right after the cookie is made.
+	rotation := time.Unix(0, 0).Add(1000 * cookieSecretRotation)
+	made := rotation.Add(-time.Minute)
+	serverCookie := s.serverCookie(clientCookie, ip, uint32(made.Unix()))
+	if s.secret(uint32(made.Unix())) == s.secret(uint32(rotation.Unix())) {
+		t.Fatalf("expected the secret to rotate")
+	}
+
+	tests := []struct {
+		now   time.Time
+		valid bool
+	}{
+		{made, true},
+		{rotation.Add(time.Minute), true},
+		{made.Add(serverCookieLifetime + time.Second), false},
+		{made.Add(-serverCookieMaxSkew - time.Second), false},
+	}
+	for _, test := range tests {
+		if valid := s.verify(clientCookie, serverCookie, ip, test.now); valid != test.valid {
+			t.Fatalf("%s after making the cookie: expected valid=%t", test.now.Sub(made), test.valid)
+		}
+	}
+}
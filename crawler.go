@@ -0,0 +1,314 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kaspanet/kaspad/app/appmessage"
+	"github.com/kaspanet/kaspad/infrastructure/config"
+	"github.com/kaspanet/kaspad/infrastructure/network/dnsseed"
+	"github.com/kaspanet/kaspad/util/panics"
+	"github.com/pkg/errors"
+)
+
+const (
+	// defaultCrawlWorkers is the default number of peers each crawler
+	// polls at once.
+	defaultCrawlWorkers = 16
+
+	// defaultCrawlRate is the default number of new peer connections
+	// per second opened by all crawlers together.
+	defaultCrawlRate = 10
+
+	// defaultCrawlTimeout is the default time allowed for polling a
+	// single peer.
+	defaultCrawlTimeout = 30 * time.Second
+
+	// crawlQueueFactor is the size of a crawler's queue relative to its
+	// number of workers.
+	crawlQueueFactor = 2
+
+	// crawlIdleInterval is the time a crawler waits before looking for
+	// peers to poll again after it found none.
+	crawlIdleInterval = 10 * time.Second
+)
+
+// crawler discovers and polls the nodes of a single network, and records
+// the results in the network's Manager. A pool of workers polls the peers
+// fed to its queue, which is refilled as soon as there is room in it.
+type crawler struct {
+	amgr          *Manager
+	networkFlags  config.NetworkFlags
+	knownPeers    string
+	defaultSeeder *appmessage.NetAddress
+
+	workers int
+	timeout time.Duration
+	pacer   *connectionPacer
+	dialer  *peerDialer
+	queue   chan *appmessage.NetAddress
+
+	// inFlight holds the IPs of the peers that are queued or being
+	// polled, so that they are not queued again.
+	inFlightLock sync.Mutex
+	inFlight     map[string]struct{}
+}
+
+// newCrawler returns a crawler for the network of zone, whose nodes are
+// kept by amgr. It polls up to workers peers at once, opening connections
+// as paced by pacer through dialer and giving up on a peer after timeout.
+// The zone's seeder, if any, is resolved and added to amgr.
+func newCrawler(zone *ZoneConfig, amgr *Manager, workers int, timeout time.Duration,
+	pacer *connectionPacer, dialer *peerDialer) (*crawler, error) {
+
+	c := &crawler{
+		amgr:         amgr,
+		networkFlags: zone.NetworkFlags,
+		knownPeers:   zone.KnownPeers,
+		workers:      workers,
+		timeout:      timeout,
+		pacer:        pacer,
+		dialer:       dialer,
+		queue:        make(chan *appmessage.NetAddress, crawlQueueFactor*workers),
+		inFlight:     make(map[string]struct{}),
+	}
+	if len(zone.Seeder) != 0 {
+		var err error
+		c.defaultSeeder, err = resolveSeeder(zone.Seeder, amgr.defaultPort, dialer.lookupIP)
+		if err != nil {
+			return nil, err
+		}
+		if c.defaultSeeder != nil {
+			amgr.AddAddresses([]*appmessage.NetAddress{c.defaultSeeder})
+		}
+	}
+	return c, nil
+}
+
+// connectionPacer spaces out the connections opened by the crawlers, so that
+// no more than a given number are opened per second.
+type connectionPacer struct {
+	interval time.Duration
+
+	mtx  sync.Mutex
+	next time.Time
+}
+
+// newConnectionPacer returns a pacer allowing rate connections per second.
+func newConnectionPacer(rate float64) *connectionPacer {
+	return &connectionPacer{interval: time.Duration(float64(time.Second) / rate)}
+}
+
+// reserve returns the time from which the caller may open a connection,
+// which is no earlier than now.
+func (p *connectionPacer) reserve(now time.Time) time.Time {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	if p.next.Before(now) {
+		p.next = now
+	}
+	slot := p.next
+	p.next = p.next.Add(p.interval)
+	return slot
+}
+
+// resolveSeeder resolves the address of a working node, given either as a
+// simple IP or hostname, which uses the network's default port, or in full
+// host:port format. Host names are resolved by lookup. It returns nil if the
+// host cannot be resolved, and an error if the port is invalid.
+func resolveSeeder(seeder string, defaultPort uint16,
+	lookup func(host string) ([]net.IP, error)) (*appmessage.NetAddress, error) {
+	seederIP := seeder
+	seederPort := int(defaultPort)
+
+	// Try to split seeder host and port
+	foundIP, foundPort, err := net.SplitHostPort(seeder)
+	if err == nil {
+		seederIP = foundIP
+		seederPort, err = strconv.Atoi(foundPort)
+		if err != nil {
+			return nil, errors.Errorf("invalid seeder port: %s", foundPort)
+		}
+	}
+
+	ip := net.ParseIP(seederIP)
+	if ip == nil {
+		hostIPs, err := lookup(seederIP)
+		if err != nil {
+			log.Warnf("Failed to resolve seed host: %v, %v, ignoring", seederIP, err)
+			return nil, nil
+		}
+		if len(hostIPs) == 0 {
+			log.Warnf("Failed to resolve seed host: %v, ignoring", seederIP)
+			return nil, nil
+		}
+		ip = hostIPs[0]
+	}
+	return appmessage.NewNetAddressIPPort(ip, uint16(seederPort)), nil
+}
+
+func (c *crawler) creep() {
+	defer wg.Done()
+
+	netParams := c.networkFlags.NetParams()
+	netAdapter, err := newCrawlerNetAdapter(&config.Config{Flags: &config.Flags{NetworkFlags: c.networkFlags}},
+		c.dialer)
+	if err != nil {
+		panic(errors.Wrap(err, "Could not start net adapter"))
+	}
+
+	var knownPeers []*appmessage.NetAddress
+
+	if len(c.knownPeers) != 0 {
+		for _, p := range strings.Split(c.knownPeers, ",") {
+			addressStr := strings.Split(p, ":")
+			if len(addressStr) != 2 {
+				log.Errorf("Invalid peer address: %s; addresses should be in format \"IP\":\"port\"", p)
+				return
+			}
+
+			ip := net.ParseIP(addressStr[0])
+			if ip == nil {
+				log.Errorf("Invalid peer IP address: %s", addressStr[0])
+				return
+			}
+			port, err := strconv.Atoi(addressStr[1])
+			if err != nil {
+				log.Errorf("Invalid peer port: %s", addressStr[1])
+				return
+			}
+
+			knownPeers = append(knownPeers, appmessage.NewNetAddressIPPort(ip, uint16(port)))
+		}
+
+		c.amgr.AddAddresses(knownPeers)
+		for _, peer := range knownPeers {
+			c.amgr.Good(peer.IP, nil)
+			c.amgr.Attempt(peer.IP)
+		}
+	}
+
+	var workers sync.WaitGroup
+	for i := 0; i < c.workers; i++ {
+		workers.Add(1)
+		spawn("crawler.crawlWorker", func() {
+			defer workers.Done()
+			c.crawlWorker(netAdapter)
+		})
+	}
+
+	for atomic.LoadInt32(&systemShutdown) == 0 {
+		if len(c.queue) == cap(c.queue) {
+			// Wait for a worker to take a peer off the queue.
+			time.Sleep(c.pacer.interval)
+			continue
+		}
+		if c.refillQueue() > 0 {
+			continue
+		}
+		if c.inFlightCount() == 0 {
+			if c.amgr.AddressCount() == 0 {
+				// Add peers discovered through DNS to the address manager.
+				dnsseed.SeedFromDNS(netParams, "", true,
+					nil, c.dialer.lookupIP, func(addrs []*appmessage.NetAddress) {
+						c.amgr.AddAddresses(addrs)
+					})
+				if c.refillQueue() > 0 {
+					continue
+				}
+			}
+			// Every peer that was due has been polled.
+			c.amgr.CrawlRoundDone()
+		}
+		log.Debugf("%s: no stale addresses to queue -- sleeping for %s", netParams.Name, crawlIdleInterval)
+		for i := 0; i < int(crawlIdleInterval/time.Second) && atomic.LoadInt32(&systemShutdown) == 0; i++ {
+			time.Sleep(time.Second)
+		}
+	}
+
+	log.Infof("%s: waiting creep threads to terminate", netParams.Name)
+	close(c.queue)
+	workers.Wait()
+	log.Infof("%s: creep thread shutdown", netParams.Name)
+}
+
+// refillQueue queues the peers that are due to be polled and not yet in
+// flight, as many as fit in the queue, and returns their number.
+func (c *crawler) refillQueue() int {
+	addrs := c.amgr.Addresses(cap(c.queue)-len(c.queue), func(node *Node) bool {
+		c.inFlightLock.Lock()
+		defer c.inFlightLock.Unlock()
+		_, ok := c.inFlight[node.Addr.IP.String()]
+		return ok
+	})
+	c.inFlightLock.Lock()
+	for _, addr := range addrs {
+		c.inFlight[addr.IP.String()] = struct{}{}
+	}
+	c.inFlightLock.Unlock()
+	for _, addr := range addrs {
+		c.queue <- addr
+	}
+	return len(addrs)
+}
+
+// inFlightCount returns the number of peers that are queued or being polled
+func (c *crawler) inFlightCount() int {
+	c.inFlightLock.Lock()
+	defer c.inFlightLock.Unlock()
+	return len(c.inFlight)
+}
+
+// crawlWorker polls the queued peers until the queue is closed. Peers still
+// queued when shutdown is requested are skipped.
+func (c *crawler) crawlWorker(netAdapter *crawlerNetAdapter) {
+	for addr := range c.queue {
+		if atomic.LoadInt32(&systemShutdown) == 0 {
+			time.Sleep(time.Until(c.pacer.reserve(time.Now())))
+			err := c.pollPeer(netAdapter, addr, time.Now().Add(c.timeout))
+			if err != nil {
+				log.Debugf(err.Error())
+				if c.defaultSeeder != nil && addr == c.defaultSeeder {
+					panics.Exit(log, "failed to poll default seeder")
+				}
+			}
+		}
+
+		c.inFlightLock.Lock()
+		delete(c.inFlight, addr.IP.String())
+		c.inFlightLock.Unlock()
+	}
+}
+
+// pollPeer connects to the peer at addr, adds the addresses it knows to the
+// manager, and records it as good along with the metadata of its version
+// message. It gives up at deadline.
+func (c *crawler) pollPeer(netAdapter *crawlerNetAdapter, addr *appmessage.NetAddress, deadline time.Time) error {
+	defer c.amgr.Attempt(addr.IP)
+
+	peerAddress := net.JoinHostPort(addr.IP.String(), strconv.Itoa(int(addr.Port)))
+	conn, err := netAdapter.Connect(peerAddress, deadline)
+	if err != nil {
+		return errors.Wrapf(err, "could not connect to %s", peerAddress)
+	}
+	defer conn.Disconnect()
+
+	addresses, err := conn.requestAddresses(deadline)
+	if err != nil {
+		return errors.Wrapf(err, "failed to receive addresses from %s", peerAddress)
+	}
+
+	added := c.amgr.AddAddresses(addresses)
+	log.Infof("Peer %s (%s, protocol version %d) sent %d addresses, %d new",
+		peerAddress, conn.version.UserAgent, conn.version.ProtocolVersion, len(addresses), added)
+
+	c.amgr.RecordLatency(addr.IP, conn.connectLatency, conn.handshakeLatency)
+	c.amgr.Good(addr.IP, conn.version)
+
+	return nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/kaspanet/kaspad/app/appmessage"
+)
+
+func TestConnectionPacer(t *testing.T) {
+	p := newConnectionPacer(4)
+	now := time.Unix(1000, 0)
+	for i := 0; i < 3; i++ {
+		if slot := p.reserve(now); !slot.Equal(now.Add(time.Duration(i) * 250 * time.Millisecond)) {
+			t.Fatalf("expected connection %d to wait %s, got %s", i, time.Duration(i)*250*time.Millisecond,
+				slot.Sub(now))
+		}
+	}
+	// Unused slots do not accumulate.
+	later := now.Add(time.Minute)
+	if slot := p.reserve(later); !slot.Equal(later) {
+		t.Fatalf("expected a connection after an idle minute to be opened right away, got %s", slot.Sub(later))
+	}
+}
+
+func TestCrawlerQueue(t *testing.T) {
+	m := setupAnswerPoolManager(t, 0, newPeerSelector(0, 0, nil, nil, 0, globalRand{}))
+	c, err := newCrawler(&ZoneConfig{}, m, 2, time.Second, newConnectionPacer(10),
+		newPeerDialer("", "", "", "", false, false))
+	if err != nil {
+		t.Fatalf("newCrawler: %s", err)
+	}
+	for i := 0; i < 10; i++ {
+		m.AddAddresses([]*appmessage.NetAddress{appmessage.NewNetAddressIPPort([]byte{1, 0, 0, byte(1 + i)}, testPort)})
+	}
+
+	if queued := c.refillQueue(); queued != 4 || len(c.queue) != 4 {
+		t.Fatalf("expected the queue to be filled with 4 peers, got %d", queued)
+	}
+	if queued := c.refillQueue(); queued != 0 {
+		t.Fatalf("expected a full queue to stay as it is, got %d more peers", queued)
+	}
+
+	// Peers taken off the queue stay in flight until they were polled.
+	seen := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		seen[(<-c.queue).IP.String()] = true
+	}
+	if queued := c.refillQueue(); queued != 2 || c.inFlightCount() != 6 {
+		t.Fatalf("expected 2 more peers and 6 in flight, got %d and %d", queued, c.inFlightCount())
+	}
+	for len(c.queue) > 0 {
+		ip := (<-c.queue).IP.String()
+		if seen[ip] {
+			t.Fatalf("expected %s to be queued only once", ip)
+		}
+		seen[ip] = true
+	}
+}
@@ -5,15 +5,20 @@
 package main
 
 import (
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
 	"fmt"
-	"github.com/kaspanet/kaspad/app/appmessage"
+	"io"
 	"net"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
-	"github.com/kaspanet/kaspad/domain/consensus/model/externalapi"
+	"github.com/kaspanet/kaspad/app/appmessage"
 	"github.com/kaspanet/kaspad/domain/consensus/utils/subnetworks"
 
 	"github.com/kaspanet/kaspad/infrastructure/network/dnsseed"
@@ -22,46 +27,321 @@ import (
 	"github.com/miekg/dns"
 )
 
-// DNSServer struct
-type DNSServer struct {
+const (
+	// tcpIdleTimeout is the time a DNS-over-TCP connection may stay idle
+	// before it is closed by the server.
+	tcpIdleTimeout = 10 * time.Second
+
+	// tcpWriteTimeout is the time allowed for writing a single response
+	// to a DNS-over-TCP connection.
+	tcpWriteTimeout = 5 * time.Second
+
+	// ednsMaxUDPSize is the largest UDP payload the server is willing to
+	// send, regardless of the size advertised by the client. It is also
+	// the size advertised in the server's own OPT records.
+	ednsMaxUDPSize = 1232
+
+	// maxAddressesPerResponse is the upper bound on the number of
+	// addresses offered in a single response.
+	maxAddressesPerResponse = 128
+
+	// dnsHeaderSize is the size of the fixed DNS message header.
+	dnsHeaderSize = 12
+
+	// protocolVersionPrefixChar and servicesPrefixChar prefix the query
+	// labels that filter nodes by protocol version and service flags.
+	protocolVersionPrefixChar = 'v'
+	servicesPrefixChar        = 's'
+
+	// peerTargetPrefixChar prefixes the SRV target names that encode a
+	// peer's IP and port.
+	peerTargetPrefixChar = 'p'
+
+	// srvServiceName is the service and protocol part of the names SRV
+	// records are served on, in front of the seeder's hostname.
+	srvServiceName = "_kaspa._tcp"
+
+	// srvProtocolName is the protocol label of srvServiceName, which names
+	// an empty non-terminal in front of the seeder's hostname.
+	srvProtocolName = "_tcp"
+
+	// soaTTL is the TTL of the zone's SOA record.
+	soaTTL = 86400
+
+	// soaRetry and soaExpire are the retry and expire timings, in
+	// seconds, advertised in the zone's SOA record.
+	soaRetry  = 600
+	soaExpire = 604800
+
+	// dotProtocol is the ALPN protocol ID of DNS-over-TLS.
+	dotProtocol = "dot"
+)
+
+// udpRequest is a UDP query waiting in the queue for a worker
+type udpRequest struct {
+	addr   *net.UDPAddr
+	conn   *net.UDPConn
+	buffer *[]byte
+	length int
+}
+
+// DNSZoneConfig describes a zone served by a DNSServer
+type DNSZoneConfig struct {
+	// Hostname and Nameserver are the zone's name and the name of its
+	// nameserver.
+	Hostname   string
+	Nameserver string
+
+	// Manager holds the nodes listed in the zone.
+	Manager *Manager
+
+	// Signer signs the zone's responses, or is nil if the zone is not
+	// signed.
+	Signer *dnssecSigner
+}
+
+// DNSServerConfig holds the settings of a DNSServer
+type DNSServerConfig struct {
+	// Listen holds the addresses to listen on for UDP and TCP queries.
+	Listen []string
+
+	// TLSListen and HTTPSListen hold the addresses to listen on for
+	// DNS-over-TLS and DNS-over-HTTPS queries. Certificates provides the
+	// certificate for both, and must be set if either is not empty.
+	TLSListen    []string
+	HTTPSListen  []string
+	Certificates *certificateLoader
+
+	// SOASerial, SOARefresh and SOAMinimum are the corresponding fields
+	// of the zones' SOA records. A zero serial is replaced by the current
+	// time.
+	SOASerial  uint32
+	SOARefresh uint32
+	SOAMinimum uint32
+
+	// AnswerTTL and NSTTL are the TTLs, in seconds, of the records
+	// listing peers and of the zones' NS records.
+	AnswerTTL uint32
+	NSTTL     uint32
+
+	// MaxAddresses is the number of addresses offered in an answer that
+	// has to fit in 512 bytes.
+	MaxAddresses int
+
+	// Workers and QueueSize are the number of workers handling UDP
+	// queries and the number of queries that may wait for them.
+	Workers   int
+	QueueSize int
+
+	// Geo locates clients so that they are answered with nearby nodes.
+	// It is nil if answers do not depend on the client's location.
+	Geo geoLocator
+
+	// Transfer enables zone transfers to secondary nameservers. It is nil
+	// if transfers are disabled.
+	Transfer *TransferConfig
+
+	// Cookies makes and verifies DNS server cookies. It is nil if DNS
+	// Cookies are disabled.
+	Cookies *cookieSecrets
+
+	// DNSTap logs queries and responses in dnstap format. It is nil if
+	// dnstap logging is disabled.
+	DNSTap *dnstapLogger
+}
+
+// dnsTransport is the transport a query was received over
+type dnsTransport int
+
+const (
+	transportUDP dnsTransport = iota
+	transportTCP
+	transportTLS
+	transportHTTPS
+)
+
+// dnsZone is a zone served by the DNS server
+type dnsZone struct {
 	hostname   string
-	listen     string
 	nameserver string
+	soa        *dns.SOA
+	authority  *dns.NS
+	signer     *dnssecSigner
+	amgr       *Manager
+
+	// zoneVersions holds the recent versions of the zone if it is
+	// transferred. lastTransferPools is the answer pools snapshot the
+	// current version was built from, and is only used by the transfer
+	// loop.
+	zoneVersions      atomic.Value
+	lastTransferPools *answerPools
+}
+
+// DNSServer struct
+type DNSServer struct {
+	listen       []string
+	tlsListen    []string
+	httpsListen  []string
+	certificates *certificateLoader
+	zones        []*dnsZone
+	answerTTL    uint32
+	maxAddresses int
+	rrl          *responseRateLimiter
+	workers      int
+	queueSize    int
+	geo          geoLocator
+	transfer     *TransferConfig
+	cookies      *cookieSecrets
+	dnstap       *dnstapLogger
+	startTime    time.Time
+
+	buffers         sync.Pool
+	droppedRequests uint64
 }
 
 // Start - starts server
 func (d *DNSServer) Start() {
 	defer wg.Done()
 
-	rr := fmt.Sprintf("%s 86400 IN NS %s", d.hostname, d.nameserver)
-	authority, err := dns.NewRR(rr)
+	var listeners []io.Closer
+	closeListeners := func() {
+		for _, listener := range listeners {
+			listener.Close()
+		}
+	}
+
+	udpListeners := make([]*net.UDPConn, 0, len(d.listen))
+	tcpListeners := make([]*net.TCPListener, 0, len(d.listen))
+	for _, listen := range d.listen {
+		udpListen, tcpListen, err := listenDNS(listen)
+		if err != nil {
+			log.Errorf("Failed to listen on %s: %v", listen, err)
+			closeListeners()
+			return
+		}
+		log.Infof("DNS server listening on %s", listen)
+		udpListeners = append(udpListeners, udpListen)
+		tcpListeners = append(tcpListeners, tcpListen)
+		listeners = append(listeners, udpListen, tcpListen)
+	}
+
+	tlsListeners := make([]*net.TCPListener, 0, len(d.tlsListen))
+	for _, listen := range d.tlsListen {
+		tlsListen, err := listenTCP(listen)
+		if err != nil {
+			log.Errorf("Failed to listen on %s: %v", listen, err)
+			closeListeners()
+			return
+		}
+		log.Infof("DNS-over-TLS server listening on %s", listen)
+		tlsListeners = append(tlsListeners, tlsListen)
+		listeners = append(listeners, tlsListen)
+	}
+
+	httpsListeners := make([]*net.TCPListener, 0, len(d.httpsListen))
+	for _, listen := range d.httpsListen {
+		httpsListen, err := listenTCP(listen)
+		if err != nil {
+			log.Errorf("Failed to listen on %s: %v", listen, err)
+			closeListeners()
+			return
+		}
+		log.Infof("DNS-over-HTTPS server listening on %s", listen)
+		httpsListeners = append(httpsListeners, httpsListen)
+		listeners = append(listeners, httpsListen)
+	}
+
+	requests := make(chan *udpRequest, d.queueSize)
+	for i := 0; i < d.workers; i++ {
+		wg.Add(1)
+		spawn("DNSServer.Start-DNSServer.udpWorker", func() { d.udpWorker(requests) })
+	}
+
+	var wgUDP sync.WaitGroup
+	for i := range d.listen {
+		udpListen, tcpListen := udpListeners[i], tcpListeners[i]
+		wgUDP.Add(1)
+		spawn("DNSServer.Start-DNSServer.serveUDP", func() {
+			defer wgUDP.Done()
+			d.serveUDP(udpListen, requests)
+		})
+		wg.Add(1)
+		spawn("DNSServer.Start-DNSServer.serveTCP", func() { d.serveTCP(tcpListen, nil) })
+	}
+	for _, tlsListen := range tlsListeners {
+		tlsListen := tlsListen
+		wg.Add(1)
+		spawn("DNSServer.Start-DNSServer.serveTCP", func() {
+			d.serveTCP(tlsListen, d.certificates.tlsConfig(dotProtocol))
+		})
+	}
+	for _, httpsListen := range httpsListeners {
+		httpsListen := httpsListen
+		wg.Add(1)
+		spawn("DNSServer.Start-DNSServer.serveHTTPS", func() { d.serveHTTPS(httpsListen) })
+	}
+	if d.transfer != nil {
+		wg.Add(1)
+		spawn("DNSServer.Start-DNSServer.transferLoop", d.transferLoop)
+	}
+
+	// Once all the UDP listeners have shut down, let the workers drain
+	// the queue and exit.
+	wgUDP.Wait()
+	close(requests)
+}
+
+// listenDNS opens the UDP and TCP listeners for a single listen address,
+// which may be an IPv4 or IPv6 address or a hostname.
+func listenDNS(listen string) (*net.UDPConn, *net.TCPListener, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", listen)
 	if err != nil {
-		log.Infof("NewRR: %v", err)
-		return
+		return nil, nil, errors.Wrap(err, "ResolveUDPAddr")
+	}
+	udpListen, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "ListenUDP")
 	}
 
-	udpAddr, err := net.ResolveUDPAddr("udp4", d.listen)
+	tcpListen, err := listenTCP(listen)
 	if err != nil {
-		log.Infof("ResolveUDPAddr: %v", err)
-		return
+		udpListen.Close()
+		return nil, nil, err
 	}
 
-	udpListen, err := net.ListenUDP("udp", udpAddr)
+	return udpListen, tcpListen, nil
+}
+
+// listenTCP opens a TCP listener on the given listen address.
+func listenTCP(listen string) (*net.TCPListener, error) {
+	tcpAddr, err := net.ResolveTCPAddr("tcp", listen)
 	if err != nil {
-		log.Infof("ListenUDP: %v", err)
-		return
+		return nil, errors.Wrap(err, "ResolveTCPAddr")
+	}
+	tcpListen, err := net.ListenTCP("tcp", tcpAddr)
+	if err != nil {
+		return nil, errors.Wrap(err, "ListenTCP")
 	}
+	return tcpListen, nil
+}
+
+// serveUDP reads DNS queries from udpListen and queues them for the
+// workers until system shutdown is requested. Queries arriving while the
+// queue is full are dropped.
+func (d *DNSServer) serveUDP(udpListen *net.UDPConn, requests chan<- *udpRequest) {
 	defer udpListen.Close()
 
+	lastDropLog := time.Now()
+	var loggedDropped uint64
 	for {
-		b := make([]byte, 512)
+		b := d.buffers.Get().(*[]byte)
 	mainLoop:
 		err := udpListen.SetReadDeadline(time.Now().Add(time.Second))
 		if err != nil {
 			log.Infof("SetReadDeadline: %v", err)
 			os.Exit(1)
 		}
-		_, addr, err := udpListen.ReadFromUDP(b)
+		n, addr, err := udpListen.ReadFromUDP(*b)
 		if err != nil {
 			var netErr net.Error
 			if errors.As(err, &netErr) && netErr.Timeout() {
@@ -69,7 +349,8 @@ func (d *DNSServer) Start() {
 					// use goto in order to do not re-allocate 'b' buffer
 					goto mainLoop
 				}
-				log.Infof("DNS server shutdown")
+				d.buffers.Put(b)
+				log.Infof("DNS server on udp %s shutdown", udpListen.LocalAddr())
 				return
 			}
 			var opErr *net.OpError
@@ -78,132 +359,705 @@ func (d *DNSServer) Start() {
 			} else {
 				log.Errorf("Unknown error: %s", err)
 			}
+			d.buffers.Put(b)
 			continue
 		}
 
+		select {
+		case requests <- &udpRequest{addr: addr, conn: udpListen, buffer: b, length: n}:
+		default:
+			d.buffers.Put(b)
+			dropped := atomic.AddUint64(&d.droppedRequests, 1)
+			if time.Since(lastDropLog) > time.Minute || loggedDropped == 0 {
+				log.Warnf("DNS request queue is full: %d requests dropped in total", dropped)
+				lastDropLog = time.Now()
+				loggedDropped = dropped
+			}
+		}
+	}
+}
+
+// udpWorker handles queued UDP queries until the queue is closed.
+func (d *DNSServer) udpWorker(requests <-chan *udpRequest) {
+	defer wg.Done()
+
+	for request := range requests {
+		d.handleUDPRequest(request.addr, request.conn, (*request.buffer)[:request.length])
+		d.buffers.Put(request.buffer)
+	}
+}
+
+// serveTCP accepts DNS-over-TCP connections until system shutdown is
+// requested, after which the listener and all open connections are closed.
+// If tlsConfig is not nil, the connections are DNS-over-TLS ones as
+// described in RFC 7858, which use the same framing inside a TLS session.
+func (d *DNSServer) serveTCP(tcpListen *net.TCPListener, tlsConfig *tls.Config) {
+	defer wg.Done()
+	defer tcpListen.Close()
+
+	transport := "tcp"
+	if tlsConfig != nil {
+		transport = "tls"
+	}
+
+	var connsMtx sync.Mutex
+	conns := make(map[net.Conn]struct{})
+	defer func() {
+		connsMtx.Lock()
+		for conn := range conns {
+			conn.Close()
+		}
+		connsMtx.Unlock()
+	}()
+
+	for {
+		err := tcpListen.SetDeadline(time.Now().Add(time.Second))
+		if err != nil {
+			log.Infof("SetDeadline: %v", err)
+			os.Exit(1)
+		}
+		var conn net.Conn
+		conn, err = tcpListen.AcceptTCP()
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				if atomic.LoadInt32(&systemShutdown) == 0 {
+					continue
+				}
+				log.Infof("DNS server on %s %s shutdown", transport, tcpListen.Addr())
+				return
+			}
+			log.Infof("Accept: %v", err)
+			continue
+		}
+		if tlsConfig != nil {
+			conn = tls.Server(conn, tlsConfig)
+		}
+
+		connsMtx.Lock()
+		conns[conn] = struct{}{}
+		connsMtx.Unlock()
+
 		wg.Add(1)
+		spawn("DNSServer.serveTCP-DNSServer.handleTCPConnection", func() {
+			d.handleTCPConnection(conn)
 
-		spawn("DNSServer.Start-DNSServer.handleDNSRequest",
-			func() { d.handleDNSRequest(addr, authority, udpListen, b) })
+			connsMtx.Lock()
+			delete(conns, conn)
+			connsMtx.Unlock()
+		})
+	}
+}
+
+// handleTCPConnection serves DNS queries received over conn, framed with the
+// two byte length prefix defined in RFC 1035 section 4.2.2, until the client
+// closes the connection or it stays idle for tcpIdleTimeout.
+func (d *DNSServer) handleTCPConnection(conn net.Conn) {
+	defer wg.Done()
+	defer conn.Close()
+
+	addr := conn.RemoteAddr()
+	transport := transportTCP
+	if _, ok := conn.(*tls.Conn); ok {
+		transport = transportTLS
+	}
+	lengthPrefix := make([]byte, 2)
+	for {
+		err := conn.SetReadDeadline(time.Now().Add(tcpIdleTimeout))
+		if err != nil {
+			log.Infof("%s: SetReadDeadline: %v", addr, err)
+			return
+		}
+		_, err = io.ReadFull(conn, lengthPrefix)
+		if err != nil {
+			return
+		}
+		b := make([]byte, binary.BigEndian.Uint16(lengthPrefix))
+		_, err = io.ReadFull(conn, b)
+		if err != nil {
+			log.Infof("%s: failed to read query: %v", addr, err)
+			return
+		}
+
+		var responses [][]byte
+		if isTransferQuery(b) {
+			responses, err = d.handleTransferRequest(addr, b, true)
+		} else {
+			var sendBytes []byte
+			sendBytes, err = d.handleDNSRequest(addr, b, transport)
+			responses = [][]byte{sendBytes}
+		}
+		if err != nil {
+			continue
+		}
+
+		var response []byte
+		for _, sendBytes := range responses {
+			response = append(response, byte(len(sendBytes)>>8), byte(len(sendBytes)))
+			response = append(response, sendBytes...)
+		}
+
+		err = conn.SetWriteDeadline(time.Now().Add(tcpWriteTimeout))
+		if err != nil {
+			log.Infof("%s: SetWriteDeadline: %v", addr, err)
+			return
+		}
+		_, err = conn.Write(response)
+		if err != nil {
+			log.Infof("%s: failed to write response: %v", addr, err)
+			return
+		}
 	}
 }
 
 // NewDNSServer - create DNS server
-func NewDNSServer(hostname, nameserver, listen string) *DNSServer {
-	if hostname[len(hostname)-1] != '.' {
-		hostname = hostname + "."
+func NewDNSServer(cfg *DNSServerConfig, zones []*DNSZoneConfig, rrl *responseRateLimiter) *DNSServer {
+	soaSerial := cfg.SOASerial
+	if soaSerial == 0 {
+		soaSerial = uint32(time.Now().Unix())
+	}
+
+	d := &DNSServer{
+		listen:       cfg.Listen,
+		tlsListen:    cfg.TLSListen,
+		httpsListen:  cfg.HTTPSListen,
+		certificates: cfg.Certificates,
+		answerTTL:    cfg.AnswerTTL,
+		maxAddresses: cfg.MaxAddresses,
+		rrl:          rrl,
+		workers:      cfg.Workers,
+		queueSize:    cfg.QueueSize,
+		geo:          cfg.Geo,
+		transfer:     cfg.Transfer,
+		cookies:      cfg.Cookies,
+		dnstap:       cfg.DNSTap,
+		startTime:    time.Now(),
+		buffers: sync.Pool{
+			New: func() interface{} {
+				b := make([]byte, ednsMaxUDPSize)
+				return &b
+			},
+		},
 	}
-	if nameserver[len(nameserver)-1] != '.' {
-		nameserver = nameserver + "."
+	for _, zone := range zones {
+		hostname := dns.Fqdn(strings.ToLower(zone.Hostname))
+		nameserver := dns.Fqdn(zone.Nameserver)
+		d.zones = append(d.zones, &dnsZone{
+			hostname:   hostname,
+			nameserver: nameserver,
+			soa: &dns.SOA{
+				Hdr:     dns.RR_Header{Name: hostname, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: soaTTL},
+				Ns:      nameserver,
+				Mbox:    "hostmaster." + hostname,
+				Serial:  soaSerial,
+				Refresh: cfg.SOARefresh,
+				Retry:   soaRetry,
+				Expire:  soaExpire,
+				Minttl:  cfg.SOAMinimum,
+			},
+			authority: &dns.NS{
+				Hdr: dns.RR_Header{Name: hostname, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: cfg.NSTTL},
+				Ns:  nameserver,
+			},
+			signer: zone.Signer,
+			amgr:   zone.Manager,
+		})
+	}
+	if d.transfer != nil {
+		for _, zone := range d.zones {
+			d.updateZoneVersion(zone)
+		}
 	}
+	return d
+}
 
-	return &DNSServer{
-		hostname:   hostname,
-		listen:     listen,
-		nameserver: nameserver,
+// findZone returns the zone domainName belongs to, or nil if the server is
+// not authoritative for it. If zones are nested, the innermost one is
+// returned.
+func (d *DNSServer) findZone(domainName string) *dnsZone {
+	var found *dnsZone
+	for _, zone := range d.zones {
+		if dns.IsSubDomain(zone.hostname, domainName) &&
+			(found == nil || len(zone.hostname) > len(found.hostname)) {
+			found = zone
+		}
 	}
+	return found
 }
 
-func (d *DNSServer) extractSubnetworkID(addr *net.UDPAddr, domainName string) (*externalapi.DomainSubnetworkID, bool, error) {
+// extractAddressFilter parses the labels domainName has in front of the
+// seeder's hostname into an address filter. It returns an error if the
+// labels are not understood, in which case the name does not exist in the
+// zone.
+func (d *DNSServer) extractAddressFilter(addr net.Addr, zone *dnsZone, domainName string) (*AddressFilter, error) {
 	// Domain name may be in following format:
-	//   [n[subnetwork].]hostname
-	// where connmgr.SubnetworkIDPrefixChar is a prefix
-	var subnetworkID *externalapi.DomainSubnetworkID
-	includeAllSubnetworks := true
-	if d.hostname != domainName {
-		labels := dns.SplitDomainName(domainName)
-		if labels[0][0] == dnsseed.SubnetworkIDPrefixChar {
-			includeAllSubnetworks = false
-			if len(labels[0]) > 1 {
-				subnetworkID, err := subnetworks.FromString(labels[0][1:])
+	//   [label.]...hostname
+	// where each label is one of the following, in any order and at most
+	// once each:
+	//   n[subnetwork] - nodes of the given subnetwork, where
+	//                   dnsseed.SubnetworkIDPrefixChar is a prefix and an
+	//                   empty subnetwork selects full nodes
+	//   v<version>    - nodes with at least the given protocol version
+	//   s<services>   - nodes with all the given service flags, in hex
+	filter := &AddressFilter{IncludeAllSubnetworks: true}
+	if zone.hostname == domainName {
+		return filter, nil
+	}
+
+	seen := make(map[byte]bool)
+	labels := dns.SplitDomainName(strings.TrimSuffix(domainName, "."+zone.hostname))
+	for _, label := range labels {
+		prefix, value := label[0], label[1:]
+		if seen[prefix] {
+			return nil, d.unknownNameError(addr, domainName)
+		}
+		seen[prefix] = true
+
+		switch prefix {
+		case dnsseed.SubnetworkIDPrefixChar:
+			filter.IncludeAllSubnetworks = false
+			if len(value) > 0 {
+				subnetworkID, err := subnetworks.FromString(value)
 				if err != nil {
 					log.Infof("%s: subnetworkid.NewFromStr: %v", addr, err)
-					return subnetworkID, includeAllSubnetworks, err
+					return nil, err
 				}
+				filter.SubnetworkID = subnetworkID
+			}
+		case protocolVersionPrefixChar:
+			protocolVersion, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				log.Infof("%s: invalid protocol version %s: %v", addr, value, err)
+				return nil, err
 			}
+			filter.MinProtocolVersion = uint32(protocolVersion)
+		case servicesPrefixChar:
+			services, err := strconv.ParseUint(value, 16, 64)
+			if err != nil {
+				log.Infof("%s: invalid service flags %s: %v", addr, value, err)
+				return nil, err
+			}
+			filter.Services = appmessage.ServiceFlag(services)
+		default:
+			return nil, d.unknownNameError(addr, domainName)
 		}
 	}
-	return subnetworkID, includeAllSubnetworks, nil
+	return filter, nil
+}
+
+func (d *DNSServer) unknownNameError(addr net.Addr, domainName string) error {
+	str := fmt.Sprintf("%s: unknown name: %s", addr, domainName)
+	log.Infof("%s", str)
+	return errors.Errorf("%s", str)
 }
 
-func (d *DNSServer) validateDNSRequest(addr *net.UDPAddr, b []byte) (dnsMsg *dns.Msg, domainName string, atype string, err error) {
+// validateDNSRequest parses the query in b and finds the zone it is routed
+// to. A non-nil error means the query should be dropped without an answer.
+// Otherwise, if rcode is anything but dns.RcodeSuccess, the query must be
+// answered with that response code.
+func (d *DNSServer) validateDNSRequest(addr net.Addr, b []byte) (dnsMsg *dns.Msg, zone *dnsZone, domainName string,
+	rcode int, err error) {
+
 	dnsMsg = new(dns.Msg)
-	err = dnsMsg.Unpack(b[:])
+	err = dnsMsg.Unpack(b)
 	if err != nil {
 		log.Infof("%s: invalid dns message: %v", addr, err)
-		return nil, "", "", err
+		if len(b) < dnsHeaderSize || dnsMsg.Response {
+			return nil, nil, "", 0, err
+		}
+		// The header could be parsed, so the client can be told
+		// that the rest of its query is malformed.
+		dnsMsg.Question = nil
+		return dnsMsg, nil, "", dns.RcodeFormatError, nil
 	}
-	if len(dnsMsg.Question) != 1 {
-		str := fmt.Sprintf("%s sent more than 1 question: %d", addr, len(dnsMsg.Question))
+	if dnsMsg.Response {
+		str := fmt.Sprintf("%s sent a response instead of a query", addr)
 		log.Infof("%s", str)
-		return nil, "", "", errors.Errorf("%s", str)
+		return nil, nil, "", 0, errors.Errorf("%s", str)
+	}
+	if dnsMsg.Opcode != dns.OpcodeQuery {
+		log.Infof("%s: unsupported opcode: %d", addr, dnsMsg.Opcode)
+		return dnsMsg, nil, "", dns.RcodeNotImplemented, nil
+	}
+	if len(dnsMsg.Question) != 1 {
+		log.Infof("%s sent more than 1 question: %d", addr, len(dnsMsg.Question))
+		dnsMsg.Question = nil
+		return dnsMsg, nil, "", dns.RcodeFormatError, nil
+	}
+	if opt := dnsMsg.IsEdns0(); opt != nil && opt.Version() != 0 {
+		log.Infof("%s: unsupported EDNS version %d", addr, opt.Version())
+		return dnsMsg, nil, "", dns.RcodeBadVers, nil
 	}
 	domainName = strings.ToLower(dnsMsg.Question[0].Name)
-	ff := strings.LastIndex(domainName, d.hostname)
-	if ff < 0 {
-		str := fmt.Sprintf("invalid name: %s", dnsMsg.Question[0].Name)
-		log.Infof("%s", str)
-		return nil, "", "", errors.Errorf("%s", str)
+	zone = d.findZone(domainName)
+	if zone == nil || dnsMsg.Question[0].Qclass != dns.ClassINET {
+		log.Infof("%s: refusing query for %s", addr, dnsMsg.Question[0].Name)
+		return dnsMsg, nil, "", dns.RcodeRefused, nil
 	}
-	atype, err = translateDNSQuestion(addr, dnsMsg)
-	return dnsMsg, domainName, atype, err
+	return dnsMsg, zone, domainName, dns.RcodeSuccess, nil
 }
 
-func translateDNSQuestion(addr *net.UDPAddr, dnsMsg *dns.Msg) (string, error) {
-	var atype string
-	qtype := dnsMsg.Question[0].Qtype
-	switch qtype {
-	case dns.TypeA:
-		atype = "A"
-	case dns.TypeAAAA:
-		atype = "AAAA"
-	case dns.TypeNS:
-		atype = "NS"
-	default:
-		str := fmt.Sprintf("%s: invalid qtype: %d", addr, dnsMsg.Question[0].Qtype)
-		log.Infof("%s", str)
-		return "", errors.Errorf("%s", str)
+// responseSize returns the maximum size of a response to dnsMsg. Over TCP
+// this is the largest possible DNS message; over UDP it is the payload size
+// advertised in the query's OPT record, bounded by ednsMaxUDPSize, or 512
+// bytes if the query carries no OPT record.
+func responseSize(dnsMsg *dns.Msg, isTCP bool) int {
+	if isTCP {
+		return dns.MaxMsgSize
 	}
-	return atype, nil
+	opt := dnsMsg.IsEdns0()
+	if opt == nil {
+		return dns.MinMsgSize
+	}
+	size := int(opt.UDPSize())
+	if size < dns.MinMsgSize {
+		size = dns.MinMsgSize
+	}
+	if size > ednsMaxUDPSize {
+		size = ednsMaxUDPSize
+	}
+	return size
 }
 
-func (d *DNSServer) buildDNSResponse(addr *net.UDPAddr, authority dns.RR, dnsMsg *dns.Msg, includeAllSubnetworks bool,
-	subnetworkID *externalapi.DomainSubnetworkID, atype string) ([]byte, error) {
+// maxAddressesForSize returns how many addresses should be offered in a
+// response limited to size bytes. Clients advertising larger buffers get
+// proportionally more addresses.
+func (d *DNSServer) maxAddressesForSize(size int) int {
+	maxAddresses := d.maxAddresses * size / dns.MinMsgSize
+	if maxAddresses > maxAddressesPerResponse {
+		maxAddresses = maxAddressesPerResponse
+	}
+	return maxAddresses
+}
 
-	respMsg := dnsMsg.Copy()
-	respMsg.Authoritative = true
-	respMsg.Response = true
+// newDNSResponse creates an authoritative reply to dnsMsg with the given
+// response code, echoing an OPT record if the query carried one. An EDNS
+// Client Subnet option is echoed with a scope prefix length of 0, meaning
+// that the response applies to all clients.
+func newDNSResponse(dnsMsg *dns.Msg, rcode int) *dns.Msg {
+	respMsg := new(dns.Msg).SetReply(dnsMsg)
+	respMsg.Authoritative = rcode == dns.RcodeSuccess || rcode == dns.RcodeNameError
+	respMsg.Compress = true
+	respMsg.Rcode = rcode
+	if opt := dnsMsg.IsEdns0(); opt != nil {
+		respMsg.SetEdns0(ednsMaxUDPSize, opt.Do())
+		if ecs := clientSubnet(dnsMsg); ecs != nil {
+			echo := *ecs
+			echo.SourceScope = 0
+			respOpt := respMsg.IsEdns0()
+			respOpt.Option = append(respOpt.Option, &echo)
+		}
+	}
+	return respMsg
+}
 
-	qtype := dnsMsg.Question[0].Qtype
-	if qtype != dns.TypeNS {
-		respMsg.Ns = append(respMsg.Ns, authority)
-		addrs := amgr.GoodAddresses(qtype, includeAllSubnetworks, subnetworkID)
-		log.Infof("%s: Sending %d addresses", addr, len(addrs))
-		if len(addrs) == 0 && qtype == dns.TypeAAAA {
-			// Musl (Alpine) requires non-empty result (work-around):
-			addrs = append(addrs, appmessage.NewNetAddressIPPort(net.ParseIP("100::"), uint16(0)))
-		}
-		for _, a := range addrs {
-			rr := fmt.Sprintf("%s 30 IN %s %s", dnsMsg.Question[0].Name, atype, a.IP.String())
-			newRR, err := dns.NewRR(rr)
-			if err != nil {
-				log.Infof("%s: NewRR: %v", addr, err)
-				return nil, err
-			}
+// clientSubnet returns the EDNS Client Subnet option of msg, or nil if it
+// carries none.
+func clientSubnet(msg *dns.Msg) *dns.EDNS0_SUBNET {
+	opt := msg.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, option := range opt.Option {
+		if ecs, ok := option.(*dns.EDNS0_SUBNET); ok {
+			return ecs
+		}
+	}
+	return nil
+}
+
+// setClientSubnetScope sets the scope prefix length of the EDNS Client
+// Subnet option echoed in respMsg, if any.
+func setClientSubnetScope(respMsg *dns.Msg, scope uint8) {
+	if ecs := clientSubnet(respMsg); ecs != nil {
+		ecs.SourceScope = scope
+	}
+}
+
+// addrIP returns the IP of a UDP or TCP address
+func addrIP(addr net.Addr) net.IP {
+	switch addr := addr.(type) {
+	case *net.UDPAddr:
+		return addr.IP
+	case *net.TCPAddr:
+		return addr.IP
+	}
+	return nil
+}
+
+// clientLocation returns the location of the client a query was made on
+// behalf of, or nil if it is unknown, along with the ECS scope prefix length
+// of answers depending on it. The client is identified by the EDNS Client
+// Subnet option (RFC 7871) of the query if it carries one, and by the
+// address the query came from otherwise.
+func (d *DNSServer) clientLocation(addr net.Addr, dnsMsg *dns.Msg) (*geoLocation, uint8) {
+	if d.geo == nil {
+		return nil, 0
+	}
+	ip := addrIP(addr)
+	if ecs := clientSubnet(dnsMsg); ecs != nil {
+		// A source prefix length of 0 asks for the client's address
+		// not to be used at all.
+		if ecs.SourceNetmask == 0 {
+			return nil, 0
+		}
+		ip = ecs.Address
+	}
+	if ip == nil {
+		return nil, 0
+	}
+
+	location, prefixLength := d.geo.locate(ip)
+	maxPrefixLength := net.IPv6len * 8
+	if ip.To4() != nil {
+		maxPrefixLength = net.IPv4len * 8
+	}
+	if prefixLength > maxPrefixLength {
+		prefixLength = maxPrefixLength
+	}
+	return location, uint8(prefixLength)
+}
+
+// negativeSOA returns the SOA record placed in the authority section of
+// NXDOMAIN and NODATA responses. As required by RFC 2308, its TTL is the
+// minimum of the SOA's own TTL and its MINIMUM field.
+func (z *dnsZone) negativeSOA() dns.RR {
+	soa := *z.currentSOA()
+	if soa.Minttl < soa.Hdr.Ttl {
+		soa.Hdr.Ttl = soa.Minttl
+	}
+	return &soa
+}
+
+// buildErrorResponse builds a response to dnsMsg that carries no answers.
+// NXDOMAIN responses carry the zone's SOA record in their authority section.
+// zone is nil if the query could not be routed to a zone.
+func (d *DNSServer) buildErrorResponse(addr net.Addr, zone *dnsZone, dnsMsg *dns.Msg, rcode int,
+	isTCP bool) ([]byte, error) {
+
+	respMsg := newDNSResponse(dnsMsg, rcode)
+	if rcode == dns.RcodeNameError {
+		respMsg.Ns = append(respMsg.Ns, zone.negativeSOA())
+	}
+	return d.finishResponse(addr, zone, dnsMsg, respMsg, nil, isTCP)
+}
+
+// buildEmptyNonTerminalResponse answers a query for a name that has no records
+// of its own but names below it, such as the parent of SRV names, with NODATA.
+// Answering NXDOMAIN would deny the existence of the names below as well
+// (RFC 8020), breaking resolvers that minimise query names.
+func (d *DNSServer) buildEmptyNonTerminalResponse(addr net.Addr, zone *dnsZone, dnsMsg *dns.Msg,
+	isTCP bool) ([]byte, error) {
+
+	respMsg := newDNSResponse(dnsMsg, dns.RcodeSuccess)
+	respMsg.Ns = append(respMsg.Ns, zone.negativeSOA())
+	return d.finishResponse(addr, zone, dnsMsg, respMsg, nil, isTCP)
+}
+
+// extractPeerTarget parses domainName as an SRV target name, consisting of
+// a single label in front of the seeder's hostname that encodes a peer's IP
+// and port. It returns false if domainName is not an SRV target name, and an
+// error if it looks like one but cannot be parsed.
+func (d *DNSServer) extractPeerTarget(addr net.Addr, zone *dnsZone, domainName string) (*appmessage.NetAddress,
+	bool, error) {
+
+	// SRV target names are in the following format:
+	//   p<ip>-<port>.hostname
+	// where ip is the hex encoding of the peer's 4 or 16 byte IP and port
+	// is decimal.
+	labels := dns.SplitDomainName(strings.TrimSuffix(domainName, "."+zone.hostname))
+	if zone.hostname == domainName || len(labels) != 1 || labels[0][0] != peerTargetPrefixChar {
+		return nil, false, nil
+	}
 
-			respMsg.Answer = append(respMsg.Answer, newRR)
+	parts := strings.SplitN(labels[0][1:], "-", 2)
+	if len(parts) != 2 {
+		return nil, true, d.unknownNameError(addr, domainName)
+	}
+	ip, err := hex.DecodeString(parts[0])
+	if err != nil || (len(ip) != net.IPv4len && len(ip) != net.IPv6len) {
+		return nil, true, d.unknownNameError(addr, domainName)
+	}
+	port, err := strconv.ParseUint(parts[1], 10, 16)
+	if err != nil {
+		return nil, true, d.unknownNameError(addr, domainName)
+	}
+	return appmessage.NewNetAddressIPPort(ip, uint16(port)), true, nil
+}
+
+// peerTarget returns the SRV target name that encodes the IP and port of
+// the given address, as parsed by extractPeerTarget.
+func (z *dnsZone) peerTarget(address *appmessage.NetAddress) string {
+	ip := address.IP.To4()
+	if ip == nil {
+		ip = address.IP.To16()
+	}
+	return fmt.Sprintf("%c%s-%d.%s", peerTargetPrefixChar, hex.EncodeToString(ip), address.Port, z.hostname)
+}
+
+// addressRR returns the A or AAAA record for the given address, depending on
+// its IP family.
+func addressRR(name string, address *appmessage.NetAddress, ttl uint32) dns.RR {
+	if ip := address.IP.To4(); ip != nil {
+		return &dns.A{
+			Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl},
+			A:   ip,
 		}
+	}
+	return &dns.AAAA{
+		Hdr:  dns.RR_Header{Name: name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: ttl},
+		AAAA: address.IP.To16(),
+	}
+}
+
+// buildPeerTargetResponse answers a query for an SRV target name with the
+// single address encoded in it.
+func (d *DNSServer) buildPeerTargetResponse(addr net.Addr, zone *dnsZone, dnsMsg *dns.Msg,
+	address *appmessage.NetAddress, policy answerPolicy, isTCP bool) ([]byte, error) {
+
+	respMsg := newDNSResponse(dnsMsg, dns.RcodeSuccess)
+
+	rr := addressRR(dnsMsg.Question[0].Name, address, d.answerTTL)
+	if policy == answerAddresses && rr.Header().Rrtype == dnsMsg.Question[0].Qtype {
+		respMsg.Answer = append(respMsg.Answer, rr)
+		respMsg.Ns = append(respMsg.Ns, zone.authority)
 	} else {
-		rr := fmt.Sprintf("%s 86400 IN NS %s", dnsMsg.Question[0].Name, d.nameserver)
-		newRR, err := dns.NewRR(rr)
+		respMsg.Ns = append(respMsg.Ns, zone.negativeSOA())
+	}
+
+	return d.finishResponse(addr, zone, dnsMsg, respMsg, []uint16{rr.Header().Rrtype}, isTCP)
+}
+
+func (d *DNSServer) buildDNSResponse(addr net.Addr, zone *dnsZone, dnsMsg *dns.Msg, filter *AddressFilter,
+	isSRVName bool, policy answerPolicy, isTCP bool) ([]byte, error) {
+
+	respMsg := newDNSResponse(dnsMsg, dns.RcodeSuccess)
+	near, scope := d.clientLocation(addr, dnsMsg)
+
+	size := responseSize(dnsMsg, isTCP)
+
+	qtype := dnsMsg.Question[0].Qtype
+	isApex := strings.EqualFold(dnsMsg.Question[0].Name, zone.hostname)
+	switch {
+	case policy == answerSRV && isSRVName:
+		// Each SRV answer, together with its glue, takes about four
+		// times the space of a plain A record.
+		entries := zone.amgr.sampleAnswerPool(qtype, filter, near, d.maxAddressesForSize(size)/4)
+		setClientSubnetScope(respMsg, scope)
+		log.Debugf("%s: Sending %d SRV records", addr, len(entries))
+		for _, entry := range entries {
+			target := zone.peerTarget(entry.node.Addr)
+			respMsg.Answer = append(respMsg.Answer, &dns.SRV{
+				Hdr:    dns.RR_Header{Name: dnsMsg.Question[0].Name, Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: d.answerTTL},
+				Port:   entry.node.Addr.Port,
+				Target: target,
+			})
+			respMsg.Extra = append(respMsg.Extra, entry.record(target, d.answerTTL))
+		}
+		if len(respMsg.Answer) > 0 {
+			respMsg.Ns = append(respMsg.Ns, zone.authority)
+		}
+	case policy == answerAddresses && !isSRVName:
+		entries := zone.amgr.sampleAnswerPool(qtype, filter, near, d.maxAddressesForSize(size))
+		setClientSubnetScope(respMsg, scope)
+		log.Debugf("%s: Sending %d addresses", addr, len(entries))
+		for _, entry := range entries {
+			respMsg.Answer = append(respMsg.Answer, entry.record(dnsMsg.Question[0].Name, d.answerTTL))
+		}
+		if len(respMsg.Answer) > 0 {
+			respMsg.Ns = append(respMsg.Ns, zone.authority)
+		}
+	case policy == answerNS && isApex:
+		ns := *zone.authority
+		ns.Hdr.Name = dnsMsg.Question[0].Name
+		respMsg.Answer = append(respMsg.Answer, &ns)
+	case policy == answerSOA && isApex:
+		respMsg.Answer = append(respMsg.Answer, zone.currentSOA())
+		respMsg.Ns = append(respMsg.Ns, zone.authority)
+	case policy == answerDNSKEY && isApex && zone.signer != nil:
+		respMsg.Answer = append(respMsg.Answer, zone.signer.dnskeys...)
+	}
+
+	if len(respMsg.Answer) == 0 {
+		// NODATA: the name exists but has no records of the requested
+		// type.
+		respMsg.Ns = append(respMsg.Ns[:0], zone.negativeSOA())
+	}
+
+	return d.finishResponse(addr, zone, dnsMsg, respMsg, zone.peerNameTypes(filter, isSRVName, isApex), isTCP)
+}
+
+// finishResponse adds a server cookie to respMsg, signs it if DNSSEC is
+// enabled for zone and requested by the client, truncates it to the size the
+// client can receive and packs it. nameTypes are the types of the records at
+// the queried name, which a signed NODATA response lists.
+func (d *DNSServer) finishResponse(addr net.Addr, zone *dnsZone, dnsMsg *dns.Msg, respMsg *dns.Msg,
+	nameTypes []uint16, isTCP bool) ([]byte, error) {
+
+	d.setServerCookie(addr, dnsMsg, respMsg)
+	size := responseSize(dnsMsg, isTCP)
+	if zone == nil || zone.signer == nil || !wantsDNSSEC(dnsMsg) || respMsg.Question == nil ||
+		(respMsg.Rcode != dns.RcodeSuccess && respMsg.Rcode != dns.RcodeNameError) {
+
+		truncateResponse(respMsg, size)
+		if respMsg.Truncated {
+			log.Infof("%s: response truncated to %d answers", addr, len(respMsg.Answer))
+		}
+		return packDNSResponse(addr, respMsg)
+	}
+
+	if len(respMsg.Answer) == 0 {
+		zone.signer.denyExistence(respMsg, zone.negativeSOA().Header().Ttl, nameTypes)
+	}
+	signedMsg, err := zone.signer.signResponse(respMsg)
+	if err != nil {
+		log.Errorf("%s: %v", addr, err)
+		return nil, err
+	}
+	if signedMsg.Len() > size {
+		// Signatures take the same space regardless of the number
+		// of records in a set, so truncating the unsigned response
+		// by the space they take makes the signed one fit.
+		truncateResponse(respMsg, size-(signedMsg.Len()-respMsg.Len()))
+		signedMsg, err = zone.signer.signResponse(respMsg)
 		if err != nil {
-			log.Infof("%s: NewRR: %v", addr, err)
+			log.Errorf("%s: %v", addr, err)
 			return nil, err
 		}
+		signedMsg.Truncated = true
+		if signedMsg.Len() > size {
+			signedMsg.Answer, signedMsg.Ns = nil, nil
+			signedMsg.Extra = signedMsg.Extra[len(signedMsg.Extra)-1:]
+		}
+		log.Infof("%s: signed response truncated to %d records", addr, len(signedMsg.Answer))
+	}
 
-		respMsg.Answer = append(respMsg.Answer, newRR)
+	return packDNSResponse(addr, signedMsg)
+}
+
+// truncateResponse makes respMsg fit into size bytes. The authority section
+// of a positive answer and the glue in its additional section are optional
+// and are dropped first; if the answers still do not fit, as many as
+// possible are kept and the TC flag is set so that the client retries over
+// TCP.
+func truncateResponse(respMsg *dns.Msg, size int) {
+	if respMsg.Len() <= size {
+		return
 	}
+	if len(respMsg.Answer) > 0 {
+		respMsg.Ns = nil
+		extra := respMsg.Extra[:0]
+		for _, rr := range respMsg.Extra {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				extra = append(extra, rr)
+			}
+		}
+		respMsg.Extra = extra
+	}
+	respMsg.Truncate(size)
+}
 
+func packDNSResponse(addr net.Addr, respMsg *dns.Msg) ([]byte, error) {
 	sendBytes, err := respMsg.Pack()
 	if err != nil {
 		log.Infof("%s: failed to pack response: %v", addr, err)
@@ -212,30 +1066,146 @@ func (d *DNSServer) buildDNSResponse(addr *net.UDPAddr, authority dns.RR, dnsMsg
 	return sendBytes, nil
 }
 
-func (d *DNSServer) handleDNSRequest(addr *net.UDPAddr, authority dns.RR, udpListen *net.UDPConn, b []byte) {
-	defer wg.Done()
-
-	dnsMsg, domainName, atype, err := d.validateDNSRequest(addr, b)
+func (d *DNSServer) handleUDPRequest(addr *net.UDPAddr, udpListen *net.UDPConn, b []byte) {
+	sendBytes, hasValidCookie, err := d.answerDNSRequest(addr, b, transportUDP)
 	if err != nil {
 		return
 	}
 
-	subnetworkID, includeAllSubnetworks, err := d.extractSubnetworkID(addr, domainName)
+	// A valid server cookie proves that the client's address is not
+	// spoofed, so its responses are limited less strictly.
+	if d.rrl != nil {
+		switch d.rrl.check(addr.IP, isNegativeResponse(sendBytes), hasValidCookie, time.Now()) {
+		case rrlDrop:
+			return
+		case rrlSlip:
+			sendBytes, err = slipResponse(sendBytes)
+			if err != nil {
+				log.Infof("%s: failed to slip response: %v", addr, err)
+				return
+			}
+		}
+	}
+
+	_, err = udpListen.WriteToUDP(sendBytes, addr)
 	if err != nil {
+		log.Infof("%s: failed to write response: %v", addr, err)
 		return
 	}
+}
+
+// handleDNSRequest processes a single DNS query and returns the packed
+// response. It is shared by all transports.
+func (d *DNSServer) handleDNSRequest(addr net.Addr, b []byte, transport dnsTransport) ([]byte, error) {
+	sendBytes, _, err := d.answerDNSRequest(addr, b, transport)
+	return sendBytes, err
+}
 
-	log.Infof("%s: query %d for subnetwork ID %v",
-		addr, dnsMsg.Question[0].Qtype, subnetworkID)
+// answerDNSRequest is handleDNSRequest that also returns whether the query
+// carried a valid server cookie. Sampled exchanges are logged to dnstap.
+func (d *DNSServer) answerDNSRequest(addr net.Addr, b []byte, transport dnsTransport) ([]byte, bool, error) {
+	if d.dnstap == nil || !d.dnstap.sample() {
+		return d.processDNSRequest(addr, b, transport)
+	}
 
-	sendBytes, err := d.buildDNSResponse(addr, authority, dnsMsg, includeAllSubnetworks, subnetworkID, atype)
+	// The query is copied before it is processed, since the caller may
+	// reuse its buffer and verifying a TSIG signature modifies it.
+	exchange := &dnstapExchange{
+		addr:      addr,
+		transport: transport,
+		query:     append([]byte(nil), b...),
+		queryTime: time.Now(),
+	}
+	sendBytes, hasValidCookie, err := d.processDNSRequest(addr, b, transport)
+	if err == nil {
+		exchange.response = sendBytes
+		exchange.responseTime = time.Now()
+		d.dnstap.logExchange(exchange)
+	}
+	return sendBytes, hasValidCookie, err
+}
+
+// processDNSRequest answers a query without logging it to dnstap.
+func (d *DNSServer) processDNSRequest(addr net.Addr, b []byte, transport dnsTransport) ([]byte, bool, error) {
+	isTCP := transport != transportUDP
+	if isTransferQuery(b) {
+		responses, err := d.handleTransferRequest(addr, b, false)
+		if err != nil {
+			return nil, false, err
+		}
+		return responses[0], false, nil
+	}
+
+	dnsMsg, zone, domainName, rcode, err := d.validateDNSRequest(addr, b)
 	if err != nil {
-		return
+		return nil, false, err
+	}
+	cookie := d.checkCookie(addr, dnsMsg, time.Now())
+	switch {
+	case cookie == cookieMalformed:
+		log.Infof("%s: malformed DNS cookie", addr)
+		rcode = dns.RcodeFormatError
+	case cookie == cookieInvalid && !isTCP && rcode == dns.RcodeSuccess:
+		// The client is sent a fresh server cookie to retry with.
+		log.Infof("%s: invalid server cookie", addr)
+		rcode = dns.RcodeBadCookie
 	}
+	sendBytes, err := d.buildResponse(addr, dnsMsg, zone, domainName, rcode, isTCP)
+	return sendBytes, cookie == cookieValid, err
+}
 
-	_, err = udpListen.WriteToUDP(sendBytes, addr)
+// buildResponse answers the query dnsMsg routed to zone, or with rcode if it
+// is not dns.RcodeSuccess.
+func (d *DNSServer) buildResponse(addr net.Addr, dnsMsg *dns.Msg, zone *dnsZone, domainName string, rcode int,
+	isTCP bool) ([]byte, error) {
+
+	if rcode != dns.RcodeSuccess {
+		return d.buildErrorResponse(addr, zone, dnsMsg, rcode, isTCP)
+	}
+
+	policy := queryAnswerPolicy(dnsMsg.Question[0].Qtype)
+
+	if label, ok := zone.metadataLabel(domainName); ok {
+		if policy == answerMinimalANY {
+			return d.buildMinimalANYResponse(addr, zone, dnsMsg, isTCP)
+		}
+		return d.buildMetadataResponse(addr, zone, dnsMsg, label, policy, isTCP)
+	}
+
+	peerAddress, isPeerTarget, err := d.extractPeerTarget(addr, zone, domainName)
 	if err != nil {
-		log.Infof("%s: failed to write response: %v", addr, err)
-		return
+		return d.buildErrorResponse(addr, zone, dnsMsg, dns.RcodeNameError, isTCP)
 	}
+	if isPeerTarget {
+		// Only the targets of SRV answers exist, so that the seeder
+		// cannot be made to resolve names to arbitrary addresses.
+		if !zone.amgr.AnswerPools().hasSRVTarget(peerAddress) {
+			log.Infof("%s: unknown peer target: %s", addr, domainName)
+			return d.buildErrorResponse(addr, zone, dnsMsg, dns.RcodeNameError, isTCP)
+		}
+		if policy == answerMinimalANY {
+			return d.buildMinimalANYResponse(addr, zone, dnsMsg, isTCP)
+		}
+		return d.buildPeerTargetResponse(addr, zone, dnsMsg, peerAddress, policy, isTCP)
+	}
+
+	isSRVName := strings.HasPrefix(domainName, srvServiceName+".")
+	isSRVParent := strings.HasPrefix(domainName, srvProtocolName+".")
+	filterName := strings.TrimPrefix(domainName, srvServiceName+".")
+	filterName = strings.TrimPrefix(filterName, srvProtocolName+".")
+	filter, err := d.extractAddressFilter(addr, zone, filterName)
+	if err != nil {
+		return d.buildErrorResponse(addr, zone, dnsMsg, dns.RcodeNameError, isTCP)
+	}
+	if isSRVParent {
+		return d.buildEmptyNonTerminalResponse(addr, zone, dnsMsg, isTCP)
+	}
+	if policy == answerMinimalANY {
+		return d.buildMinimalANYResponse(addr, zone, dnsMsg, isTCP)
+	}
+
+	log.Debugf("%s: query %d in %s for subnetwork ID %v, protocol version %d, services %x",
+		addr, dnsMsg.Question[0].Qtype, zone.hostname, filter.SubnetworkID, filter.MinProtocolVersion, filter.Services)
+
+	return d.buildDNSResponse(addr, zone, dnsMsg, filter, isSRVName, policy, isTCP)
 }
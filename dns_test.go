@@ -0,0 +1,666 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kaspanet/dnsseeder/version"
+	"github.com/kaspanet/kaspad/app/appmessage"
+	"github.com/kaspanet/kaspad/domain/consensus/model/externalapi"
+	"github.com/kaspanet/kaspad/infrastructure/network/dnsseed"
+	"github.com/miekg/dns"
+)
+
+// testDNSServerConfig returns the configuration of the DNS servers under
+// test, which tests adjust as they need
+func testDNSServerConfig() *DNSServerConfig {
+	return &DNSServerConfig{
+		SOASerial:    1,
+		SOARefresh:   3600,
+		SOAMinimum:   60,
+		AnswerTTL:    defaultTTL,
+		NSTTL:        defaultNSTTL,
+		MaxAddresses: defaultMaxAddresses,
+		Workers:      1,
+	}
+}
+
+func queryDNSServer(t *testing.T, d *DNSServer, name string, qtype uint16) *dns.Msg {
+	query := new(dns.Msg)
+	query.SetQuestion(name, qtype)
+	b, err := query.Pack()
+	if err != nil {
+		t.Fatalf("Pack: %s", err)
+	}
+	respBytes, err := d.handleDNSRequest(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, b, transportUDP)
+	if err != nil {
+		t.Fatalf("handleDNSRequest: %s", err)
+	}
+	resp := new(dns.Msg)
+	err = resp.Unpack(respBytes)
+	if err != nil {
+		t.Fatalf("Unpack: %s", err)
+	}
+	return resp
+}
+
+func TestDNSServerZones(t *testing.T) {
+	selector := newPeerSelector(0, 0, nil, nil, 0, globalRand{})
+	mainnet := setupAnswerPoolManager(t, 2, selector)
+	testnet := setupAnswerPoolManager(t, 0, selector)
+
+	d := NewDNSServer(testDNSServerConfig(), []*DNSZoneConfig{
+		{Hostname: "seed.example.org", Nameserver: "ns.example.org", Manager: mainnet},
+		{Hostname: "testnet.seed.example.org", Nameserver: "ns-testnet.example.org", Manager: testnet},
+	}, nil)
+
+	resp := queryDNSServer(t, d, "seed.example.org.", dns.TypeA)
+	if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 1 {
+		t.Fatalf("expected an A record from the main zone, got:\n%s", resp)
+	}
+
+	resp = queryDNSServer(t, d, "TESTNET.seed.example.org.", dns.TypeA)
+	if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 0 {
+		t.Fatalf("expected an empty answer from the testnet zone, got:\n%s", resp)
+	}
+	if len(resp.Ns) != 1 || resp.Ns[0].Header().Name != "testnet.seed.example.org." {
+		t.Fatalf("expected the SOA of the testnet zone, got:\n%s", resp)
+	}
+
+	resp = queryDNSServer(t, d, "testnet.seed.example.org.", dns.TypeNS)
+	if len(resp.Answer) != 1 || resp.Answer[0].(*dns.NS).Ns != "ns-testnet.example.org." {
+		t.Fatalf("expected the nameserver of the testnet zone, got:\n%s", resp)
+	}
+
+	resp = queryDNSServer(t, d, "seed.example.com.", dns.TypeA)
+	if resp.Rcode != dns.RcodeRefused {
+		t.Fatalf("expected a query outside of all zones to be refused, got:\n%s", resp)
+	}
+}
+
+func TestParseZone(t *testing.T) {
+	zone, err := parseZone("seed.example.org,ns.example.org,testnet-11,127.0.0.1", "base")
+	if err != nil {
+		t.Fatalf("parseZone: %s", err)
+	}
+	if zone.NetParams().Name != "kaspa-testnet-11" || zone.NetParams().DefaultPort != "16311" {
+		t.Fatalf("unexpected network %s:%s", zone.NetParams().Name, zone.NetParams().DefaultPort)
+	}
+	if zone.Seeder != "127.0.0.1" || zone.AppDir != filepath.Join("base", "kaspa-testnet-11") {
+		t.Fatalf("unexpected zone %+v", zone)
+	}
+
+	for _, invalid := range []string{
+		"seed.example.org,ns.example.org",
+		"seed.example.org,ns.example.org,othernet",
+		",ns.example.org,mainnet",
+	} {
+		_, err := parseZone(invalid, "base")
+		if err == nil {
+			t.Errorf("expected zone %s to be rejected", invalid)
+		}
+	}
+}
+
+func TestMetadataRecords(t *testing.T) {
+	amgr := setupAnswerPoolManager(t, 3, newPeerSelector(0, 0, nil, nil, 0, globalRand{}))
+	d := NewDNSServer(testDNSServerConfig(), []*DNSZoneConfig{{Hostname: testZone, Nameserver: "ns.example.org", Manager: amgr}}, nil)
+
+	txt := func(name string) map[string]string {
+		resp := queryDNSServer(t, d, name, dns.TypeTXT)
+		if resp.Rcode != dns.RcodeSuccess {
+			t.Fatalf("%s: unexpected response:\n%s", name, resp)
+		}
+		pairs := make(map[string]string)
+		for _, rr := range resp.Answer {
+			for _, s := range rr.(*dns.TXT).Txt {
+				parts := strings.SplitN(s, "=", 2)
+				pairs[parts[0]] = parts[1]
+			}
+		}
+		return pairs
+	}
+
+	info := txt("_info." + testZone)
+	if info["version"] != version.Version() || info["network"] != testNetParams().Name {
+		t.Fatalf("unexpected info %v", info)
+	}
+
+	stats := txt("_STATS." + testZone)
+	if stats["nodes"] != "3" || stats["good"] != "3" || stats["lastcrawl"] != "never" || stats["uptime"] == "" {
+		t.Fatalf("unexpected stats %v", stats)
+	}
+	amgr.CrawlRoundDone()
+	if stats := txt("_stats." + testZone); stats["lastcrawl"] == "never" {
+		t.Fatalf("expected the crawl round to be reported, got %v", stats)
+	}
+
+	resp := queryDNSServer(t, d, "_info."+testZone, dns.TypeA)
+	if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 0 {
+		t.Fatalf("expected an empty answer for A records of the info name, got:\n%s", resp)
+	}
+	resp = queryDNSServer(t, d, "_other."+testZone, dns.TypeTXT)
+	if resp.Rcode != dns.RcodeNameError {
+		t.Fatalf("expected an unknown name to not exist, got:\n%s", resp)
+	}
+	resp = queryDNSServer(t, d, testZone, dns.TypeA)
+	if len(resp.Answer) != 2 {
+		t.Fatalf("expected the apex to still serve addresses, got:\n%s", resp)
+	}
+}
+
+// idleTestConn is a pipeConn recording the read timeouts set on it, which
+// it shortens to idleTimeout from the third one on, so that the server's
+// idle timeout fires during the test
+type idleTestConn struct {
+	*pipeConn
+	idleTimeout time.Duration
+
+	mtx      sync.Mutex
+	timeouts []time.Duration
+}
+
+func (c *idleTestConn) SetReadDeadline(deadline time.Time) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.timeouts = append(c.timeouts, time.Until(deadline))
+	if len(c.timeouts) > 2 {
+		deadline = time.Now().Add(c.idleTimeout)
+	}
+	return c.pipeConn.SetReadDeadline(deadline)
+}
+
+func TestDNSOverTCP(t *testing.T) {
+	amgr := setupAnswerPoolManager(t, 3, newPeerSelector(0, 0, nil, nil, 0, globalRand{}))
+	d := NewDNSServer(testDNSServerConfig(), []*DNSZoneConfig{{Hostname: testZone, Nameserver: "ns.example.org", Manager: amgr}}, nil)
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	conn := &idleTestConn{
+		pipeConn:    &pipeConn{Conn: serverConn, remoteAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}},
+		idleTimeout: 50 * time.Millisecond,
+	}
+	closed := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		d.handleTCPConnection(conn)
+		close(closed)
+	}()
+	clientConn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// Two queries are answered in turn over the same connection, each
+	// framed with its length.
+	for i, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		query := new(dns.Msg)
+		query.SetQuestion(testZone, qtype)
+		b, err := query.Pack()
+		if err != nil {
+			t.Fatalf("Pack: %s", err)
+		}
+		_, err = clientConn.Write(append([]byte{byte(len(b) >> 8), byte(len(b))}, b...))
+		if err != nil {
+			t.Fatalf("query %d: Write: %s", i, err)
+		}
+
+		lengthPrefix := make([]byte, 2)
+		_, err = io.ReadFull(clientConn, lengthPrefix)
+		if err != nil {
+			t.Fatalf("query %d: failed to read the length prefix: %s", i, err)
+		}
+		respBytes := make([]byte, binary.BigEndian.Uint16(lengthPrefix))
+		_, err = io.ReadFull(clientConn, respBytes)
+		if err != nil {
+			t.Fatalf("query %d: failed to read the response: %s", i, err)
+		}
+		resp := new(dns.Msg)
+		err = resp.Unpack(respBytes)
+		if err != nil {
+			t.Fatalf("query %d: Unpack: %s", i, err)
+		}
+		if resp.Id != query.Id || resp.Rcode != dns.RcodeSuccess || len(resp.Answer) == 0 ||
+			resp.Answer[0].Header().Rrtype != qtype {
+			t.Fatalf("query %d: unexpected response:\n%s", i, resp)
+		}
+	}
+
+	// The idle connection is then closed by the server.
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the idle connection was not closed")
+	}
+	_, err := clientConn.Read(make([]byte, 1))
+	if err != io.EOF {
+		t.Fatalf("expected the connection to be closed, got %v", err)
+	}
+	conn.mtx.Lock()
+	defer conn.mtx.Unlock()
+	if len(conn.timeouts) != 3 {
+		t.Fatalf("expected a read timeout before each query and the close, got %v", conn.timeouts)
+	}
+	for _, timeout := range conn.timeouts {
+		if timeout <= tcpIdleTimeout-time.Second || timeout > tcpIdleTimeout {
+			t.Fatalf("expected read timeouts of %s, got %v", tcpIdleTimeout, conn.timeouts)
+		}
+	}
+}
+
+func TestUDPQueueOverflow(t *testing.T) {
+	amgr := setupAnswerPoolManager(t, 1, newPeerSelector(0, 0, nil, nil, 0, globalRand{}))
+	d := NewDNSServer(testDNSServerConfig(), []*DNSZoneConfig{{Hostname: testZone, Nameserver: "ns.example.org", Manager: amgr}}, nil)
+
+	serverConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP: %s", err)
+	}
+	clientConn, err := net.DialUDP("udp", nil, serverConn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("DialUDP: %s", err)
+	}
+	defer clientConn.Close()
+
+	// No worker takes queries off the queue yet, as if all of them were
+	// busy, so that the queries beyond the queue size are dropped.
+	const queueSize, queries = 2, 5
+	requests := make(chan *udpRequest, queueSize)
+	served := make(chan struct{})
+	go func() {
+		d.serveUDP(serverConn, requests)
+		close(served)
+	}()
+	defer func() {
+		atomic.StoreInt32(&systemShutdown, 1)
+		<-served
+		atomic.StoreInt32(&systemShutdown, 0)
+		close(requests)
+	}()
+
+	query := new(dns.Msg)
+	query.SetQuestion(testZone, dns.TypeA)
+	b, err := query.Pack()
+	if err != nil {
+		t.Fatalf("Pack: %s", err)
+	}
+	for i := 0; i < queries; i++ {
+		_, err = clientConn.Write(b)
+		if err != nil {
+			t.Fatalf("query %d: Write: %s", i, err)
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadUint64(&d.droppedRequests) < queries-queueSize && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if dropped := atomic.LoadUint64(&d.droppedRequests); dropped != queries-queueSize || len(requests) != queueSize {
+		t.Fatalf("expected %d queued and %d dropped queries, got %d and %d",
+			queueSize, queries-queueSize, len(requests), dropped)
+	}
+
+	// Once a worker is free, the queued queries are answered.
+	wg.Add(1)
+	go d.udpWorker(requests)
+	clientConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for i := 0; i < queueSize; i++ {
+		respBytes := make([]byte, dns.MaxMsgSize)
+		n, err := clientConn.Read(respBytes)
+		if err != nil {
+			t.Fatalf("response %d: Read: %s", i, err)
+		}
+		resp := new(dns.Msg)
+		err = resp.Unpack(respBytes[:n])
+		if err != nil || resp.Id != query.Id || len(resp.Answer) != 1 {
+			t.Fatalf("response %d: unexpected response %v:\n%s", i, err, resp)
+		}
+	}
+}
+
+func TestResponseSize(t *testing.T) {
+	tests := []struct {
+		name    string
+		udpSize uint16
+		isTCP   bool
+		want    int
+	}{
+		{"no OPT record", 0, false, dns.MinMsgSize},
+		{"512-byte buffer", 512, false, 512},
+		{"1232-byte buffer", 1232, false, 1232},
+		{"buffer over the server's limit", 4096, false, ednsMaxUDPSize},
+		{"buffer under the DNS minimum", 100, false, dns.MinMsgSize},
+		{"TCP", 1232, true, dns.MaxMsgSize},
+	}
+	for _, test := range tests {
+		query := new(dns.Msg)
+		query.SetQuestion(testZone, dns.TypeA)
+		if test.udpSize != 0 {
+			query.SetEdns0(test.udpSize, false)
+		}
+		if size := responseSize(query, test.isTCP); size != test.want {
+			t.Errorf("%s: expected a size of %d, got %d", test.name, test.want, size)
+		}
+	}
+
+	d := &DNSServer{maxAddresses: defaultMaxAddresses}
+	for size, want := range map[int]int{
+		dns.MinMsgSize: defaultMaxAddresses,
+		ednsMaxUDPSize: defaultMaxAddresses * ednsMaxUDPSize / dns.MinMsgSize,
+		dns.MaxMsgSize: maxAddressesPerResponse,
+	} {
+		if maxAddresses := d.maxAddressesForSize(size); maxAddresses != want {
+			t.Errorf("expected %d addresses for %d bytes, got %d", want, size, maxAddresses)
+		}
+	}
+}
+
+func TestResponseTruncation(t *testing.T) {
+	amgr := setupAnswerPoolManager(t, 300, newPeerSelector(0, 0, nil, nil, 0, globalRand{}))
+
+	tests := []struct {
+		name          string
+		maxAddresses  int
+		udpSize       uint16
+		do            bool
+		transport     dnsTransport
+		wantAnswers   int
+		wantTruncated bool
+	}{
+		{"512-byte buffer without OPT record", defaultMaxAddresses, 0, false, transportUDP,
+			defaultMaxAddresses, false},
+		{"1232-byte buffer", defaultMaxAddresses, 1232, false, transportUDP,
+			defaultMaxAddresses * 1232 / dns.MinMsgSize, false},
+		{"buffer over the server's limit", defaultMaxAddresses, 4096, true, transportUDP,
+			defaultMaxAddresses * ednsMaxUDPSize / dns.MinMsgSize, false},
+		{"truncated UDP answer", 64, 0, false, transportUDP, -1, true},
+		{"TCP answer", 64, 0, false, transportTCP, maxAddressesPerResponse, false},
+	}
+	for _, test := range tests {
+		cfg := testDNSServerConfig()
+		cfg.MaxAddresses = test.maxAddresses
+		d := NewDNSServer(cfg, []*DNSZoneConfig{{Hostname: testZone, Nameserver: "ns.example.org", Manager: amgr}}, nil)
+
+		query := new(dns.Msg)
+		query.SetQuestion(testZone, dns.TypeA)
+		if test.udpSize != 0 {
+			query.SetEdns0(test.udpSize, test.do)
+		}
+		b, err := query.Pack()
+		if err != nil {
+			t.Fatalf("Pack: %s", err)
+		}
+		respBytes, err := d.handleDNSRequest(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, b, test.transport)
+		if err != nil {
+			t.Fatalf("%s: handleDNSRequest: %s", test.name, err)
+		}
+		resp := new(dns.Msg)
+		err = resp.Unpack(respBytes)
+		if err != nil {
+			t.Fatalf("%s: Unpack: %s", test.name, err)
+		}
+
+		size := responseSize(query, test.transport != transportUDP)
+		if len(respBytes) > size {
+			t.Errorf("%s: response of %d bytes exceeds %d bytes", test.name, len(respBytes), size)
+		}
+		if resp.Truncated != test.wantTruncated {
+			t.Errorf("%s: expected TC %t, got:\n%s", test.name, test.wantTruncated, resp)
+		}
+		if test.wantAnswers >= 0 && len(resp.Answer) != test.wantAnswers {
+			t.Errorf("%s: expected %d answers, got %d", test.name, test.wantAnswers, len(resp.Answer))
+		}
+		if test.wantTruncated && (len(resp.Answer) == 0 || len(resp.Answer) >= test.maxAddresses) {
+			t.Errorf("%s: expected the answers that fit, got %d", test.name, len(resp.Answer))
+		}
+
+		// The server advertises its own buffer size and echoes the DO bit.
+		opt := resp.IsEdns0()
+		switch {
+		case test.udpSize == 0 && opt != nil:
+			t.Errorf("%s: unexpected OPT record in the response to a query without one", test.name)
+		case test.udpSize != 0 && opt == nil:
+			t.Errorf("%s: expected an OPT record, got:\n%s", test.name, resp)
+		case opt != nil && (opt.UDPSize() != ednsMaxUDPSize || opt.Do() != test.do):
+			t.Errorf("%s: expected an OPT record with size %d and DO %t, got %s",
+				test.name, ednsMaxUDPSize, test.do, opt)
+		}
+	}
+}
+
+func TestNegativeResponses(t *testing.T) {
+	// A single IPv4 node, so that the zone has no AAAA records.
+	amgr := setupAnswerPoolManager(t, 1, newPeerSelector(0, 0, nil, nil, 0, globalRand{}))
+	d := NewDNSServer(testDNSServerConfig(), []*DNSZoneConfig{{Hostname: testZone, Nameserver: "ns.example.org", Manager: amgr}}, nil)
+
+	pack := func(name string, qtype uint16, modify func(*dns.Msg)) []byte {
+		query := new(dns.Msg)
+		query.SetQuestion(name, qtype)
+		if modify != nil {
+			modify(query)
+		}
+		b, err := query.Pack()
+		if err != nil {
+			t.Fatalf("Pack: %s", err)
+		}
+		return b
+	}
+	twoQuestions := func(query *dns.Msg) {
+		query.Question = append(query.Question, query.Question[0])
+	}
+	notify := func(query *dns.Msg) {
+		query.Opcode = dns.OpcodeNotify
+	}
+	truncated := pack(testZone, dns.TypeA, nil)
+	truncated = truncated[:dnsHeaderSize+5]
+
+	tests := []struct {
+		name        string
+		query       []byte
+		wantRcode   int
+		wantSOA     bool
+		wantAnswers int
+	}{
+		{"truncated name", truncated, dns.RcodeFormatError, false, 0},
+		{"two questions", pack(testZone, dns.TypeA, twoQuestions), dns.RcodeFormatError, false, 0},
+		{"unsupported opcode", pack(testZone, dns.TypeA, notify), dns.RcodeNotImplemented, false, 0},
+		{"foreign zone", pack("seed.example.com.", dns.TypeA, nil), dns.RcodeRefused, false, 0},
+		{"unknown label", pack("x."+testZone, dns.TypeA, nil), dns.RcodeNameError, true, 0},
+		{"malformed filter", pack("vx."+testZone, dns.TypeA, nil), dns.RcodeNameError, true, 0},
+		{"unsupported type", pack(testZone, dns.TypeMX, nil), dns.RcodeSuccess, true, 0},
+		{"no IPv6 nodes", pack(testZone, dns.TypeAAAA, nil), dns.RcodeSuccess, true, 0},
+		{"positive answer", pack(testZone, dns.TypeA, nil), dns.RcodeSuccess, false, 1},
+	}
+	for _, test := range tests {
+		respBytes, err := d.handleDNSRequest(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, test.query, transportUDP)
+		if err != nil {
+			t.Fatalf("%s: handleDNSRequest: %s", test.name, err)
+		}
+		resp := new(dns.Msg)
+		err = resp.Unpack(respBytes)
+		if err != nil {
+			t.Fatalf("%s: Unpack: %s", test.name, err)
+		}
+		if resp.Rcode != test.wantRcode || len(resp.Answer) != test.wantAnswers {
+			t.Fatalf("%s: expected rcode %s and %d answers, got:\n%s",
+				test.name, dns.RcodeToString[test.wantRcode], test.wantAnswers, resp)
+		}
+		if test.wantRcode == dns.RcodeFormatError && len(resp.Question) != 0 {
+			t.Fatalf("%s: expected no question in the FORMERR response, got:\n%s", test.name, resp)
+		}
+
+		// Negative answers carry the SOA, with the negative caching TTL,
+		// and the AAAA placeholder once served to musl clients is gone.
+		var soa *dns.SOA
+		for _, rr := range resp.Ns {
+			if rr, ok := rr.(*dns.SOA); ok {
+				soa = rr
+			}
+		}
+		if !test.wantSOA {
+			if soa != nil {
+				t.Fatalf("%s: unexpected SOA record:\n%s", test.name, resp)
+			}
+			continue
+		}
+		if soa == nil || len(resp.Ns) != 1 || soa.Hdr.Name != testZone || soa.Serial != 1 ||
+			soa.Hdr.Ttl != 60 || !resp.Authoritative {
+			t.Fatalf("%s: expected the zone's SOA in the authority section, got:\n%s", test.name, resp)
+		}
+	}
+}
+
+func TestExtractAddressFilter(t *testing.T) {
+	amgr := setupAnswerPoolManager(t, 1, newPeerSelector(0, 0, nil, nil, 0, globalRand{}))
+	d := NewDNSServer(testDNSServerConfig(), []*DNSZoneConfig{{Hostname: testZone, Nameserver: "ns.example.org", Manager: amgr}}, nil)
+	zone := d.findZone(testZone)
+
+	n := string(dnsseed.SubnetworkIDPrefixChar)
+	subnetworkID := &externalapi.DomainSubnetworkID{1, 2, 3}
+	all := AddressFilter{IncludeAllSubnetworks: true}
+	combined := AddressFilter{MinProtocolVersion: 5, Services: 0x1f}
+
+	tests := []struct {
+		labels string
+		want   *AddressFilter
+	}{
+		{"", &all},
+		{"v5.", &AddressFilter{IncludeAllSubnetworks: true, MinProtocolVersion: 5}},
+		{"s1f.", &AddressFilter{IncludeAllSubnetworks: true, Services: 0x1f}},
+		{n + ".", &AddressFilter{}},
+		{n + subnetworkID.String() + ".", &AddressFilter{SubnetworkID: subnetworkID}},
+		{"v5.s1f." + n + ".", &combined},
+		{n + ".s1f.v5.", &combined},
+		{"s1f." + n + ".v5.", &combined},
+
+		// Duplicate labels
+		{"v5.v6.", nil},
+		{"s1.v5.s2.", nil},
+		{n + "." + n + subnetworkID.String() + ".", nil},
+
+		// Malformed values
+		{"v.", nil},
+		{"vx.", nil},
+		{"v-1.", nil},
+		{"v4294967296.", nil},
+		{"s.", nil},
+		{"sz.", nil},
+		{"s10000000000000000.", nil},
+		{n + "123.", nil},
+		{n + "zz.", nil},
+		{"x1.", nil},
+		{"v5.x1.", nil},
+	}
+	for _, test := range tests {
+		name := test.labels + testZone
+		filter, err := d.extractAddressFilter(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, zone, name)
+		if test.want == nil {
+			if err == nil {
+				t.Fatalf("%s: expected an error, got %+v", name, filter)
+			}
+			if resp := queryDNSServer(t, d, name, dns.TypeA); resp.Rcode != dns.RcodeNameError {
+				t.Fatalf("%s: expected NXDOMAIN, got:\n%s", name, resp)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: extractAddressFilter: %s", name, err)
+		}
+		if !reflect.DeepEqual(filter, test.want) {
+			t.Fatalf("%s: expected filter %+v, got %+v", name, test.want, filter)
+		}
+	}
+}
+
+func TestPeerTargets(t *testing.T) {
+	// Two IPv4 and two IPv6 nodes
+	amgr := setupAnswerPoolManager(t, 4, newPeerSelector(0, 0, nil, nil, 0, globalRand{}))
+	d := NewDNSServer(testDNSServerConfig(), []*DNSZoneConfig{{Hostname: testZone, Nameserver: "ns.example.org", Manager: amgr}}, nil)
+	zone := d.findZone(testZone)
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+
+	// Targets encode the address they are parsed back to.
+	for _, address := range []*appmessage.NetAddress{
+		appmessage.NewNetAddressIPPort(net.IPv4(203, 0, 113, 7), testPort),
+		appmessage.NewNetAddressIPPort(net.IPv4(10, 0, 0, 1), 1),
+		appmessage.NewNetAddressIPPort(net.ParseIP("2001:db8::7"), 65535),
+		appmessage.NewNetAddressIPPort(net.ParseIP("::ffff:203.0.113.8"), testPort),
+	} {
+		target := zone.peerTarget(address)
+		parsed, ok, err := d.extractPeerTarget(addr, zone, target)
+		if err != nil || !ok {
+			t.Fatalf("%s: expected a peer target, got %t, %v", target, ok, err)
+		}
+		if !parsed.IP.Equal(address.IP) || parsed.Port != address.Port {
+			t.Fatalf("%s: expected %s:%d, got %s:%d", target, address.IP, address.Port, parsed.IP, parsed.Port)
+		}
+	}
+
+	tests := []struct {
+		name         string
+		isPeerTarget bool
+		valid        bool
+	}{
+		{testZone, false, true},
+		{"v5." + testZone, false, true},
+		{"pcb007107-16111.v5." + testZone, false, true},
+		{"pcb007107." + testZone, true, false},
+		{"pcb0071-16111." + testZone, true, false},
+		{"pzz007107-16111." + testZone, true, false},
+		{"pcb007107-65536." + testZone, true, false},
+		{"pcb007107-x." + testZone, true, false},
+	}
+	for _, test := range tests {
+		_, isPeerTarget, err := d.extractPeerTarget(addr, zone, test.name)
+		if isPeerTarget != test.isPeerTarget || (err == nil) != test.valid {
+			t.Fatalf("%s: expected a peer target %t and valid %t, got %t, %v",
+				test.name, test.isPeerTarget, test.valid, isPeerTarget, err)
+		}
+		if !test.valid {
+			if resp := queryDNSServer(t, d, test.name, dns.TypeA); resp.Rcode != dns.RcodeNameError {
+				t.Fatalf("%s: expected NXDOMAIN, got:\n%s", test.name, resp)
+			}
+		}
+	}
+
+	// Each SRV answer comes with the glue record of its target, which
+	// also answers queries for the target name.
+	resp := queryDNSServer(t, d, srvServiceName+"."+testZone, dns.TypeSRV)
+	if len(resp.Answer) != 4 || len(resp.Extra) != len(resp.Answer) {
+		t.Fatalf("expected 4 SRV records with their glue, got:\n%s", resp)
+	}
+	for i, rr := range resp.Answer {
+		srv := rr.(*dns.SRV)
+		address, ok, err := d.extractPeerTarget(addr, zone, srv.Target)
+		if err != nil || !ok || address.Port != srv.Port || address.Port != testPort {
+			t.Fatalf("%s: expected a peer target with the SRV port, got %v, %v", srv.Target, address, err)
+		}
+		glue := addressRR(srv.Target, address, defaultTTL)
+		if resp.Extra[i].String() != glue.String() {
+			t.Fatalf("%s: expected the glue record %s, got %s", srv.Target, glue, resp.Extra[i])
+		}
+		targetResp := queryDNSServer(t, d, srv.Target, glue.Header().Rrtype)
+		if len(targetResp.Answer) != 1 || targetResp.Answer[0].String() != glue.String() {
+			t.Fatalf("%s: expected the answer %s, got:\n%s", srv.Target, glue, targetResp)
+		}
+	}
+
+	// Well-formed targets of addresses that are not in the SRV pool do
+	// not exist, so that the seeder cannot be used for DNS rebinding.
+	for _, address := range []*appmessage.NetAddress{
+		appmessage.NewNetAddressIPPort(net.IPv4(127, 0, 0, 1), 1),
+		appmessage.NewNetAddressIPPort(net.IPv4(169, 254, 169, 254), 80),
+		appmessage.NewNetAddressIPPort(net.IPv4(1, 0, 0, 1), testPort+1),
+		appmessage.NewNetAddressIPPort(net.ParseIP("2001:db8::7"), testPort),
+	} {
+		target := zone.peerTarget(address)
+		resp := queryDNSServer(t, d, target, addressRR(target, address, 0).Header().Rrtype)
+		if resp.Rcode != dns.RcodeNameError || len(resp.Answer) != 0 {
+			t.Fatalf("%s: expected NXDOMAIN, got:\n%s", target, resp)
+		}
+	}
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"crypto"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+const (
+	// signatureValidity is the time a freshly made signature stays valid.
+	signatureValidity = 7 * 24 * time.Hour
+
+	// signatureRefresh is the remaining validity below which a cached
+	// signature is replaced by a fresh one.
+	signatureRefresh = 2 * 24 * time.Hour
+
+	// signatureInceptionOffset backdates the inception of signatures to
+	// tolerate resolvers with slightly skewed clocks.
+	signatureInceptionOffset = time.Hour
+
+	// dnskeyTTL is the TTL of the zone's DNSKEY records.
+	dnskeyTTL = 3600
+
+	// typeNXNAME is the pseudo type that marks a non-existent name in
+	// compact denial of existence responses (RFC 9824).
+	typeNXNAME = 128
+)
+
+// dnssecKey is a DNSKEY record together with its private key
+type dnssecKey struct {
+	dnskey *dns.DNSKEY
+	signer crypto.Signer
+}
+
+// dnssecSigner signs the seeder's responses on the fly. Signatures over
+// record sets that do not change between responses are cached and replaced
+// before they expire or once the record set changes.
+type dnssecSigner struct {
+	zone    string
+	ksk     *dnssecKey
+	zsk     *dnssecKey
+	dnskeys []dns.RR
+
+	sigCacheMtx sync.Mutex
+	sigCache    map[sigCacheKey]*sigCacheEntry
+}
+
+// sigCacheKey identifies a cached signature by the owner name, in lower
+// case, type and TTL of the record set it covers. The TTL tells the SOA
+// record of negative responses apart from the one at the apex.
+type sigCacheKey struct {
+	name   string
+	rrtype uint16
+	ttl    uint32
+}
+
+// sigCacheEntry is a cached signature along with the record set it covers
+type sigCacheEntry struct {
+	rrset []dns.RR
+	rrsig *dns.RRSIG
+}
+
+// covers returns whether the entry's signature covers rrset
+func (e *sigCacheEntry) covers(rrset []dns.RR) bool {
+	if len(e.rrset) != len(rrset) {
+		return false
+	}
+	for i, rr := range rrset {
+		if !dns.IsDuplicate(e.rrset[i], rr) {
+			return false
+		}
+	}
+	return true
+}
+
+// loadDNSSECKeys loads the BIND-style key pairs (K<zone>+<alg>+<tag>.key and
+// .private) of the given zone from dir. A key with the SEP flag is used as
+// the key signing key and one without it as the zone signing key. A single
+// key is used for both.
+func loadDNSSECKeys(dir, zone string) (*dnssecSigner, error) {
+	zone = dns.Fqdn(strings.ToLower(zone))
+	keyFiles, err := filepath.Glob(filepath.Join(dir, "K"+zone+"+*.key"))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if len(keyFiles) == 0 {
+		return nil, errors.Errorf("no DNSSEC keys for %s found in %s", zone, dir)
+	}
+
+	s := &dnssecSigner{
+		zone:     zone,
+		sigCache: make(map[sigCacheKey]*sigCacheEntry),
+	}
+	for _, keyFile := range keyFiles {
+		key, err := readDNSSECKey(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.EqualFold(key.dnskey.Hdr.Name, zone) {
+			return nil, errors.Errorf("key %s does not belong to zone %s", keyFile, zone)
+		}
+		if key.dnskey.Flags&dns.SEP != 0 {
+			if s.ksk != nil {
+				return nil, errors.Errorf("more than one key signing key for %s", zone)
+			}
+			s.ksk = key
+		} else {
+			if s.zsk != nil {
+				return nil, errors.Errorf("more than one zone signing key for %s", zone)
+			}
+			s.zsk = key
+		}
+		key.dnskey.Hdr.Ttl = dnskeyTTL
+		s.dnskeys = append(s.dnskeys, key.dnskey)
+	}
+	if s.ksk == nil {
+		s.ksk = s.zsk
+	}
+	if s.zsk == nil {
+		s.zsk = s.ksk
+	}
+
+	return s, nil
+}
+
+// readDNSSECKey reads the public key in keyFile and the private key in the
+// .private file next to it.
+func readDNSSECKey(keyFile string) (*dnssecKey, error) {
+	f, err := os.Open(keyFile)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer f.Close()
+	rr, err := dns.ReadRR(f, keyFile)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error reading %s", keyFile)
+	}
+	dnskey, ok := rr.(*dns.DNSKEY)
+	if !ok {
+		return nil, errors.Errorf("%s does not contain a DNSKEY record", keyFile)
+	}
+
+	privateFile := strings.TrimSuffix(keyFile, ".key") + ".private"
+	f, err = os.Open(privateFile)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer f.Close()
+	privateKey, err := dnskey.ReadPrivateKey(f, privateFile)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error reading %s", privateFile)
+	}
+	signer, ok := privateKey.(crypto.Signer)
+	if !ok {
+		return nil, errors.Errorf("%s does not contain a signing key", privateFile)
+	}
+
+	return &dnssecKey{dnskey: dnskey, signer: signer}, nil
+}
+
+// wantsDNSSEC returns whether the client asked for DNSSEC records by
+// setting the DO bit.
+func wantsDNSSEC(dnsMsg *dns.Msg) bool {
+	opt := dnsMsg.IsEdns0()
+	return opt != nil && opt.Do()
+}
+
+// denyExistence adds an NSEC record proving the non-existence of the
+// queried name or type to a negative response, following the compact
+// denial of existence scheme of RFC 9824: NXDOMAIN is answered as NOERROR
+// with only NSEC, RRSIG and NXNAME in the type bitmap, and NODATA lists the
+// types of the records that exist at the name, nameTypes, but the queried
+// one.
+func (s *dnssecSigner) denyExistence(respMsg *dns.Msg, negativeTTL uint32, nameTypes []uint16) {
+	question := respMsg.Question[0]
+	var types []uint16
+	if respMsg.Rcode == dns.RcodeNameError {
+		respMsg.Rcode = dns.RcodeSuccess
+		types = []uint16{dns.TypeRRSIG, dns.TypeNSEC, typeNXNAME}
+	} else {
+		types = []uint16{dns.TypeRRSIG, dns.TypeNSEC}
+		for _, t := range nameTypes {
+			if t != question.Qtype {
+				types = append(types, t)
+			}
+		}
+		sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+	}
+	respMsg.Ns = append(respMsg.Ns, &dns.NSEC{
+		Hdr:        dns.RR_Header{Name: question.Name, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: negativeTTL},
+		NextDomain: "\\000." + question.Name,
+		TypeBitMap: types,
+	})
+}
+
+// peerNameTypes returns the types of the records at a name of the zone listing
+// the peers that pass filter: SRV records at SRV names and A and AAAA
+// records elsewhere, as far as there are such peers, and the NS, SOA and
+// DNSKEY records at the apex.
+func (z *dnsZone) peerNameTypes(filter *AddressFilter, isSRVName, isApex bool) []uint16 {
+	var types []uint16
+	if isApex {
+		types = append(types, dns.TypeNS, dns.TypeSOA)
+		if z.signer != nil {
+			types = append(types, dns.TypeDNSKEY)
+		}
+	}
+	qtypes := []uint16{dns.TypeA, dns.TypeAAAA}
+	if isSRVName {
+		qtypes = []uint16{dns.TypeSRV}
+	}
+	pools := z.amgr.AnswerPools()
+	for _, qtype := range qtypes {
+		if pools.pool(qtype, filter, "").hasMatch(filter) {
+			types = append(types, qtype)
+		}
+	}
+	return types
+}
+
+// signResponse returns a copy of respMsg with every record set in its
+// answer, authority and additional sections followed by its signature.
+func (s *dnssecSigner) signResponse(respMsg *dns.Msg) (*dns.Msg, error) {
+	signedMsg := respMsg.Copy()
+	var err error
+	signedMsg.Answer, err = s.signSection(respMsg.Answer)
+	if err != nil {
+		return nil, err
+	}
+	signedMsg.Ns, err = s.signSection(respMsg.Ns)
+	if err != nil {
+		return nil, err
+	}
+	signedMsg.Extra, err = s.signSection(respMsg.Extra)
+	if err != nil {
+		return nil, err
+	}
+	return signedMsg, nil
+}
+
+// signSection groups the records of a message section into record sets and
+// appends a signature after each of them.
+func (s *dnssecSigner) signSection(section []dns.RR) ([]dns.RR, error) {
+	var rrsets [][]dns.RR
+	var opt dns.RR
+	for _, rr := range section {
+		if rr.Header().Rrtype == dns.TypeOPT {
+			opt = rr
+			continue
+		}
+		found := false
+		for i, rrset := range rrsets {
+			if rrset[0].Header().Rrtype == rr.Header().Rrtype &&
+				strings.EqualFold(rrset[0].Header().Name, rr.Header().Name) {
+				rrsets[i] = append(rrset, rr)
+				found = true
+				break
+			}
+		}
+		if !found {
+			rrsets = append(rrsets, []dns.RR{rr})
+		}
+	}
+
+	signed := make([]dns.RR, 0, len(section)+len(rrsets))
+	for _, rrset := range rrsets {
+		rrsig, err := s.sign(rrset)
+		if err != nil {
+			return nil, err
+		}
+		signed = append(signed, rrset...)
+		signed = append(signed, rrsig)
+	}
+	if opt != nil {
+		signed = append(signed, opt)
+	}
+	return signed, nil
+}
+
+// sign returns a signature over rrset. DNSKEY record sets are signed with
+// the key signing key and all others with the zone signing key. Signatures
+// over the zone's static record sets are taken from the cache if they cover
+// the same records and are still valid for longer than signatureRefresh.
+func (s *dnssecSigner) sign(rrset []dns.RR) (*dns.RRSIG, error) {
+	header := rrset[0].Header()
+	key := s.zsk
+	if header.Rrtype == dns.TypeDNSKEY {
+		key = s.ksk
+	}
+
+	cacheKey := sigCacheKey{strings.ToLower(header.Name), header.Rrtype, header.Ttl}
+	cacheable := header.Rrtype == dns.TypeSOA || header.Rrtype == dns.TypeNS || header.Rrtype == dns.TypeDNSKEY
+
+	now := time.Now()
+	if cacheable {
+		s.sigCacheMtx.Lock()
+		entry, ok := s.sigCache[cacheKey]
+		s.sigCacheMtx.Unlock()
+		if ok && entry.covers(rrset) &&
+			time.Unix(int64(entry.rrsig.Expiration), 0).Sub(now) > signatureRefresh {
+			return entry.rrsig, nil
+		}
+	}
+
+	rrsig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Ttl: header.Ttl},
+		Algorithm:  key.dnskey.Algorithm,
+		Inception:  uint32(now.Add(-signatureInceptionOffset).Unix()),
+		Expiration: uint32(now.Add(signatureValidity).Unix()),
+		KeyTag:     key.dnskey.KeyTag(),
+		SignerName: s.zone,
+	}
+	err := rrsig.Sign(key.signer, rrset)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to sign %s %s", header.Name, dns.TypeToString[header.Rrtype])
+	}
+
+	if cacheable {
+		entry := &sigCacheEntry{rrset: make([]dns.RR, len(rrset)), rrsig: rrsig}
+		for i, rr := range rrset {
+			entry.rrset[i] = dns.Copy(rr)
+		}
+		s.sigCacheMtx.Lock()
+		s.sigCache[cacheKey] = entry
+		s.sigCacheMtx.Unlock()
+	}
+	return rrsig, nil
+}
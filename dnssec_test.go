@@ -0,0 +1,274 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kaspanet/kaspad/app/appmessage"
+	"github.com/miekg/dns"
+)
+
+const testZone = "seed.example.org."
+
+func generateTestKey(t *testing.T, dir string, flags uint16) {
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: testZone, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: dnskeyTTL},
+		Flags:     flags,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	privateKey, err := key.Generate(256)
+	if err != nil {
+		t.Fatalf("Generate: %s", err)
+	}
+	base := filepath.Join(dir, fmt.Sprintf("K%s+%03d+%05d", testZone, key.Algorithm, key.KeyTag()))
+	err = os.WriteFile(base+".key", []byte(key.String()+"\n"), 0600)
+	if err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+	err = os.WriteFile(base+".private", []byte(key.PrivateKeyString(privateKey)), 0600)
+	if err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+}
+
+func setupSignedDNSServer(t *testing.T) *DNSServer {
+	dir := t.TempDir()
+	amgr, err := NewManager(dir, testNetParams(), defaultStaleTimeout, defaultPruneExpireTimeout,
+		defaultMaxFailures, newPeerSelector(defaultNetgroupCap, 0, nil, nil, 0, globalRand{}))
+	if err != nil {
+		t.Fatalf("NewManager: %s", err)
+	}
+	ip := net.IP{203, 105, 20, 21}
+	amgr.AddAddresses([]*appmessage.NetAddress{appmessage.NewNetAddressIPPort(ip, testPort)})
+	amgr.Good(ip, nil)
+	amgr.refreshAnswerPools()
+
+	generateTestKey(t, dir, dns.ZONE|dns.SEP)
+	generateTestKey(t, dir, dns.ZONE)
+	signer, err := loadDNSSECKeys(dir, testZone)
+	if err != nil {
+		t.Fatalf("loadDNSSECKeys: %s", err)
+	}
+	if signer.ksk == signer.zsk {
+		t.Fatalf("expected separate key and zone signing keys")
+	}
+
+	return NewDNSServer(testDNSServerConfig(), []*DNSZoneConfig{{
+		Hostname:   testZone,
+		Nameserver: "ns.example.org",
+		Manager:    amgr,
+		Signer:     signer,
+	}}, nil)
+}
+
+func querySignedDNSServer(t *testing.T, d *DNSServer, name string, qtype uint16, do bool) *dns.Msg {
+	query := new(dns.Msg)
+	query.SetQuestion(name, qtype)
+	query.SetEdns0(ednsMaxUDPSize, do)
+	b, err := query.Pack()
+	if err != nil {
+		t.Fatalf("Pack: %s", err)
+	}
+	respBytes, err := d.handleDNSRequest(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, b, transportUDP)
+	if err != nil {
+		t.Fatalf("handleDNSRequest: %s", err)
+	}
+	resp := new(dns.Msg)
+	err = resp.Unpack(respBytes)
+	if err != nil {
+		t.Fatalf("Unpack: %s", err)
+	}
+	return resp
+}
+
+// verifySection checks that every record set in section is covered by a
+// valid signature made with one of the zone's keys.
+func verifySection(t *testing.T, d *DNSServer, section []dns.RR) {
+	keys := make(map[uint16]*dns.DNSKEY)
+	for _, rr := range d.zones[0].signer.dnskeys {
+		key := rr.(*dns.DNSKEY)
+		keys[key.KeyTag()] = key
+	}
+
+	covered := make(map[string]bool)
+	for _, rr := range section {
+		rrsig, ok := rr.(*dns.RRSIG)
+		if !ok {
+			continue
+		}
+		var rrset []dns.RR
+		for _, other := range section {
+			if other.Header().Rrtype == rrsig.TypeCovered && strings.EqualFold(other.Header().Name, rrsig.Hdr.Name) {
+				rrset = append(rrset, other)
+			}
+		}
+		key, ok := keys[rrsig.KeyTag]
+		if !ok {
+			t.Fatalf("signature by unknown key %d", rrsig.KeyTag)
+		}
+		err := rrsig.Verify(key, rrset)
+		if err != nil {
+			t.Fatalf("signature over %s %s does not verify: %s", rrsig.Hdr.Name,
+				dns.TypeToString[rrsig.TypeCovered], err)
+		}
+		if !rrsig.ValidityPeriod(time.Now()) {
+			t.Fatalf("signature over %s %s is not currently valid", rrsig.Hdr.Name,
+				dns.TypeToString[rrsig.TypeCovered])
+		}
+		covered[strings.ToLower(rrsig.Hdr.Name)+dns.TypeToString[rrsig.TypeCovered]] = true
+	}
+	for _, rr := range section {
+		rrtype := rr.Header().Rrtype
+		if rrtype == dns.TypeRRSIG || rrtype == dns.TypeOPT {
+			continue
+		}
+		if !covered[strings.ToLower(rr.Header().Name)+dns.TypeToString[rrtype]] {
+			t.Fatalf("record %s is not signed", rr)
+		}
+	}
+}
+
+func TestDNSSECSignedAnswers(t *testing.T) {
+	d := setupSignedDNSServer(t)
+
+	resp := querySignedDNSServer(t, d, testZone, dns.TypeA, true)
+	if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 2 {
+		t.Fatalf("expected an A record and its signature, got:\n%s", resp)
+	}
+	verifySection(t, d, resp.Answer)
+	verifySection(t, d, resp.Ns)
+
+	resp = querySignedDNSServer(t, d, testZone, dns.TypeDNSKEY, true)
+	if len(resp.Answer) != 3 {
+		t.Fatalf("expected two DNSKEY records and a signature, got:\n%s", resp)
+	}
+	verifySection(t, d, resp.Answer)
+	for _, rr := range resp.Answer {
+		if rrsig, ok := rr.(*dns.RRSIG); ok && rrsig.KeyTag != d.zones[0].signer.ksk.dnskey.KeyTag() {
+			t.Fatalf("DNSKEY set signed with key %d instead of the key signing key", rrsig.KeyTag)
+		}
+	}
+
+	resp = querySignedDNSServer(t, d, testZone, dns.TypeA, false)
+	for _, rr := range append(resp.Answer, resp.Ns...) {
+		if rr.Header().Rrtype == dns.TypeRRSIG {
+			t.Fatalf("got signatures without the DO bit:\n%s", resp)
+		}
+	}
+}
+
+func TestDNSSECDenialOfExistence(t *testing.T) {
+	d := setupSignedDNSServer(t)
+
+	// The only node is an IPv4 node with protocol version 0.
+	tests := []struct {
+		name      string
+		qtype     uint16
+		wantTypes []uint16
+	}{
+		{"unknown." + testZone, dns.TypeA, []uint16{dns.TypeRRSIG, dns.TypeNSEC, typeNXNAME}},
+		{testZone, dns.TypeAAAA,
+			[]uint16{dns.TypeA, dns.TypeNS, dns.TypeSOA, dns.TypeRRSIG, dns.TypeNSEC, dns.TypeDNSKEY}},
+		{testZone, dns.TypeTXT,
+			[]uint16{dns.TypeA, dns.TypeNS, dns.TypeSOA, dns.TypeRRSIG, dns.TypeNSEC, dns.TypeDNSKEY}},
+		{"n." + testZone, dns.TypeAAAA, []uint16{dns.TypeA, dns.TypeRRSIG, dns.TypeNSEC}},
+		{"n." + testZone, dns.TypeSOA, []uint16{dns.TypeA, dns.TypeRRSIG, dns.TypeNSEC}},
+		{"v5." + testZone, dns.TypeA, []uint16{dns.TypeRRSIG, dns.TypeNSEC}},
+		{srvServiceName + "." + testZone, dns.TypeA, []uint16{dns.TypeSRV, dns.TypeRRSIG, dns.TypeNSEC}},
+		{srvProtocolName + "." + testZone, dns.TypeSRV, []uint16{dns.TypeRRSIG, dns.TypeNSEC}},
+		{infoLabel + "." + testZone, dns.TypeNS, []uint16{dns.TypeTXT, dns.TypeRRSIG, dns.TypeNSEC}},
+	}
+
+	for _, test := range tests {
+		resp := querySignedDNSServer(t, d, test.name, test.qtype, true)
+		if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 0 {
+			t.Fatalf("%s: expected an empty NOERROR response, got:\n%s", test.name, resp)
+		}
+		verifySection(t, d, resp.Ns)
+
+		var nsec *dns.NSEC
+		for _, rr := range resp.Ns {
+			if rr.Header().Rrtype == dns.TypeNSEC {
+				nsec = rr.(*dns.NSEC)
+			}
+		}
+		if nsec == nil {
+			t.Fatalf("%s: no NSEC record in response:\n%s", test.name, resp)
+		}
+		if fmt.Sprint(nsec.TypeBitMap) != fmt.Sprint(test.wantTypes) {
+			t.Errorf("%s type %d: expected the NSEC bitmap %v, got %v", test.name, test.qtype,
+				test.wantTypes, nsec.TypeBitMap)
+		}
+	}
+}
+
+func TestDNSSECSignatureRefresh(t *testing.T) {
+	d := setupSignedDNSServer(t)
+
+	rrset := []dns.RR{d.zones[0].soa}
+	first, err := d.zones[0].signer.sign(rrset)
+	if err != nil {
+		t.Fatalf("sign: %s", err)
+	}
+	second, err := d.zones[0].signer.sign(rrset)
+	if err != nil {
+		t.Fatalf("sign: %s", err)
+	}
+	if first != second {
+		t.Fatalf("expected the cached signature to be reused")
+	}
+
+	// Make the cached signature close to expiring.
+	first.Expiration = uint32(time.Now().Add(signatureRefresh / 2).Unix())
+	third, err := d.zones[0].signer.sign(rrset)
+	if err != nil {
+		t.Fatalf("sign: %s", err)
+	}
+	if third == first {
+		t.Fatalf("expected a signature close to expiring to be replaced")
+	}
+	if time.Unix(int64(third.Expiration), 0).Sub(time.Now()) <= signatureRefresh {
+		t.Fatalf("replacement signature expires too soon")
+	}
+}
+
+func TestDNSSECSignatureCacheSize(t *testing.T) {
+	d := setupSignedDNSServer(t)
+	signer := d.zones[0].signer
+
+	// Every new serial of the zone gets a new signature, which replaces
+	// the cached one instead of piling up next to it.
+	var previous *dns.RRSIG
+	for i := uint32(0); i < 100; i++ {
+		soa := *d.zones[0].soa
+		soa.Serial += i
+		rrsig, err := signer.sign([]dns.RR{&soa})
+		if err != nil {
+			t.Fatalf("sign: %s", err)
+		}
+		if rrsig == previous {
+			t.Fatalf("serial %d: expected a new signature", soa.Serial)
+		}
+		verifySection(t, d, []dns.RR{&soa, rrsig})
+		previous = rrsig
+	}
+
+	negativeSOA := d.zones[0].negativeSOA()
+	for i := 0; i < 2; i++ {
+		_, err := signer.sign([]dns.RR{negativeSOA})
+		if err != nil {
+			t.Fatalf("sign: %s", err)
+		}
+	}
+	signer.sigCacheMtx.Lock()
+	defer signer.sigCacheMtx.Unlock()
+	if len(signer.sigCache) != 2 {
+		t.Fatalf("expected a signature for each SOA TTL in the cache, got %d", len(signer.sigCache))
+	}
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	dnstap "github.com/dnstap/golang-dnstap"
+	framestream "github.com/farsightsec/golang-framestream"
+	"github.com/kaspanet/dnsseeder/version"
+	"github.com/pkg/errors"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// dnstapSocketPrefix marks a dnstap output that is a Unix socket
+	// rather than a file.
+	dnstapSocketPrefix = "unix:"
+
+	// dnstapFlushInterval is the interval in which buffered frames are
+	// written out.
+	dnstapFlushInterval = time.Second
+
+	// dnstapReconnectInterval is the time waited before connecting to
+	// the dnstap socket again after a failure.
+	dnstapReconnectInterval = 5 * time.Second
+
+	// dnstapWriteTimeout bounds the time a write to the dnstap socket
+	// may take.
+	dnstapWriteTimeout = 5 * time.Second
+
+	// dnstapStatsInterval is the interval in which the number of dropped
+	// frames is logged if it changed.
+	dnstapStatsInterval = time.Minute
+)
+
+// dnstapExchange is a query and the response it was answered with
+type dnstapExchange struct {
+	addr         net.Addr
+	transport    dnsTransport
+	query        []byte
+	queryTime    time.Time
+	response     []byte
+	responseTime time.Time
+}
+
+// dnstapLogger logs queries and responses in dnstap format. Exchanges are
+// handed to a single writer through a bounded queue, and dropped when the
+// queue is full, so that logging never delays answers.
+type dnstapLogger struct {
+	output     string
+	isSocket   bool
+	sampleRate uint64
+	exchanges  chan *dnstapExchange
+	identity   []byte
+
+	file *os.File
+
+	exchangeCount uint64
+	dropped       uint64
+}
+
+// newDNSTapLogger returns a dnstap logger writing to output, which is a file
+// path or unix: followed by the path of a Unix socket. One in sampleRate
+// exchanges is logged, and up to bufferSize exchanges may wait to be
+// written. A file is created right away, while a socket is connected to by
+// the writer.
+func newDNSTapLogger(output string, sampleRate uint64, bufferSize int) (*dnstapLogger, error) {
+	l := &dnstapLogger{
+		output:     strings.TrimPrefix(output, dnstapSocketPrefix),
+		isSocket:   strings.HasPrefix(output, dnstapSocketPrefix),
+		sampleRate: sampleRate,
+		exchanges:  make(chan *dnstapExchange, bufferSize),
+	}
+	hostname, err := os.Hostname()
+	if err == nil {
+		l.identity = []byte(hostname)
+	}
+	if !l.isSocket {
+		l.file, err = os.Create(l.output)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+	return l, nil
+}
+
+// sample returns whether the next exchange should be logged
+func (l *dnstapLogger) sample() bool {
+	return l.sampleRate <= 1 || atomic.AddUint64(&l.exchangeCount, 1)%l.sampleRate == 0
+}
+
+// logExchange queues an exchange to be written, or drops it if the queue is
+// full.
+func (l *dnstapLogger) logExchange(exchange *dnstapExchange) {
+	select {
+	case l.exchanges <- exchange:
+	default:
+		atomic.AddUint64(&l.dropped, 1)
+	}
+}
+
+// frames encodes an exchange as a CLIENT_QUERY and an AUTH_RESPONSE message
+func (l *dnstapLogger) frames(exchange *dnstapExchange) ([][]byte, error) {
+	socketFamily := dnstap.SocketFamily_INET6
+	var ip net.IP
+	var port uint32
+	switch addr := exchange.addr.(type) {
+	case *net.UDPAddr:
+		ip, port = addr.IP, uint32(addr.Port)
+	case *net.TCPAddr:
+		ip, port = addr.IP, uint32(addr.Port)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		socketFamily, ip = dnstap.SocketFamily_INET, ip4
+	}
+	socketProtocol := map[dnsTransport]dnstap.SocketProtocol{
+		transportUDP:   dnstap.SocketProtocol_UDP,
+		transportTCP:   dnstap.SocketProtocol_TCP,
+		transportTLS:   dnstap.SocketProtocol_DOT,
+		transportHTTPS: dnstap.SocketProtocol_DOH,
+	}[exchange.transport]
+
+	queryTimeSec, queryTimeNsec := uint64(exchange.queryTime.Unix()), uint32(exchange.queryTime.Nanosecond())
+	responseTimeSec := uint64(exchange.responseTime.Unix())
+	responseTimeNsec := uint32(exchange.responseTime.Nanosecond())
+	messages := []*dnstap.Message{
+		{
+			Type:         dnstap.Message_CLIENT_QUERY.Enum(),
+			QueryTimeSec: &queryTimeSec, QueryTimeNsec: &queryTimeNsec,
+			QueryMessage: exchange.query,
+		},
+		{
+			Type:         dnstap.Message_AUTH_RESPONSE.Enum(),
+			QueryTimeSec: &queryTimeSec, QueryTimeNsec: &queryTimeNsec,
+			ResponseTimeSec: &responseTimeSec, ResponseTimeNsec: &responseTimeNsec,
+			ResponseMessage: exchange.response,
+		},
+	}
+
+	frames := make([][]byte, 0, len(messages))
+	for _, message := range messages {
+		message.SocketFamily = socketFamily.Enum()
+		message.SocketProtocol = socketProtocol.Enum()
+		message.QueryAddress = ip
+		message.QueryPort = &port
+		frame, err := proto.Marshal(&dnstap.Dnstap{
+			Identity: l.identity,
+			Version:  []byte("dnsseeder " + version.Version()),
+			Type:     dnstap.Dnstap_MESSAGE.Enum(),
+			Message:  message,
+		})
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		frames = append(frames, frame)
+	}
+	return frames, nil
+}
+
+// writeExchange writes the frames of exchange to w
+func (l *dnstapLogger) writeExchange(w *framestream.Writer, exchange *dnstapExchange) error {
+	frames, err := l.frames(exchange)
+	if err != nil {
+		return err
+	}
+	for _, frame := range frames {
+		_, err = w.WriteFrame(frame)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
+
+// open starts a Frame Streams stream on the logger's output
+func (l *dnstapLogger) open() (*framestream.Writer, io.Closer, error) {
+	options := &framestream.WriterOptions{ContentTypes: [][]byte{dnstap.FSContentType}}
+	if !l.isSocket {
+		w, err := framestream.NewWriter(l.file, options)
+		if err != nil {
+			return nil, nil, errors.WithStack(err)
+		}
+		return w, l.file, nil
+	}
+
+	conn, err := net.DialTimeout("unix", l.output, dnstapWriteTimeout)
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+	options.Bidirectional = true
+	options.Timeout = dnstapWriteTimeout
+	w, err := framestream.NewWriter(conn, options)
+	if err != nil {
+		conn.Close()
+		return nil, nil, errors.WithStack(err)
+	}
+	return w, conn, nil
+}
+
+// run writes the queued exchanges until system shutdown is requested. The
+// socket is reconnected to after failures, dropping the exchanges queued
+// in the meantime, while a file that failed is given up on.
+func (l *dnstapLogger) run() {
+	defer wg.Done()
+
+	var w *framestream.Writer
+	var closer io.Closer
+	closeOutput := func() {
+		closer.Close()
+		w, closer = nil, nil
+		// A file is not opened again, since the stream in it would
+		// have to be started over.
+		l.file = nil
+	}
+	var lastAttempt time.Time
+	connect := func(now time.Time) {
+		if w != nil || (!l.isSocket && l.file == nil) || now.Sub(lastAttempt) < dnstapReconnectInterval {
+			return
+		}
+		lastAttempt = now
+		var err error
+		w, closer, err = l.open()
+		if err != nil {
+			log.Warnf("Failed to open the dnstap output %s: %v", l.output, err)
+			return
+		}
+		log.Infof("Writing dnstap output to %s", l.output)
+	}
+
+	ticker := time.NewTicker(dnstapFlushInterval)
+	defer ticker.Stop()
+	var loggedDropped uint64
+	lastStats := time.Now()
+	for {
+		select {
+		case exchange := <-l.exchanges:
+			connect(time.Now())
+			if w == nil {
+				atomic.AddUint64(&l.dropped, 1)
+				continue
+			}
+			err := l.writeExchange(w, exchange)
+			if err != nil {
+				log.Warnf("Failed to write to the dnstap output %s: %v", l.output, err)
+				closeOutput()
+			}
+
+		case now := <-ticker.C:
+			if atomic.LoadInt32(&systemShutdown) != 0 {
+				if w != nil {
+					w.Close()
+					closeOutput()
+				}
+				return
+			}
+			connect(now)
+			if w != nil {
+				err := w.Flush()
+				if err != nil {
+					log.Warnf("Failed to write to the dnstap output %s: %v", l.output, err)
+					closeOutput()
+				}
+			}
+			if now.Sub(lastStats) > dnstapStatsInterval {
+				lastStats = now
+				dropped := atomic.LoadUint64(&l.dropped)
+				if dropped != loggedDropped {
+					log.Infof("dnstap: %d exchanges dropped in total", dropped)
+					loggedDropped = dropped
+				}
+			}
+		}
+	}
+}
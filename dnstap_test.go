@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	dnstap "github.com/dnstap/golang-dnstap"
+	framestream "github.com/farsightsec/golang-framestream"
+	"github.com/miekg/dns"
+	"google.golang.org/protobuf/proto"
+)
+
+func setupDNSTapServer(t *testing.T, sampleRate uint64, bufferSize int) (*DNSServer, *dnstapLogger, string) {
+	output := filepath.Join(t.TempDir(), "dnstap.fstrm")
+	l, err := newDNSTapLogger(output, sampleRate, bufferSize)
+	if err != nil {
+		t.Fatalf("newDNSTapLogger: %s", err)
+	}
+	cfg := testDNSServerConfig()
+	cfg.DNSTap = l
+	d := NewDNSServer(cfg, []*DNSZoneConfig{{
+		Hostname:   testZone,
+		Nameserver: "ns.example.org",
+		Manager:    setupAnswerPoolManager(t, 2, newPeerSelector(0, 0, nil, nil, 0, globalRand{})),
+	}}, nil)
+	return d, l, output
+}
+
+func TestDNSTapLogger(t *testing.T) {
+	d, l, output := setupDNSTapServer(t, 1, 8)
+
+	query := new(dns.Msg).SetQuestion(testZone, dns.TypeA)
+	b, err := query.Pack()
+	if err != nil {
+		t.Fatalf("Pack: %s", err)
+	}
+	response, err := d.handleDNSRequest(&net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5300}, b, transportTLS)
+	if err != nil {
+		t.Fatalf("handleDNSRequest: %s", err)
+	}
+
+	w, closer, err := l.open()
+	if err != nil {
+		t.Fatalf("open: %s", err)
+	}
+	err = l.writeExchange(w, <-l.exchanges)
+	if err != nil {
+		t.Fatalf("writeExchange: %s", err)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+	closer.Close()
+
+	f, err := os.Open(output)
+	if err != nil {
+		t.Fatalf("Open: %s", err)
+	}
+	defer f.Close()
+	decoder, err := framestream.NewDecoder(f, &framestream.DecoderOptions{ContentType: dnstap.FSContentType})
+	if err != nil {
+		t.Fatalf("NewDecoder: %s", err)
+	}
+	var messages []*dnstap.Message
+	for i := 0; i < 2; i++ {
+		frame, err := decoder.Decode()
+		if err != nil {
+			t.Fatalf("Decode: %s", err)
+		}
+		var message dnstap.Dnstap
+		err = proto.Unmarshal(frame, &message)
+		if err != nil {
+			t.Fatalf("Unmarshal: %s", err)
+		}
+		messages = append(messages, message.Message)
+	}
+
+	queryMessage, responseMessage := messages[0], messages[1]
+	if queryMessage.GetType() != dnstap.Message_CLIENT_QUERY || !bytes.Equal(queryMessage.QueryMessage, b) {
+		t.Fatalf("expected the query, got %s", queryMessage)
+	}
+	if responseMessage.GetType() != dnstap.Message_AUTH_RESPONSE ||
+		!bytes.Equal(responseMessage.ResponseMessage, response) {
+		t.Fatalf("expected the response, got %s", responseMessage)
+	}
+	for _, message := range messages {
+		if !net.IP(message.QueryAddress).Equal(net.IPv4(192, 0, 2, 1)) || message.GetQueryPort() != 5300 ||
+			message.GetSocketFamily() != dnstap.SocketFamily_INET ||
+			message.GetSocketProtocol() != dnstap.SocketProtocol_DOT {
+			t.Fatalf("unexpected client address or transport in %s", message)
+		}
+	}
+}
+
+func TestDNSTapSamplingAndBuffering(t *testing.T) {
+	query := new(dns.Msg).SetQuestion(testZone, dns.TypeA)
+	b, err := query.Pack()
+	if err != nil {
+		t.Fatalf("Pack: %s", err)
+	}
+
+	d, l, _ := setupDNSTapServer(t, 3, 100)
+	for i := 0; i < 9; i++ {
+		d.handleDNSRequest(&net.UDPAddr{IP: net.IPv4(192, 0, 2, 1)}, b, transportUDP)
+	}
+	if len(l.exchanges) != 3 {
+		t.Fatalf("expected one in three exchanges to be logged, got %d of 9", len(l.exchanges))
+	}
+
+	// Exchanges that do not fit in the buffer are dropped rather than
+	// delaying the answers.
+	d, l, _ = setupDNSTapServer(t, 1, 2)
+	for i := 0; i < 5; i++ {
+		_, err = d.handleDNSRequest(&net.UDPAddr{IP: net.IPv4(192, 0, 2, 1)}, b, transportUDP)
+		if err != nil {
+			t.Fatalf("handleDNSRequest: %s", err)
+		}
+	}
+	if len(l.exchanges) != 2 || l.dropped != 3 {
+		t.Fatalf("expected 2 queued and 3 dropped exchanges, got %d and %d", len(l.exchanges), l.dropped)
+	}
+}
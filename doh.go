@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+const (
+	// dohPath is the URL path DNS-over-HTTPS queries are served on.
+	dohPath = "/dns-query"
+
+	// dohMediaType is the media type of DNS messages carried over HTTPS,
+	// as defined in RFC 8484.
+	dohMediaType = "application/dns-message"
+
+	// dohReadTimeout, dohWriteTimeout and dohIdleTimeout bound the time
+	// spent reading a request, writing a response and waiting for the
+	// next request on a DNS-over-HTTPS connection.
+	dohReadTimeout  = 5 * time.Second
+	dohWriteTimeout = 5 * time.Second
+	dohIdleTimeout  = tcpIdleTimeout
+)
+
+// serveHTTPS serves DNS-over-HTTPS on listener until system shutdown is
+// requested.
+func (d *DNSServer) serveHTTPS(listener net.Listener) {
+	defer wg.Done()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(dohPath, d.handleDoHRequest)
+	server := &http.Server{
+		Handler:      mux,
+		TLSConfig:    d.certificates.tlsConfig("h2", "http/1.1"),
+		ReadTimeout:  dohReadTimeout,
+		WriteTimeout: dohWriteTimeout,
+		IdleTimeout:  dohIdleTimeout,
+	}
+
+	done := make(chan struct{})
+	spawn("DNSServer.serveHTTPS-http.Server.ServeTLS", func() {
+		defer close(done)
+		err := server.ServeTLS(listener, "", "")
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Errorf("DNS-over-HTTPS server on %s failed: %v", listener.Addr(), err)
+		}
+	})
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if atomic.LoadInt32(&systemShutdown) != 0 {
+				server.Close()
+				<-done
+				log.Infof("DNS server on https %s shutdown", listener.Addr())
+				return
+			}
+		}
+	}
+}
+
+// handleDoHRequest answers a DNS query received over HTTPS, either as the
+// base64url encoded dns parameter of a GET request or as the body of a POST
+// request, as described in RFC 8484.
+func (d *DNSServer) handleDoHRequest(w http.ResponseWriter, r *http.Request) {
+	var b []byte
+	switch r.Method {
+	case http.MethodGet:
+		var err error
+		b, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		if err != nil || len(b) == 0 {
+			http.Error(w, "invalid dns parameter", http.StatusBadRequest)
+			return
+		}
+	case http.MethodPost:
+		if r.Header.Get("Content-Type") != dohMediaType {
+			http.Error(w, "unsupported media type", http.StatusUnsupportedMediaType)
+			return
+		}
+		var err error
+		b, err = io.ReadAll(io.LimitReader(r.Body, dns.MaxMsgSize+1))
+		if err != nil {
+			log.Infof("%s: failed to read DNS-over-HTTPS request: %v", r.RemoteAddr, err)
+			return
+		}
+		if len(b) == 0 || len(b) > dns.MaxMsgSize {
+			http.Error(w, "invalid dns message", http.StatusBadRequest)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+	if err != nil {
+		log.Infof("%s: invalid remote address: %v", r.RemoteAddr, err)
+		http.Error(w, "invalid remote address", http.StatusBadRequest)
+		return
+	}
+
+	sendBytes, err := d.handleDNSRequest(addr, b, transportHTTPS)
+	if err != nil {
+		http.Error(w, "invalid dns message", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", dohMediaType)
+	if maxAge, ok := responseMaxAge(sendBytes); ok {
+		w.Header().Set("Cache-Control", "max-age="+strconv.FormatUint(uint64(maxAge), 10))
+	}
+	_, err = w.Write(sendBytes)
+	if err != nil {
+		log.Infof("%s: failed to write response: %v", addr, err)
+	}
+}
+
+// responseMaxAge returns the freshness lifetime of a packed response, which
+// RFC 8484 section 5.1 requires to be no longer than the smallest TTL of
+// its records. It returns false if the response carries no records the
+// lifetime can be derived from.
+func responseMaxAge(b []byte) (uint32, bool) {
+	respMsg := new(dns.Msg)
+	err := respMsg.Unpack(b)
+	if err != nil {
+		return 0, false
+	}
+	var maxAge uint32
+	found := false
+	for _, section := range [][]dns.RR{respMsg.Answer, respMsg.Ns} {
+		for _, rr := range section {
+			if !found || rr.Header().Ttl < maxAge {
+				maxAge = rr.Header().Ttl
+				found = true
+			}
+		}
+	}
+	return maxAge, found
+}
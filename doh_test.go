@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestDoHRequests(t *testing.T) {
+	d := NewDNSServer(testDNSServerConfig(), []*DNSZoneConfig{{
+		Hostname:   testZone,
+		Nameserver: "ns.example.org",
+		Manager:    setupAnswerPoolManager(t, 2, newPeerSelector(0, 0, nil, nil, 0, globalRand{})),
+	}}, nil)
+
+	query := new(dns.Msg)
+	query.SetQuestion(testZone, dns.TypeA)
+	query.Id = 0
+	b, err := query.Pack()
+	if err != nil {
+		t.Fatalf("Pack: %s", err)
+	}
+
+	get := httptest.NewRequest(http.MethodGet, dohPath+"?dns="+base64.RawURLEncoding.EncodeToString(b), nil)
+	post := httptest.NewRequest(http.MethodPost, dohPath, bytes.NewReader(b))
+	post.Header.Set("Content-Type", dohMediaType)
+	for _, r := range []*http.Request{get, post} {
+		w := httptest.NewRecorder()
+		d.handleDoHRequest(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: unexpected status %d: %s", r.Method, w.Code, w.Body)
+		}
+		if w.Header().Get("Content-Type") != dohMediaType {
+			t.Fatalf("%s: unexpected content type %s", r.Method, w.Header().Get("Content-Type"))
+		}
+		if cacheControl := w.Header().Get("Cache-Control"); cacheControl != "max-age=30" {
+			t.Fatalf("%s: unexpected cache control %s", r.Method, cacheControl)
+		}
+		resp := new(dns.Msg)
+		err = resp.Unpack(w.Body.Bytes())
+		if err != nil {
+			t.Fatalf("%s: Unpack: %s", r.Method, err)
+		}
+		if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 1 {
+			t.Fatalf("%s: expected an A record, got:\n%s", r.Method, resp)
+		}
+	}
+
+	invalid := []struct {
+		request *http.Request
+		status  int
+	}{
+		{httptest.NewRequest(http.MethodGet, dohPath+"?dns=!", nil), http.StatusBadRequest},
+		{httptest.NewRequest(http.MethodGet, dohPath, nil), http.StatusBadRequest},
+		{httptest.NewRequest(http.MethodPost, dohPath, bytes.NewReader(b)), http.StatusUnsupportedMediaType},
+		{httptest.NewRequest(http.MethodPut, dohPath, bytes.NewReader(b)), http.StatusMethodNotAllowed},
+	}
+	for _, test := range invalid {
+		w := httptest.NewRecorder()
+		d.handleDoHRequest(w, test.request)
+		if w.Code != test.status {
+			t.Errorf("%s %s: expected status %d, got %d", test.request.Method, test.request.URL,
+				test.status, w.Code)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/oschwald/maxminddb-golang"
+	"github.com/pkg/errors"
+)
+
+// geoLocation is the region an IP is located in
+type geoLocation struct {
+	country   string
+	continent string
+}
+
+// regions returns the keys of the regions the location belongs to, the
+// smallest first
+func (l *geoLocation) regions() []string {
+	var regions []string
+	if l.country != "" {
+		regions = append(regions, "country:"+l.country)
+	}
+	if l.continent != "" {
+		regions = append(regions, "continent:"+l.continent)
+	}
+	return regions
+}
+
+func (l *geoLocation) String() string {
+	return fmt.Sprintf("%s/%s", l.continent, l.country)
+}
+
+// geoLocator looks up the location of IPs. Tests inject fixed locations in
+// place of a GeoIP database.
+type geoLocator interface {
+	// locate returns the location of ip, or nil if it is unknown, and
+	// the length of the prefix around ip the location applies to.
+	locate(ip net.IP) (*geoLocation, int)
+}
+
+// geoRecord holds the fields read from the records of a GeoIP2 or GeoLite2
+// Country or City database
+type geoRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	Continent struct {
+		Code string `maxminddb:"code"`
+	} `maxminddb:"continent"`
+}
+
+// geoDatabase is a geoLocator backed by a MaxMind DB file
+type geoDatabase struct {
+	reader *maxminddb.Reader
+}
+
+// openGeoDatabase opens the MaxMind DB file at path.
+func openGeoDatabase(path string) (*geoDatabase, error) {
+	reader, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open GeoIP database %s", path)
+	}
+	return &geoDatabase{reader: reader}, nil
+}
+
+func (g *geoDatabase) locate(ip net.IP) (*geoLocation, int) {
+	var record geoRecord
+	network, ok, err := g.reader.LookupNetwork(ip, &record)
+	if err != nil || network == nil {
+		return nil, 0
+	}
+	prefixLength, _ := network.Mask.Size()
+	if !ok || (record.Country.ISOCode == "" && record.Continent.Code == "") {
+		return nil, prefixLength
+	}
+	return &geoLocation{
+		country:   record.Country.ISOCode,
+		continent: record.Continent.Code,
+	}, prefixLength
+}
+
+// Close closes the database file
+func (g *geoDatabase) Close() error {
+	return g.reader.Close()
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"testing"
+
+	"github.com/kaspanet/kaspad/app/appmessage"
+	"github.com/miekg/dns"
+)
+
+// testGeoLocator locates IPv4 addresses by their first octet
+type testGeoLocator map[byte]*geoLocation
+
+func (g testGeoLocator) locate(ip net.IP) (*geoLocation, int) {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return nil, 0
+	}
+	return g[ip4[0]], 8
+}
+
+var testGeo = testGeoLocator{
+	1: {country: "DE", continent: "EU"},
+	2: {country: "FR", continent: "EU"},
+	3: {country: "US", continent: "NA"},
+	4: {country: "JP", continent: "AS"},
+}
+
+// setupGeoManager returns a manager with ten nodes in each of the countries
+// given by their first octet in testGeo.
+func setupGeoManager(t *testing.T, globalShare float64, firstOctets ...byte) *Manager {
+	m := setupAnswerPoolManager(t, 0, newPeerSelector(0, 0, nil, testGeo, globalShare,
+		rand.New(rand.NewSource(1))))
+	for _, firstOctet := range firstOctets {
+		for i := 1; i <= 10; i++ {
+			addGoodTestNodes(m, fmt.Sprintf("%d.0.0.%d", firstOctet, i))
+		}
+	}
+	return m
+}
+
+func countCountries(entries []*poolEntry) map[string]int {
+	countries := make(map[string]int)
+	for _, entry := range entries {
+		location, _ := testGeo.locate(entry.node.Addr.IP)
+		countries[location.country]++
+	}
+	return countries
+}
+
+func TestPeerSelectorGeoBias(t *testing.T) {
+	m := setupGeoManager(t, 0.25, 1, 2, 3)
+
+	tests := []struct {
+		name        string
+		near        *geoLocation
+		wantAtLeast map[string]int
+	}{
+		{
+			name:        "same country",
+			near:        testGeo[1],
+			wantAtLeast: map[string]int{"DE": 6},
+		},
+		{
+			name:        "same continent",
+			near:        &geoLocation{country: "IT", continent: "EU"},
+			wantAtLeast: map[string]int{"DE": 0, "FR": 0},
+		},
+	}
+	for _, test := range tests {
+		for i := 0; i < 20; i++ {
+			entries := m.sampleAnswerPool(dns.TypeA, &AddressFilter{}, test.near, 8)
+			if len(entries) != 8 {
+				t.Fatalf("%s: expected 8 entries, got %d", test.name, len(entries))
+			}
+			countries := countCountries(entries)
+			local := 0
+			for country, atLeast := range test.wantAtLeast {
+				if countries[country] < atLeast {
+					t.Fatalf("%s: expected at least %d nodes from %s, got %v", test.name, atLeast,
+						country, countries)
+				}
+				local += countries[country]
+			}
+			if local < 6 {
+				t.Fatalf("%s: expected at least 6 nearby nodes, got %v", test.name, countries)
+			}
+		}
+	}
+
+	// Without nodes in the client's region, answers are filled with
+	// nodes from anywhere.
+	entries := m.sampleAnswerPool(dns.TypeA, &AddressFilter{}, testGeo[4], 8)
+	if len(entries) != 8 {
+		t.Fatalf("expected 8 entries for a client without nearby nodes, got %d", len(entries))
+	}
+
+	// With a global share of 1, the client's location does not matter.
+	m = setupGeoManager(t, 1, 1, 3)
+	seenUS := false
+	for i := 0; i < 20; i++ {
+		if countCountries(m.sampleAnswerPool(dns.TypeA, &AddressFilter{}, testGeo[1], 8))["US"] > 0 {
+			seenUS = true
+		}
+	}
+	if !seenUS {
+		t.Fatalf("expected nodes from other continents with a global share of 1")
+	}
+}
+
+func TestDNSClientSubnet(t *testing.T) {
+	cfg := testDNSServerConfig()
+	cfg.MaxAddresses = 4
+	cfg.Geo = testGeo
+	d := NewDNSServer(cfg, []*DNSZoneConfig{{
+		Hostname:   testZone,
+		Nameserver: "ns.example.org",
+		Manager:    setupGeoManager(t, 0, 1, 3),
+	}}, nil)
+
+	query := func(qtype uint16, ecs *dns.EDNS0_SUBNET) *dns.Msg {
+		dnsMsg := new(dns.Msg)
+		dnsMsg.SetQuestion(testZone, qtype)
+		if ecs != nil {
+			dnsMsg.SetEdns0(ednsMaxUDPSize, false)
+			opt := dnsMsg.IsEdns0()
+			opt.Option = append(opt.Option, ecs)
+		}
+		b, err := dnsMsg.Pack()
+		if err != nil {
+			t.Fatalf("Pack: %s", err)
+		}
+		// The query comes from a resolver in the US.
+		respBytes, err := d.handleDNSRequest(&net.UDPAddr{IP: net.IPv4(3, 0, 0, 53)}, b, transportUDP)
+		if err != nil {
+			t.Fatalf("handleDNSRequest: %s", err)
+		}
+		resp := new(dns.Msg)
+		err = resp.Unpack(respBytes)
+		if err != nil {
+			t.Fatalf("Unpack: %s", err)
+		}
+		return resp
+	}
+	subnet := func(ip net.IP, sourceNetmask uint8) *dns.EDNS0_SUBNET {
+		return &dns.EDNS0_SUBNET{
+			Code:          dns.EDNS0SUBNET,
+			Family:        1,
+			SourceNetmask: sourceNetmask,
+			Address:       ip,
+		}
+	}
+
+	resp := query(dns.TypeA, subnet(net.IPv4(1, 2, 3, 0), 24))
+	if countCountries(answerEntries(resp))["DE"] != len(resp.Answer) {
+		t.Fatalf("expected only nodes near the client subnet, got:\n%s", resp)
+	}
+	if ecs := clientSubnet(resp); ecs == nil || ecs.SourceScope != 8 || ecs.SourceNetmask != 24 {
+		t.Fatalf("expected the client subnet to be echoed with a scope of 8, got:\n%s", resp)
+	}
+
+	resp = query(dns.TypeA, nil)
+	if countCountries(answerEntries(resp))["US"] != len(resp.Answer) {
+		t.Fatalf("expected only nodes near the resolver, got:\n%s", resp)
+	}
+	if clientSubnet(resp) != nil {
+		t.Fatalf("expected no client subnet option, got:\n%s", resp)
+	}
+
+	resp = query(dns.TypeA, subnet(net.IPv4(0, 0, 0, 0), 0))
+	if ecs := clientSubnet(resp); ecs == nil || ecs.SourceScope != 0 {
+		t.Fatalf("expected the client subnet to be echoed with a scope of 0, got:\n%s", resp)
+	}
+
+	resp = query(dns.TypeSOA, subnet(net.IPv4(1, 2, 3, 0), 24))
+	if ecs := clientSubnet(resp); ecs == nil || ecs.SourceScope != 0 {
+		t.Fatalf("expected answers not depending on the client to have a scope of 0, got:\n%s", resp)
+	}
+}
+
+// answerEntries wraps the addresses answered in resp into pool entries
+func answerEntries(resp *dns.Msg) []*poolEntry {
+	var entries []*poolEntry
+	for _, rr := range resp.Answer {
+		if a, ok := rr.(*dns.A); ok {
+			entries = append(entries, &poolEntry{node: &Node{Addr: &appmessage.NetAddress{IP: a.A}}})
+		}
+	}
+	return entries
+}
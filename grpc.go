@@ -13,6 +13,7 @@ import (
 	"github.com/miekg/dns"
 	"github.com/pkg/errors"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/peer"
 )
 
 // GRPCServer contains methods to start and stop GRPC server
@@ -24,32 +25,38 @@ type GRPCServer interface {
 type grpcServer struct {
 	pb.UnimplementedPeerServiceServer
 
-	server *grpc.Server
-	amgr   *Manager
+	server       *grpc.Server
+	amgr         *Manager
+	maxAddresses int
 }
 
-// NewGRPCServer returns new GRPC server
-func NewGRPCServer(amgr *Manager) GRPCServer {
-	return &grpcServer{amgr: amgr}
+// NewGRPCServer returns new GRPC server that returns up to maxAddresses
+// addresses of each IP family
+func NewGRPCServer(amgr *Manager, maxAddresses int) GRPCServer {
+	return &grpcServer{amgr: amgr, maxAddresses: maxAddresses}
 }
 
 func (s *grpcServer) Start(listenInterface string) error {
-	s.server = grpc.NewServer()
-	pb.RegisterPeerServiceServer(s.server, s)
-
 	lis, err := net.Listen("tcp", fmt.Sprintf(listenInterface))
 	if err != nil {
 		return errors.WithStack(err)
 	}
 
+	s.serve(lis)
+	return nil
+}
+
+// serve serves gRPC requests accepted on lis
+func (s *grpcServer) serve(lis net.Listener) {
+	s.server = grpc.NewServer()
+	pb.RegisterPeerServiceServer(s.server, s)
+
 	spawn("gRPC server", func() {
-		err = s.server.Serve(lis)
+		err := s.server.Serve(lis)
 		if err != nil {
 			fmt.Printf("%+v", err)
 		}
 	})
-
-	return nil
 }
 
 func (s *grpcServer) Stop() {
@@ -65,8 +72,16 @@ func (s *grpcServer) GetPeersList(ctx context.Context, req *pb.GetPeersListReque
 	}
 
 	// mb, we should move DNS-related logic out of manager?
-	ipv4Addresses := s.amgr.GoodAddresses(dns.TypeA, req.IncludeAllSubnetworks, subnetworkID)
-	ipv6Addresses := s.amgr.GoodAddresses(dns.TypeAAAA, req.IncludeAllSubnetworks, subnetworkID)
+	filter := &AddressFilter{
+		IncludeAllSubnetworks: req.IncludeAllSubnetworks,
+		SubnetworkID:          subnetworkID,
+	}
+	var near *geoLocation
+	if p, ok := peer.FromContext(ctx); ok {
+		near = s.amgr.selector.locate(addrIP(p.Addr))
+	}
+	ipv4Addresses := s.amgr.GoodAddresses(dns.TypeA, filter, near, s.maxAddresses)
+	ipv6Addresses := s.amgr.GoodAddresses(dns.TypeAAAA, filter, near, s.maxAddresses)
 
 	addresses := ToProtobufAddresses(append(ipv4Addresses, ipv6Addresses...))
 	log.Errorf("ADDRESSES: %+v", addresses)
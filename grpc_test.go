@@ -2,13 +2,10 @@ package main
 
 import (
 	"context"
-	"fmt"
 	"net"
-	"os"
 	"testing"
 
 	"github.com/kaspanet/kaspad/domain/consensus/model/externalapi"
-	"github.com/kaspanet/kaspad/infrastructure/config"
 
 	"github.com/kaspanet/kaspad/app/appmessage"
 	"github.com/kaspanet/kaspad/infrastructure/network/dnsseed/pb"
@@ -16,35 +13,25 @@ import (
 )
 
 func TestGetPeers(t *testing.T) {
-	activeConfig = &ConfigFlags{
-		NetworkFlags: config.NetworkFlags{Devnet: true},
-	}
-
-	err := activeConfig.NetworkFlags.ResolveNetwork(nil)
+	amgr, err := NewManager(t.TempDir(), testNetParams(), defaultStaleTimeout, defaultPruneExpireTimeout,
+		defaultMaxFailures, newPeerSelector(defaultNetgroupCap, 0, nil, nil, 0, globalRand{}))
 	if err != nil {
-		t.Fatalf("ResolveNetwork: %s", err)
-	}
-
-	peersDefaultPort = 1313
-
-	amgr, err = NewManager(DefaultAppDir)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "NewManager: %v\n", err)
-		os.Exit(1)
+		t.Fatalf("NewManager: %s", err)
 	}
 
 	ip := net.IP([]byte{203, 105, 20, 21})
-	netAddress := appmessage.NewNetAddressIPPort(ip, uint16(peersDefaultPort))
+	netAddress := appmessage.NewNetAddressIPPort(ip, testPort)
 	amgr.AddAddresses([]*appmessage.NetAddress{netAddress})
 	amgr.Good(ip, nil)
+	amgr.refreshAnswerPools()
 
-	host := "localhost:3737"
-	grpcServer := NewGRPCServer(amgr)
-	err = grpcServer.Start(host)
-
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
-		t.Fatal("Failed to start gRPC server")
+		t.Fatalf("Failed to start gRPC server: %s", err)
 	}
+	host := lis.Addr().String()
+	server := NewGRPCServer(amgr, defaultMaxAddresses).(*grpcServer)
+	server.serve(lis)
 
 	var subnetworkID *externalapi.DomainSubnetworkID
 	conn, err := grpc.Dial(host, grpc.WithInsecure())
@@ -83,7 +70,7 @@ func TestGetPeers(t *testing.T) {
 	}
 
 	t.Logf("TestGetPeers completed")
-	grpcServer.Stop()
+	server.Stop()
 }
 
 func fromProtobufAddresses(proto []*pb.NetAddress) []net.IP {
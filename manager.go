@@ -6,27 +6,77 @@ package main
 
 import (
 	"encoding/json"
+	"math/rand"
 	"net"
 	"os"
 	"path/filepath"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/kaspanet/kaspad/infrastructure/network/addressmanager"
 
 	"github.com/kaspanet/kaspad/app/appmessage"
 	"github.com/kaspanet/kaspad/domain/consensus/model/externalapi"
+	"github.com/kaspanet/kaspad/domain/dagconfig"
 	"github.com/miekg/dns"
 	"github.com/pkg/errors"
 )
 
 // Node repesents a node in the Kaspa network
 type Node struct {
-	Addr         *appmessage.NetAddress
-	LastAttempt  time.Time
-	LastSuccess  time.Time
-	LastSeen     time.Time
-	SubnetworkID *externalapi.DomainSubnetworkID
+	Addr            *appmessage.NetAddress
+	LastAttempt     time.Time
+	LastSuccess     time.Time
+	LastSeen        time.Time
+	SubnetworkID    *externalapi.DomainSubnetworkID
+	ProtocolVersion uint32
+	Services        appmessage.ServiceFlag
+
+	// Attempts and Successes count the node's connection attempts and the
+	// successful ones, and Uptime records them decayed over each of the
+	// uptimeWindows.
+	Attempts  uint32
+	Successes uint32
+	Uptime    [len(uptimeWindows)]UptimeStat
+
+	// ConnectLatency and HandshakeLatency are the times it took to
+	// connect to the node and to complete the handshake with it.
+	ConnectLatency   LatencyHistogram
+	HandshakeLatency LatencyHistogram
+
+	// ConsecutiveFailures counts the connection attempts that failed
+	// since the last successful one, and NextAttempt is the time from
+	// which the node is due to be polled again.
+	ConsecutiveFailures int
+	NextAttempt         time.Time
+
+	// UserAgent, PeerID and AdvertisedAddress are taken from the version
+	// message the node sent when it was last polled, along with its
+	// subnetwork ID, protocol version and services.
+	UserAgent         string
+	PeerID            string
+	AdvertisedAddress *appmessage.NetAddress
+}
+
+// AddressFilter restricts the nodes returned by GoodAddresses
+type AddressFilter struct {
+	IncludeAllSubnetworks bool
+	SubnetworkID          *externalapi.DomainSubnetworkID
+	MinProtocolVersion    uint32
+	Services              appmessage.ServiceFlag
+}
+
+// matches returns whether node passes the filter
+func (f *AddressFilter) matches(node *Node) bool {
+	if !f.IncludeAllSubnetworks && !node.SubnetworkID.Equal(f.SubnetworkID) {
+		return false
+	}
+	if node.ProtocolVersion < f.MinProtocolVersion {
+		return false
+	}
+	return node.Services&f.Services == f.Services
 }
 
 // Manager is dnsseeder's main worker-type, storing all information required
@@ -38,14 +88,42 @@ type Manager struct {
 	wg        sync.WaitGroup
 	quit      chan struct{}
 	peersFile string
+	selector  *peerSelector
+
+	// netParams are the parameters of the network the nodes belong to,
+	// and defaultPort is its default P2P port.
+	netParams   *dagconfig.Params
+	defaultPort uint16
+
+	// staleTimeout is the time after its last successful connection in
+	// which a node is considered good. pruneExpire is the time after
+	// which a node that was not seen or successfully connected to is
+	// removed.
+	staleTimeout time.Duration
+	pruneExpire  time.Duration
+
+	// maxFailures is the number of consecutive failed connection
+	// attempts after which a node is removed.
+	maxFailures int
+
+	// answerPools holds the latest *answerPools snapshot served by
+	// the DNS server. answerPoolsDirty is set when node state changes
+	// and cleared when the snapshot is rebuilt.
+	answerPools      atomic.Value
+	answerPoolsDirty int32
+
+	// lastCrawlRound holds the time.Time the crawler last polled every
+	// node that was due.
+	lastCrawlRound atomic.Value
 }
 
 const (
-	// defaultMaxAddresses is the maximum number of addresses to return.
+	// defaultMaxAddresses is the default maximum number of addresses to
+	// return.
 	defaultMaxAddresses = 16
 
-	// defaultStaleTimeout is the time in which a host is considered
-	// stale.
+	// defaultStaleTimeout is the default time in which a host is
+	// considered stale.
 	defaultStaleTimeout = time.Hour
 
 	// dumpAddressInterval is the interval used to dump the address
@@ -59,20 +137,50 @@ const (
 	// pruner.
 	pruneAddressInterval = time.Minute * 1
 
-	// pruneExpireTimeout is the expire time in which a node is
-	// considered dead.
-	pruneExpireTimeout = time.Hour * 8
+	// defaultPruneExpireTimeout is the default expire time in which a
+	// node is considered dead.
+	defaultPruneExpireTimeout = time.Hour * 8
+
+	// defaultMaxFailures is the default number of consecutive failed
+	// connection attempts after which a node is removed.
+	defaultMaxFailures = 8
+
+	// minRetryBackoff and maxRetryBackoff bound the time after which a
+	// node is polled again after a failed connection attempt. The backoff
+	// doubles with each consecutive failure.
+	minRetryBackoff = time.Minute
+	maxRetryBackoff = 4 * time.Hour
+
+	// retryJitter is the share by which a backoff is randomly shortened
+	// or lengthened, so that nodes that failed together are not retried
+	// together.
+	retryJitter = 0.25
 )
 
-// NewManager constructs and returns a new dnsseeder manager, with the provided dataDir
-func NewManager(dataDir string) (*Manager, error) {
+// NewManager constructs and returns a new dnsseeder manager for the nodes of
+// the network described by netParams, with the provided dataDir, timeouts and
+// failure budget, that picks the addresses it returns with selector
+func NewManager(dataDir string, netParams *dagconfig.Params, staleTimeout, pruneExpire time.Duration,
+	maxFailures int, selector *peerSelector) (*Manager, error) {
+
+	defaultPort, err := strconv.ParseUint(netParams.DefaultPort, 10, 16)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid default port %s of network %s", netParams.DefaultPort, netParams.Name)
+	}
+
 	amgr := Manager{
-		nodes:     make(map[string]*Node),
-		peersFile: filepath.Join(dataDir, peersFilename),
-		quit:      make(chan struct{}),
+		nodes:        make(map[string]*Node),
+		peersFile:    filepath.Join(dataDir, peersFilename),
+		selector:     selector,
+		netParams:    netParams,
+		defaultPort:  uint16(defaultPort),
+		staleTimeout: staleTimeout,
+		pruneExpire:  pruneExpire,
+		maxFailures:  maxFailures,
+		quit:         make(chan struct{}),
 	}
 
-	err := amgr.deserializePeers()
+	err = amgr.deserializePeers()
 	if err != nil {
 		log.Warnf("Failed to parse file %s: %v", amgr.peersFile, err)
 		// if it is invalid we nuke the old one unconditionally.
@@ -83,6 +191,8 @@ func NewManager(dataDir string) (*Manager, error) {
 		}
 	}
 
+	amgr.refreshAnswerPools()
+
 	amgr.wg.Add(1)
 	spawn("NewManager-Manager.addressHandler", amgr.addressHandler)
 
@@ -96,7 +206,7 @@ func (m *Manager) AddAddresses(addrs []*appmessage.NetAddress) int {
 
 	m.mtx.Lock()
 	for _, addr := range addrs {
-		if !addressmanager.IsRoutable(addr, ActiveConfig().NetParams().AcceptUnroutable) {
+		if !addressmanager.IsRoutable(addr, m.netParams.AcceptUnroutable) {
 			continue
 		}
 		addrStr := addr.IP.String()
@@ -118,23 +228,21 @@ func (m *Manager) AddAddresses(addrs []*appmessage.NetAddress) int {
 	return count
 }
 
-// Addresses returns IPs that need to be tested again.
-func (m *Manager) Addresses() []*appmessage.NetAddress {
-	addrs := make([]*appmessage.NetAddress, 0, defaultMaxAddresses*8)
+// Addresses returns up to maxAddresses IPs that are due to be tested again,
+// leaving out the nodes skip returns true for.
+func (m *Manager) Addresses(maxAddresses int, skip func(node *Node) bool) []*appmessage.NetAddress {
+	addrs := make([]*appmessage.NetAddress, 0, maxAddresses)
 	now := time.Now()
-	i := defaultMaxAddresses
 
 	m.mtx.RLock()
 	for _, node := range m.nodes {
-		if i == 0 {
+		if len(addrs) == maxAddresses {
 			break
 		}
-		if now.Sub(node.LastSuccess) < defaultStaleTimeout ||
-			now.Sub(node.LastAttempt) < defaultStaleTimeout {
+		if now.Before(node.NextAttempt) || skip(node) {
 			continue
 		}
 		addrs = append(addrs, node.Addr)
-		i--
 	}
 	m.mtx.RUnlock()
 
@@ -146,70 +254,129 @@ func (m *Manager) AddressCount() int {
 	return len(m.nodes)
 }
 
-// GoodAddresses returns good working IPs that match both the
-// passed DNS query type and have the requested services.
-func (m *Manager) GoodAddresses(qtype uint16, includeAllSubnetworks bool, subnetworkID *externalapi.DomainSubnetworkID,
-) []*appmessage.NetAddress {
-	addrs := make([]*appmessage.NetAddress, 0, defaultMaxAddresses)
-	i := defaultMaxAddresses
-
-	if qtype != dns.TypeA && qtype != dns.TypeAAAA {
-		return addrs
+// GoodAddresses returns up to maxAddresses good working IPs that match both
+// the passed DNS query type and the passed filter, picked at random by the
+// manager's peer selector. A and AAAA queries only return nodes listening on
+// the network's default port, while SRV queries return nodes of both IP
+// families on any port. If near is not nil, nodes in the same country or
+// continent are preferred.
+func (m *Manager) GoodAddresses(qtype uint16, filter *AddressFilter, near *geoLocation,
+	maxAddresses int) []*appmessage.NetAddress {
+
+	entries := m.sampleAnswerPool(qtype, filter, near, maxAddresses)
+	addrs := make([]*appmessage.NetAddress, 0, len(entries))
+	for _, entry := range entries {
+		addrs = append(addrs, entry.node.Addr)
 	}
+	return addrs
+}
 
-	now := time.Now()
-	m.mtx.RLock()
-	for _, node := range m.nodes {
-		if i == 0 {
-			break
-		}
+// isGoodForQuery returns whether node is a good working node that can be
+// returned in an answer to the passed DNS query type: it was reached recently
+// and has been reliable over one of the uptime windows.
+func (m *Manager) isGoodForQuery(node *Node, qtype uint16, now time.Time) bool {
+	if qtype != dns.TypeSRV && node.Addr.Port != m.defaultPort {
+		return false
+	}
 
-		if node.Addr.Port != uint16(peersDefaultPort) {
-			continue
-		}
+	if qtype == dns.TypeA && node.Addr.IP.To4() == nil {
+		return false
+	} else if qtype == dns.TypeAAAA && node.Addr.IP.To4() != nil {
+		return false
+	}
 
-		if !includeAllSubnetworks && !node.SubnetworkID.Equal(subnetworkID) {
-			continue
-		}
+	return !node.LastSuccess.IsZero() &&
+		now.Sub(node.LastSuccess) <= m.staleTimeout && node.isReliable()
+}
 
-		if qtype == dns.TypeA && node.Addr.IP.To4() == nil {
-			continue
-		} else if qtype == dns.TypeAAAA && node.Addr.IP.To4() != nil {
-			continue
+// Attempt updates the last connection attempt for the specified ip address to
+// now. It is called once a connection attempt is over, and updates the node's
+// uptime statistics with whether the attempt succeeded. A node that was
+// reached is polled again once it turns stale, while one that failed is
+// retried with exponential backoff.
+func (m *Manager) Attempt(ip net.IP) {
+	m.mtx.Lock()
+	node, exists := m.nodes[ip.String()]
+	if exists {
+		now := time.Now()
+		success := node.LastSuccess.After(node.LastAttempt)
+		for i, window := range uptimeWindows {
+			node.Uptime[i].update(success, now.Sub(node.LastAttempt), window)
 		}
-
-		if node.LastSuccess.IsZero() ||
-			now.Sub(node.LastSuccess) > defaultStaleTimeout {
-			continue
+		node.Attempts++
+		if success {
+			node.Successes++
+			node.ConsecutiveFailures = 0
+			node.NextAttempt = now.Add(m.staleTimeout)
+		} else {
+			node.ConsecutiveFailures++
+			node.NextAttempt = now.Add(retryBackoff(node.ConsecutiveFailures, rand.Float64()))
 		}
-
-		addrs = append(addrs, node.Addr)
-		i--
+		node.LastAttempt = now
 	}
-	m.mtx.RUnlock()
+	m.mtx.Unlock()
+}
 
-	return addrs
+// retryBackoff returns the time after which a node is polled again after
+// the given number of consecutive failures. The backoff is jittered by r,
+// which is between 0 and 1.
+func retryBackoff(failures int, r float64) time.Duration {
+	backoff := maxRetryBackoff
+	if shift := failures - 1; shift < 32 && minRetryBackoff<<shift < maxRetryBackoff {
+		backoff = minRetryBackoff << shift
+	}
+	return time.Duration(float64(backoff) * (1 + retryJitter*(2*r-1)))
 }
 
-// Attempt updates the last connection attempt for the specified ip address to now
-func (m *Manager) Attempt(ip net.IP) {
+// RecordLatency records the time it took to connect to the node at the
+// specified ip address and to complete the handshake with it.
+func (m *Manager) RecordLatency(ip net.IP, connect, handshake time.Duration) {
 	m.mtx.Lock()
 	node, exists := m.nodes[ip.String()]
 	if exists {
-		node.LastAttempt = time.Now()
+		node.ConnectLatency.add(connect)
+		node.HandshakeLatency.add(handshake)
 	}
 	m.mtx.Unlock()
 }
 
-// Good updates the last successful connection attempt for the specified ip address to now
-func (m *Manager) Good(ip net.IP, subnetworkid *externalapi.DomainSubnetworkID) {
+// CrawlRoundDone records that the crawler polled every node that was due
+func (m *Manager) CrawlRoundDone() {
+	m.lastCrawlRound.Store(time.Now())
+}
+
+// LastCrawlRound returns the time the crawler last polled every node that
+// was due, or the zero time if it did not yet.
+func (m *Manager) LastCrawlRound() time.Time {
+	t, _ := m.lastCrawlRound.Load().(time.Time)
+	return t
+}
+
+// Good updates the last successful connection attempt for the specified ip
+// address to now, and records the metadata of the version message the node
+// sent in the handshake. If version is nil, the node's metadata is kept.
+func (m *Manager) Good(ip net.IP, version *appmessage.MsgVersion) {
 	m.mtx.Lock()
 	node, exists := m.nodes[ip.String()]
 	if exists {
 		node.LastSuccess = time.Now()
-		node.SubnetworkID = subnetworkid
+		if version != nil {
+			node.SubnetworkID = version.SubnetworkID
+			node.ProtocolVersion = version.ProtocolVersion
+			node.Services = version.Services
+			node.UserAgent = version.UserAgent
+			node.PeerID = ""
+			if version.ID != nil {
+				node.PeerID = version.ID.String()
+			}
+			node.AdvertisedAddress = version.Address
+		}
 	}
 	m.mtx.Unlock()
+
+	if exists {
+		m.markAnswerPoolsDirty()
+	}
 }
 
 // addressHandler is the main handler for the address manager. It must be run
@@ -220,9 +387,13 @@ func (m *Manager) addressHandler() {
 	defer pruneAddressTicker.Stop()
 	dumpAddressTicker := time.NewTicker(dumpAddressInterval)
 	defer dumpAddressTicker.Stop()
+	answerPoolTicker := time.NewTicker(answerPoolRefreshInterval)
+	defer answerPoolTicker.Stop()
 out:
 	for {
 		select {
+		case <-answerPoolTicker.C:
+			m.maybeRefreshAnswerPools()
 		case <-dumpAddressTicker.C:
 			m.savePeers()
 		case <-pruneAddressTicker.C:
@@ -241,20 +412,15 @@ func (m *Manager) prunePeers() {
 	now := time.Now()
 	m.mtx.Lock()
 
-	lastSeenAbovePruneExpire := func(node *Node) bool {
-		return now.Sub(node.LastSeen) > pruneExpireTimeout
+	exceededFailureBudget := func(node *Node) bool {
+		return node.ConsecutiveFailures >= m.maxFailures
 	}
-	hadAttemptsButNoSuccess := func(node *Node) bool {
-		return !node.LastAttempt.IsZero() && node.LastSuccess.IsZero()
-	}
-	hadSuccessButLongTimeAgo := func(node *Node) bool {
-		return !node.LastSuccess.IsZero() && now.Sub(node.LastSuccess) > pruneExpireTimeout
+	neverReachedAndNotSeen := func(node *Node) bool {
+		return node.LastSuccess.IsZero() && now.Sub(node.LastSeen) > m.pruneExpire
 	}
 
 	for k, node := range m.nodes {
-		if lastSeenAbovePruneExpire(node) ||
-			hadAttemptsButNoSuccess(node) ||
-			hadSuccessButLongTimeAgo(node) {
+		if exceededFailureBudget(node) || neverReachedAndNotSeen(node) {
 
 			delete(m.nodes, k)
 			count++
@@ -263,6 +429,10 @@ func (m *Manager) prunePeers() {
 	l := len(m.nodes)
 	m.mtx.Unlock()
 
+	if count > 0 {
+		m.markAnswerPoolsDirty()
+	}
+
 	log.Infof("Pruned %d addresses: %d remaining", count, l)
 }
 
@@ -287,6 +457,14 @@ func (m *Manager) deserializePeers() error {
 
 	l := len(nodes)
 
+	// Nodes saved before retries were scheduled are due once they turn
+	// stale.
+	for _, node := range nodes {
+		if node.NextAttempt.IsZero() && !node.LastAttempt.IsZero() {
+			node.NextAttempt = node.LastAttempt.Add(m.staleTimeout)
+		}
+	}
+
 	m.mtx.Lock()
 	m.nodes = nodes
 	m.mtx.Unlock()
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/kaspanet/kaspad/app/appmessage"
+	"github.com/kaspanet/kaspad/domain/consensus/model/externalapi"
+	"github.com/kaspanet/kaspad/infrastructure/network/dnsseed"
+	"github.com/kaspanet/kaspad/infrastructure/network/netadapter/id"
+	"github.com/miekg/dns"
+)
+
+func TestNodeHandshakeMetadata(t *testing.T) {
+	dir := t.TempDir()
+	selector := newPeerSelector(0, 0, nil, nil, 0, globalRand{})
+	m, err := NewManager(dir, testNetParams(), defaultStaleTimeout, defaultPruneExpireTimeout,
+		defaultMaxFailures, selector)
+	if err != nil {
+		t.Fatalf("NewManager: %s", err)
+	}
+	full, partial := net.IP{1, 0, 0, 1}, net.IP{1, 0, 0, 2}
+	m.AddAddresses([]*appmessage.NetAddress{
+		appmessage.NewNetAddressIPPort(full, testPort),
+		appmessage.NewNetAddressIPPort(partial, testPort),
+	})
+
+	peerID, err := id.GenerateID()
+	if err != nil {
+		t.Fatalf("GenerateID: %s", err)
+	}
+	subnetworkID := &externalapi.DomainSubnetworkID{1, 2, 3}
+	m.Good(full, &appmessage.MsgVersion{ProtocolVersion: 5, Services: appmessage.SFNodeNetwork,
+		UserAgent: "/kaspad:0.12.7/", ID: peerID})
+	m.Good(partial, &appmessage.MsgVersion{ProtocolVersion: 5, UserAgent: "/kaspad:0.12.7/", ID: peerID,
+		SubnetworkID: subnetworkID, Address: appmessage.NewNetAddressIPPort(net.IP{9, 9, 9, 9}, testPort)})
+	// Polling a node without a version message keeps its metadata.
+	m.Good(partial, nil)
+	m.savePeers()
+
+	m, err = NewManager(dir, testNetParams(), defaultStaleTimeout, defaultPruneExpireTimeout,
+		defaultMaxFailures, selector)
+	if err != nil {
+		t.Fatalf("NewManager: %s", err)
+	}
+	node := m.nodes[partial.String()]
+	if node.ProtocolVersion != 5 || node.UserAgent != "/kaspad:0.12.7/" || node.PeerID != peerID.String() ||
+		!node.SubnetworkID.Equal(subnetworkID) || !node.AdvertisedAddress.IP.Equal(net.IP{9, 9, 9, 9}) {
+		t.Fatalf("expected the handshake metadata to be persisted, got %+v", node)
+	}
+	if node := m.nodes[full.String()]; node.SubnetworkID != nil || node.Services != appmessage.SFNodeNetwork {
+		t.Fatalf("expected a full node with its services, got %+v", node)
+	}
+
+	d := NewDNSServer(testDNSServerConfig(), []*DNSZoneConfig{{Hostname: testZone, Nameserver: "ns.example.org", Manager: m}}, nil)
+	tests := []struct {
+		name string
+		ip   net.IP
+	}{
+		{string(dnsseed.SubnetworkIDPrefixChar) + "." + testZone, full},
+		{string(dnsseed.SubnetworkIDPrefixChar) + subnetworkID.String() + "." + testZone, partial},
+		{"s1." + testZone, full},
+	}
+	for _, test := range tests {
+		resp := queryDNSServer(t, d, test.name, dns.TypeA)
+		if len(resp.Answer) != 1 || !resp.Answer[0].(*dns.A).A.Equal(test.ip) {
+			t.Fatalf("%s: expected %s, got:\n%s", test.name, test.ip, resp)
+		}
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	tests := []struct {
+		failures int
+		r        float64
+		want     time.Duration
+	}{
+		{1, 0.5, minRetryBackoff},
+		{2, 0.5, 2 * minRetryBackoff},
+		{4, 0.5, 8 * minRetryBackoff},
+		{4, 0, 6 * minRetryBackoff},
+		{4, 1, 10 * minRetryBackoff},
+		{100, 0.5, maxRetryBackoff},
+	}
+	for _, test := range tests {
+		if backoff := retryBackoff(test.failures, test.r); backoff != test.want {
+			t.Fatalf("%d failures, jitter %.1f: expected %s, got %s", test.failures, test.r, test.want, backoff)
+		}
+	}
+}
+
+func TestNodeFailureBudget(t *testing.T) {
+	dir := t.TempDir()
+	selector := newPeerSelector(0, 0, nil, nil, 0, globalRand{})
+	m, err := NewManager(dir, testNetParams(), defaultStaleTimeout, defaultPruneExpireTimeout, 3, selector)
+	if err != nil {
+		t.Fatalf("NewManager: %s", err)
+	}
+	ip := net.IP{1, 0, 0, 1}
+	m.AddAddresses([]*appmessage.NetAddress{appmessage.NewNetAddressIPPort(ip, testPort)})
+	due := func() bool {
+		return len(m.Addresses(defaultMaxAddresses, func(*Node) bool { return false })) == 1
+	}
+	if !due() {
+		t.Fatalf("expected a new node to be due right away")
+	}
+
+	m.Attempt(ip)
+	node := m.nodes[ip.String()]
+	if node.ConsecutiveFailures != 1 || node.NextAttempt.Sub(node.LastAttempt) > 2*minRetryBackoff || due() {
+		t.Fatalf("expected the node to be retried after a backoff, got %+v", node)
+	}
+	m.prunePeers()
+	if m.nodes[ip.String()] == nil {
+		t.Fatalf("expected the node to be kept after a single failure")
+	}
+
+	m.Attempt(ip)
+	m.savePeers()
+	m, err = NewManager(dir, testNetParams(), defaultStaleTimeout, defaultPruneExpireTimeout, 3, selector)
+	if err != nil {
+		t.Fatalf("NewManager: %s", err)
+	}
+	node = m.nodes[ip.String()]
+	if node.ConsecutiveFailures != 2 || node.NextAttempt.Sub(node.LastAttempt) < minRetryBackoff {
+		t.Fatalf("expected the retry schedule to be persisted, got %+v", node)
+	}
+
+	// A success resets the failures, and the node is polled again once
+	// it turns stale.
+	m.Good(ip, nil)
+	m.Attempt(ip)
+	if node.ConsecutiveFailures != 0 || node.NextAttempt.Sub(node.LastAttempt) != defaultStaleTimeout {
+		t.Fatalf("expected a success to reset the backoff, got %+v", node)
+	}
+
+	for i := 0; i < 3; i++ {
+		m.Attempt(ip)
+	}
+	m.prunePeers()
+	if m.nodes[ip.String()] != nil {
+		t.Fatalf("expected the node to be removed once it used up its failure budget")
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/kaspanet/dnsseeder/version"
+	"github.com/miekg/dns"
+)
+
+const (
+	// infoLabel and statsLabel are the labels, in front of a zone's
+	// hostname, of the names serving TXT records about the seeder and
+	// about its view of the network.
+	infoLabel  = "_info"
+	statsLabel = "_stats"
+)
+
+// metadataLabel returns the label of the metadata name domainName is, and
+// false if it is not one.
+func (z *dnsZone) metadataLabel(domainName string) (string, bool) {
+	label := strings.TrimSuffix(domainName, "."+z.hostname)
+	if label == domainName || (label != infoLabel && label != statsLabel) {
+		return "", false
+	}
+	return label, true
+}
+
+// metadata returns the key=value pairs served on the metadata name with the
+// given label.
+func (d *DNSServer) metadata(zone *dnsZone, label string, now time.Time) []string {
+	if label == infoLabel {
+		return []string{
+			"version=" + version.Version(),
+			"network=" + zone.amgr.netParams.Name,
+		}
+	}
+
+	pools := zone.amgr.AnswerPools()
+	lastCrawlRound := "never"
+	if t := zone.amgr.LastCrawlRound(); !t.IsZero() {
+		lastCrawlRound = t.UTC().Format(time.RFC3339)
+	}
+	return []string{
+		fmt.Sprintf("nodes=%d", pools.nodeCount),
+		fmt.Sprintf("good=%d", pools.goodCount),
+		"lastcrawl=" + lastCrawlRound,
+		fmt.Sprintf("uptime=%d", int64(now.Sub(d.startTime).Seconds())),
+	}
+}
+
+// buildMetadataResponse answers a query for one of the metadata names with
+// a TXT record per key=value pair.
+func (d *DNSServer) buildMetadataResponse(addr net.Addr, zone *dnsZone, dnsMsg *dns.Msg, label string,
+	policy answerPolicy, isTCP bool) ([]byte, error) {
+
+	respMsg := newDNSResponse(dnsMsg, dns.RcodeSuccess)
+
+	if policy == answerTXT {
+		for _, pair := range d.metadata(zone, label, time.Now()) {
+			respMsg.Answer = append(respMsg.Answer, &dns.TXT{
+				Hdr: dns.RR_Header{Name: dnsMsg.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: d.answerTTL},
+				Txt: []string{pair},
+			})
+		}
+		respMsg.Ns = append(respMsg.Ns, zone.authority)
+	} else {
+		respMsg.Ns = append(respMsg.Ns, zone.negativeSOA())
+	}
+
+	return d.finishResponse(addr, zone, dnsMsg, respMsg, []uint16{dns.TypeTXT}, isTCP)
+}
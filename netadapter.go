@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/kaspanet/kaspad/app/appmessage"
+	"github.com/kaspanet/kaspad/infrastructure/config"
+	"github.com/kaspanet/kaspad/infrastructure/network/netadapter/id"
+	"github.com/kaspanet/kaspad/infrastructure/network/netadapter/router"
+	"github.com/kaspanet/kaspad/infrastructure/network/netadapter/server/grpcserver/protowire"
+	"github.com/kaspanet/kaspad/util/mstime"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/encoding/gzip"
+	"google.golang.org/grpc/status"
+)
+
+// crawlerUserAgent is the user agent the crawler introduces itself with.
+const crawlerUserAgent = "/kaspa-dnsseeder/"
+
+// crawlerServices are the services the crawler advertises. It serves
+// neither blocks nor transactions, so it advertises none.
+const crawlerServices appmessage.ServiceFlag = 0
+
+// p2pMaxMessageSize is the largest P2P message sent or received, as in
+// kaspad.
+const p2pMaxMessageSize = 1024 * 1024 * 1024
+
+// crawlerNetAdapter connects to peers the way kaspad's standalone
+// MinimalNetAdapter does, but keeps the version message each peer sent
+// during the handshake, so that its metadata can be recorded. Unlike
+// MinimalNetAdapter, it may connect to several peers at once, and it opens
+// the connections itself through dialer, so that they may go through a
+// proxy.
+type crawlerNetAdapter struct {
+	cfg    *config.Config
+	dialer *peerDialer
+	id     *id.ID
+}
+
+// peerRoutes are the routes of a connection to a peer
+type peerRoutes struct {
+	router    *router.Router
+	outgoing  *router.Route
+	handshake *router.Route
+	addresses *router.Route
+	ping      *router.Route
+	other     *router.Route
+}
+
+// peerConnection is a connection to a peer that completed the handshake
+type peerConnection struct {
+	routes *peerRoutes
+
+	clientConnection *grpc.ClientConn
+	stream           protowire.P2P_MessageStreamClient
+	cancel           context.CancelFunc
+	disconnectOnce   sync.Once
+
+	// version is the version message the peer sent.
+	version *appmessage.MsgVersion
+
+	// connectLatency and handshakeLatency are the times it took to
+	// connect to the peer and to complete the handshake.
+	connectLatency   time.Duration
+	handshakeLatency time.Duration
+}
+
+// newCrawlerNetAdapter returns a net adapter for the network of cfg, which
+// connects to peers through dialer
+func newCrawlerNetAdapter(cfg *config.Config, dialer *peerDialer) (*crawlerNetAdapter, error) {
+	adapterID, err := id.GenerateID()
+	if err != nil {
+		return nil, errors.Wrap(err, "error generating the net adapter ID")
+	}
+	return &crawlerNetAdapter{
+		cfg:    cfg,
+		dialer: dialer,
+		id:     adapterID,
+	}, nil
+}
+
+// Connect connects to the peer at address and completes the handshake
+// before deadline.
+func (a *crawlerNetAdapter) Connect(address string, deadline time.Time) (*peerConnection, error) {
+	start := time.Now()
+	dialCtx, cancelDial := context.WithDeadline(context.Background(), deadline)
+	defer cancelDial()
+	clientConnection, err := grpc.DialContext(dialCtx, address,
+		grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithBlock(),
+		grpc.WithContextDialer(a.dialer.DialContext))
+	if err != nil {
+		return nil, errors.Wrapf(err, "error connecting to %s", address)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stream, err := protowire.NewP2PClient(clientConnection).MessageStream(ctx, grpc.UseCompressor(gzip.Name),
+		grpc.MaxCallRecvMsgSize(p2pMaxMessageSize), grpc.MaxCallSendMsgSize(p2pMaxMessageSize))
+	if err != nil {
+		cancel()
+		clientConnection.Close()
+		return nil, errors.Wrapf(err, "error getting the message stream of %s", address)
+	}
+
+	c := &peerConnection{
+		routes:           newPeerRoutes(address),
+		clientConnection: clientConnection,
+		stream:           stream,
+		cancel:           cancel,
+	}
+	spawn("crawlerNetAdapter-sendLoop", func() {
+		err := c.sendLoop()
+		if err != nil {
+			log.Debugf("Sending to %s failed: %v", address, err)
+		}
+		c.Disconnect()
+	})
+	spawn("crawlerNetAdapter-receiveLoop", func() {
+		err := c.receiveLoop()
+		if err != nil {
+			log.Debugf("Receiving from %s failed: %v", address, err)
+		}
+		c.Disconnect()
+	})
+
+	connected := time.Now()
+	c.version, err = a.handshake(c.routes, deadline)
+	if err != nil {
+		c.Disconnect()
+		return nil, errors.Wrap(err, "error in handshake")
+	}
+	c.connectLatency = connected.Sub(start)
+	c.handshakeLatency = time.Since(connected)
+
+	spawn("crawlerNetAdapter-handlePingPong", func() {
+		err := handlePingPong(c.routes)
+		if err != nil {
+			log.Debugf("Ping-pong with %s failed: %v", address, err)
+		}
+	})
+
+	return c, nil
+}
+
+// handshake exchanges version and verack messages with the peer, and answers
+// the address request peers send right after. It returns the peer's version
+// message.
+func (a *crawlerNetAdapter) handshake(routes *peerRoutes, deadline time.Time) (*appmessage.MsgVersion, error) {
+	msg, err := routes.handshake.DequeueWithTimeout(time.Until(deadline))
+	if err != nil {
+		return nil, err
+	}
+	version, ok := msg.(*appmessage.MsgVersion)
+	if !ok {
+		return nil, errors.Errorf("expected first message to be of type %s, but got %s",
+			appmessage.CmdVersion, msg.Command())
+	}
+	err = routes.outgoing.Enqueue(&appmessage.MsgVersion{
+		ProtocolVersion: version.ProtocolVersion,
+		Network:         a.cfg.ActiveNetParams.Name,
+		Services:        crawlerServices,
+		Timestamp:       mstime.Now(),
+		ID:              a.id,
+		UserAgent:       crawlerUserAgent,
+		DisableRelayTx:  true,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err = routes.handshake.DequeueWithTimeout(time.Until(deadline))
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := msg.(*appmessage.MsgVerAck); !ok {
+		return nil, errors.Errorf("expected second message to be of type %s, but got %s",
+			appmessage.CmdVerAck, msg.Command())
+	}
+	err = routes.outgoing.Enqueue(&appmessage.MsgVerAck{})
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err = routes.addresses.DequeueWithTimeout(time.Until(deadline))
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := msg.(*appmessage.MsgRequestAddresses); !ok {
+		return nil, errors.Errorf("expected third message to be of type %s, but got %s",
+			appmessage.CmdRequestAddresses, msg.Command())
+	}
+	err = routes.outgoing.Enqueue(&appmessage.MsgAddresses{AddressList: []*appmessage.NetAddress{}})
+	if err != nil {
+		return nil, err
+	}
+
+	return version, nil
+}
+
+// handlePingPong answers the peer's pings, so that it does not disconnect
+// while it is being polled.
+func handlePingPong(routes *peerRoutes) error {
+	for {
+		message, err := routes.ping.Dequeue()
+		if err != nil {
+			if errors.Is(err, router.ErrRouteClosed) {
+				return nil
+			}
+			return err
+		}
+		err = routes.outgoing.Enqueue(&appmessage.MsgPong{Nonce: message.(*appmessage.MsgPing).Nonce})
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// requestAddresses asks the peer for the addresses it knows and waits for
+// them until deadline.
+func (c *peerConnection) requestAddresses(deadline time.Time) ([]*appmessage.NetAddress, error) {
+	err := c.routes.outgoing.Enqueue(appmessage.NewMsgRequestAddresses(true, nil))
+	if err != nil {
+		return nil, err
+	}
+	for {
+		message, err := c.routes.addresses.DequeueWithTimeout(time.Until(deadline))
+		if err != nil {
+			return nil, err
+		}
+		if msgAddresses, ok := message.(*appmessage.MsgAddresses); ok {
+			return msgAddresses.AddressList, nil
+		}
+	}
+}
+
+// Disconnect closes the connection to the peer
+func (c *peerConnection) Disconnect() {
+	c.disconnectOnce.Do(func() {
+		c.routes.router.Close()
+		c.cancel()
+		c.clientConnection.Close()
+	})
+}
+
+// sendLoop sends the messages of the outgoing route to the peer until the
+// connection is closed
+func (c *peerConnection) sendLoop() error {
+	for {
+		message, err := c.routes.outgoing.Dequeue()
+		if err != nil {
+			if errors.Is(err, router.ErrRouteClosed) {
+				return nil
+			}
+			return err
+		}
+		messageProto, err := protowire.FromAppMessage(message)
+		if err != nil {
+			return err
+		}
+		err = c.stream.Send(messageProto)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// receiveLoop routes the messages received from the peer until the
+// connection is closed
+func (c *peerConnection) receiveLoop() error {
+	for {
+		messageProto, err := c.stream.Recv()
+		if err != nil {
+			if err == io.EOF || status.Code(err) == codes.Canceled {
+				return nil
+			}
+			return err
+		}
+		message, err := messageProto.ToAppMessage()
+		if err != nil {
+			return err
+		}
+		err = c.routes.router.EnqueueIncomingMessage(message)
+		if err != nil {
+			if errors.Is(err, router.ErrRouteClosed) {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// newPeerRoutes splits the messages of a new connection to the peer at
+// address into routes, and queues the ready message kaspad expects first.
+func newPeerRoutes(address string) *peerRoutes {
+	peerRouter := router.NewRouter(address)
+	routes := &peerRoutes{router: peerRouter, outgoing: peerRouter.OutgoingRoute()}
+	for _, route := range []struct {
+		route    **router.Route
+		name     string
+		commands []appmessage.MessageCommand
+	}{
+		{&routes.handshake, "handshake", []appmessage.MessageCommand{appmessage.CmdVersion, appmessage.CmdVerAck}},
+		{&routes.addresses, "addresses", []appmessage.MessageCommand{appmessage.CmdRequestAddresses, appmessage.CmdAddresses}},
+		{&routes.ping, "ping", []appmessage.MessageCommand{appmessage.CmdPing}},
+		{&routes.other, "other", otherPeerCommands},
+	} {
+		var err error
+		*route.route, err = peerRouter.AddIncomingRoute(route.name, route.commands)
+		if err != nil {
+			panic(errors.Wrapf(err, "error registering the %s route", route.name))
+		}
+	}
+
+	err := peerRouter.OutgoingRoute().Enqueue(appmessage.NewMsgReady())
+	if err != nil {
+		panic(errors.Wrap(err, "error sending the ready message"))
+	}
+	return routes
+}
+
+// otherPeerCommands are the commands of the messages that have no route of
+// their own
+var otherPeerCommands = func() []appmessage.MessageCommand {
+	builtInCommands := map[appmessage.MessageCommand]bool{
+		appmessage.CmdVersion:          true,
+		appmessage.CmdVerAck:           true,
+		appmessage.CmdRequestAddresses: true,
+		appmessage.CmdAddresses:        true,
+		appmessage.CmdPing:             true,
+	}
+	var commands []appmessage.MessageCommand
+	for command := range appmessage.ProtocolMessageCommandToString {
+		if !builtInCommands[command] {
+			commands = append(commands, command)
+		}
+	}
+	return commands
+}()
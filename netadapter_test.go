@@ -0,0 +1,196 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kaspanet/kaspad/app/appmessage"
+	"github.com/kaspanet/kaspad/infrastructure/config"
+	"github.com/kaspanet/kaspad/infrastructure/network/netadapter/id"
+	"github.com/kaspanet/kaspad/infrastructure/network/netadapter/server/grpcserver/protowire"
+	"github.com/kaspanet/kaspad/util/mstime"
+	"google.golang.org/grpc"
+)
+
+var testCrawlerConfig = &config.Config{Flags: &config.Flags{
+	NetworkFlags: config.NetworkFlags{ActiveNetParams: testNetParams()},
+}}
+
+// testPeer is a kaspad P2P server that completes the handshake, answers
+// address requests with addresses and records the messages it receives. If
+// skipVersion is set, it starts the handshake with a verack instead of its
+// version message.
+type testPeer struct {
+	protowire.UnimplementedP2PServer
+	addresses   []*appmessage.NetAddress
+	skipVersion bool
+
+	mtx      sync.Mutex
+	received []appmessage.Message
+}
+
+func (p *testPeer) MessageStream(stream protowire.P2P_MessageStreamServer) error {
+	send := func(message appmessage.Message) error {
+		messageProto, err := protowire.FromAppMessage(message)
+		if err != nil {
+			return err
+		}
+		return stream.Send(messageProto)
+	}
+	receive := func(command appmessage.MessageCommand) error {
+		for {
+			messageProto, err := stream.Recv()
+			if err != nil {
+				return err
+			}
+			message, err := messageProto.ToAppMessage()
+			if err != nil {
+				return err
+			}
+			p.mtx.Lock()
+			p.received = append(p.received, message)
+			p.mtx.Unlock()
+			if message.Command() == command {
+				return nil
+			}
+		}
+	}
+
+	peerID, err := id.GenerateID()
+	if err != nil {
+		return err
+	}
+	version := appmessage.NewMsgVersion(appmessage.NewNetAddressIPPort(net.IPv4(127, 0, 0, 1), testPort),
+		peerID, testNetParams().Name, nil, 5)
+	version.Timestamp = mstime.Now()
+	version.UserAgent = "/test-peer/"
+	version.Services = 1
+	steps := []func() error{
+		func() error { return send(version) },
+		func() error { return receive(appmessage.CmdVersion) },
+		func() error { return send(&appmessage.MsgVerAck{}) },
+		func() error { return receive(appmessage.CmdVerAck) },
+		func() error { return send(appmessage.NewMsgRequestAddresses(true, nil)) },
+		func() error { return receive(appmessage.CmdAddresses) },
+		func() error { return receive(appmessage.CmdRequestAddresses) },
+		func() error { return send(appmessage.NewMsgAddresses(p.addresses)) },
+	}
+	if p.skipVersion {
+		steps = steps[2:]
+	}
+	for _, step := range steps {
+		err := step()
+		if err != nil {
+			return err
+		}
+	}
+
+	// Keep the connection open until the crawler disconnects.
+	for {
+		_, err := stream.Recv()
+		if err != nil {
+			return nil
+		}
+	}
+}
+
+// receivedMessage returns the first message of type command the peer
+// received
+func (p *testPeer) receivedMessage(command appmessage.MessageCommand) appmessage.Message {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	for _, message := range p.received {
+		if message.Command() == command {
+			return message
+		}
+	}
+	return nil
+}
+
+func startTestPeer(t *testing.T, addresses []*appmessage.NetAddress) (*testPeer, string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %s", err)
+	}
+	peer := &testPeer{addresses: addresses}
+	server := grpc.NewServer()
+	protowire.RegisterP2PServer(server, peer)
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+	return peer, listener.Addr().String()
+}
+
+func TestCrawlerNetAdapterHandshake(t *testing.T) {
+	peer, peerAddress := startTestPeer(t, []*appmessage.NetAddress{
+		appmessage.NewNetAddressIPPort(net.IPv4(192, 0, 2, 1), testPort),
+		appmessage.NewNetAddressIPPort(net.IPv4(192, 0, 2, 2), testPort),
+	})
+	netAdapter, err := newCrawlerNetAdapter(testCrawlerConfig, newPeerDialer("", "", "", "", false, false))
+	if err != nil {
+		t.Fatalf("newCrawlerNetAdapter: %s", err)
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	conn, err := netAdapter.Connect(peerAddress, deadline)
+	if err != nil {
+		t.Fatalf("Connect: %s", err)
+	}
+	defer conn.Disconnect()
+	if conn.version.UserAgent != "/test-peer/" || conn.version.Services != 1 {
+		t.Fatalf("expected the peer's version message, got %+v", conn.version)
+	}
+	addresses, err := conn.requestAddresses(deadline)
+	if err != nil {
+		t.Fatalf("requestAddresses: %s", err)
+	}
+	if len(addresses) != 2 || !addresses[0].IP.Equal(net.IPv4(192, 0, 2, 1)) {
+		t.Fatalf("expected the peer's 2 addresses, got %v", addresses)
+	}
+
+	// The crawler introduces itself with its own services, and answers
+	// the peer's address request with no addresses.
+	version, ok := peer.receivedMessage(appmessage.CmdVersion).(*appmessage.MsgVersion)
+	if !ok {
+		t.Fatalf("expected the peer to receive a version message")
+	}
+	if version.UserAgent != crawlerUserAgent || version.Network != testNetParams().Name ||
+		version.Services != crawlerServices || !version.DisableRelayTx || !version.ID.IsEqual(netAdapter.id) {
+		t.Fatalf("unexpected version message sent by the crawler: %+v", version)
+	}
+	if peer.receivedMessage(appmessage.CmdVerAck) == nil {
+		t.Fatalf("expected the peer to receive a verack message")
+	}
+	reply, ok := peer.receivedMessage(appmessage.CmdAddresses).(*appmessage.MsgAddresses)
+	if !ok || len(reply.AddressList) != 0 {
+		t.Fatalf("expected the peer's address request to be answered with no addresses, got %v", reply)
+	}
+}
+
+func TestCrawlerNetAdapterHandshakeFailure(t *testing.T) {
+	peer, peerAddress := startTestPeer(t, nil)
+	peer.skipVersion = true
+	netAdapter, err := newCrawlerNetAdapter(testCrawlerConfig, newPeerDialer("", "", "", "", false, false))
+	if err != nil {
+		t.Fatalf("newCrawlerNetAdapter: %s", err)
+	}
+	_, err = netAdapter.Connect(peerAddress, time.Now().Add(10*time.Second))
+	if err == nil {
+		t.Fatalf("expected a handshake not starting with a version message to fail")
+	}
+
+	// So does a server that does not implement the message stream.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %s", err)
+	}
+	server := grpc.NewServer()
+	protowire.RegisterP2PServer(server, &protowire.UnimplementedP2PServer{})
+	go server.Serve(listener)
+	defer server.Stop()
+	_, err = netAdapter.Connect(listener.Addr().String(), time.Now().Add(10*time.Second))
+	if err == nil {
+		t.Fatalf("expected the handshake with a server that is not a peer to fail")
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/btcsuite/go-socks/socks"
+	"github.com/pkg/errors"
+)
+
+const (
+	// defaultProxyPort is the port of a SOCKS5 proxy given without one,
+	// Tor's SOCKS port.
+	defaultProxyPort = "9050"
+
+	// onionSuffix is the top-level domain of Tor onion services.
+	onionSuffix = ".onion"
+
+	// torResolveCommand is the SOCKS5 command by which Tor resolves a host
+	// name, a Tor extension of the protocol.
+	torResolveCommand = 0xf0
+
+	// torResolveTimeout bounds the time a lookup through Tor may take.
+	torResolveTimeout = 30 * time.Second
+)
+
+// socksStatusErrors describe the failure codes of SOCKS5 replies
+var socksStatusErrors = map[byte]string{
+	1: "general failure",
+	2: "connection not allowed by ruleset",
+	3: "network unreachable",
+	4: "host unreachable",
+	5: "connection refused",
+	6: "TTL expired",
+	7: "command not supported",
+	8: "address type not supported",
+}
+
+// peerDialer opens the crawler's connections to peers and resolves DNS seed
+// host names, either directly or through SOCKS5 proxies.
+type peerDialer struct {
+	// proxy is the proxy all connections and lookups go through, and
+	// onionProxy the one used for .onion hosts instead. Either is nil if
+	// not set.
+	proxy      *socks.Proxy
+	onionProxy *socks.Proxy
+
+	// noOnion disables .onion hosts, and tells that proxy is not Tor, so
+	// that host names are resolved by the system resolver instead.
+	noOnion bool
+}
+
+// newPeerDialer returns a dialer connecting through the SOCKS5 proxy at
+// proxyAddress, authenticating with proxyUser and proxyPass, and through
+// the one at onionAddress for .onion hosts. An empty address disables a
+// proxy. With torIsolation, each connection authenticates with random
+// credentials, so that Tor opens a separate circuit for it.
+func newPeerDialer(proxyAddress, proxyUser, proxyPass, onionAddress string, noOnion,
+	torIsolation bool) *peerDialer {
+
+	d := &peerDialer{noOnion: noOnion}
+	if proxyAddress != "" {
+		d.proxy = &socks.Proxy{
+			Addr:         proxyAddress,
+			Username:     proxyUser,
+			Password:     proxyPass,
+			TorIsolation: torIsolation,
+		}
+	}
+	if onionAddress != "" {
+		d.onionProxy = &socks.Proxy{Addr: onionAddress, TorIsolation: torIsolation}
+	}
+	return d
+}
+
+// proxyFor returns the proxy connections to host and lookups of it go
+// through, or nil if they are made directly. .onion hosts go through the
+// onion proxy, or the main proxy if that is taken to be Tor, and fail
+// otherwise.
+func (d *peerDialer) proxyFor(host string) (*socks.Proxy, error) {
+	if !strings.HasSuffix(strings.ToLower(strings.TrimSuffix(host, ".")), onionSuffix) {
+		return d.proxy, nil
+	}
+	if d.noOnion {
+		return nil, errors.Errorf("cannot connect to %s: onion hosts are disabled", host)
+	}
+	if d.onionProxy != nil {
+		return d.onionProxy, nil
+	}
+	if d.proxy != nil {
+		return d.proxy, nil
+	}
+	return nil, errors.Errorf("cannot connect to %s: no proxy for onion hosts is set", host)
+}
+
+// DialContext opens a TCP connection to address, which is a host:port pair.
+// Connections through a proxy are given up on when ctx is done.
+func (d *peerDialer) DialContext(ctx context.Context, address string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	proxy, err := d.proxyFor(host)
+	if err != nil {
+		return nil, err
+	}
+	if proxy == nil {
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, "tcp", address)
+	}
+
+	// The SOCKS handshake does not watch ctx, so it is left to finish on
+	// its own if ctx is done first.
+	type dialResult struct {
+		conn net.Conn
+		err  error
+	}
+	result := make(chan dialResult, 1)
+	go func() {
+		var timeout time.Duration
+		if deadline, ok := ctx.Deadline(); ok {
+			timeout = time.Until(deadline)
+		}
+		conn, err := proxy.DialTimeout("tcp", address, timeout)
+		result <- dialResult{conn, err}
+	}()
+	select {
+	case r := <-result:
+		if r.err != nil {
+			return nil, errors.Wrapf(r.err, "error connecting to %s through the proxy %s", address, proxy.Addr)
+		}
+		return r.conn, nil
+	case <-ctx.Done():
+		go func() {
+			if r := <-result; r.conn != nil {
+				r.conn.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+// lookupIP resolves host, and is the lookup function of DNS seeds. .onion
+// hosts are resolved through the onion proxy if one was specified, and
+// through the main proxy, treated as Tor, otherwise, unless --noonion was
+// specified in which case the lookup fails. Other hosts are resolved
+// through Tor if a proxy was specified, unless --noonion was also
+// specified in which case the system resolver is used.
+func (d *peerDialer) lookupIP(host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	proxy, err := d.proxyFor(host)
+	if err != nil {
+		return nil, err
+	}
+	if proxy == nil || (proxy == d.proxy && d.noOnion) {
+		return net.LookupIP(host)
+	}
+	return torLookupIP(proxy, host)
+}
+
+// torLookupIP resolves host through the Tor SOCKS5 proxy, using Tor's
+// RESOLVE extension. Tor returns a single address.
+func torLookupIP(proxy *socks.Proxy, host string) ([]net.IP, error) {
+	if len(host) > 255 {
+		return nil, errors.Errorf("host name %s is too long", host)
+	}
+	conn, err := net.DialTimeout("tcp", proxy.Addr, torResolveTimeout)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error connecting to the proxy %s", proxy.Addr)
+	}
+	defer conn.Close()
+	err = conn.SetDeadline(time.Now().Add(torResolveTimeout))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	user, pass := proxy.Username, proxy.Password
+	if proxy.TorIsolation {
+		var b [16]byte
+		_, err := io.ReadFull(rand.Reader, b[:])
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		user, pass = hex.EncodeToString(b[:8]), hex.EncodeToString(b[8:])
+	}
+	err = socksAuthenticate(conn, user, pass)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error authenticating with the proxy %s", proxy.Addr)
+	}
+
+	request := append([]byte{5, torResolveCommand, 0, 3, byte(len(host))}, host...)
+	request = append(request, 0, 0)
+	_, err = conn.Write(request)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	var reply [4]byte
+	_, err = io.ReadFull(conn, reply[:])
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if reply[0] != 5 {
+		return nil, errors.Errorf("invalid SOCKS version %d in the reply of the proxy %s", reply[0], proxy.Addr)
+	}
+	if reply[1] != 0 {
+		message, ok := socksStatusErrors[reply[1]]
+		if !ok {
+			message = "unknown error"
+		}
+		return nil, errors.Errorf("error resolving %s through the proxy %s: %s", host, proxy.Addr, message)
+	}
+
+	var ip net.IP
+	switch reply[3] {
+	case 1:
+		ip = make(net.IP, net.IPv4len)
+	case 4:
+		ip = make(net.IP, net.IPv6len)
+	default:
+		return nil, errors.Errorf("unexpected address type %d in the reply of the proxy %s", reply[3], proxy.Addr)
+	}
+	_, err = io.ReadFull(conn, ip)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return []net.IP{ip}, nil
+}
+
+// socksAuthenticate negotiates the authentication method with the SOCKS5
+// proxy conn is connected to, and authenticates with user and pass if they
+// are not empty.
+func socksAuthenticate(conn net.Conn, user, pass string) error {
+	greeting := []byte{5, 1, 0}
+	if user != "" {
+		if len(user) > 255 || len(pass) > 255 {
+			return errors.New("the proxy user name and password must not be longer than 255 bytes")
+		}
+		greeting = []byte{5, 2, 0, 2}
+	}
+	_, err := conn.Write(greeting)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	var choice [2]byte
+	_, err = io.ReadFull(conn, choice[:])
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if choice[0] != 5 {
+		return errors.Errorf("invalid SOCKS version %d", choice[0])
+	}
+	switch {
+	case choice[1] == 0:
+		return nil
+	case choice[1] == 2 && user != "":
+	default:
+		return errors.New("no acceptable authentication method")
+	}
+
+	request := append([]byte{1, byte(len(user))}, user...)
+	request = append(request, byte(len(pass)))
+	request = append(request, pass...)
+	_, err = conn.Write(request)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	var status [2]byte
+	_, err = io.ReadFull(conn, status[:])
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if status[1] != 0 {
+		return errors.New("authentication failed")
+	}
+	return nil
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kaspanet/kaspad/app/appmessage"
+)
+
+// testSOCKSProxy is a SOCKS5 proxy supporting CONNECT and Tor's RESOLVE
+// extension, which resolves names from hosts
+type testSOCKSProxy struct {
+	listener net.Listener
+	hosts    map[string]net.IP
+
+	mtx       sync.Mutex
+	users     []string
+	connected []string
+	resolved  []string
+}
+
+func startTestSOCKSProxy(t *testing.T, hosts map[string]net.IP) *testSOCKSProxy {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %s", err)
+	}
+	p := &testSOCKSProxy{listener: listener, hosts: hosts}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go p.serve(conn)
+		}
+	}()
+	return p
+}
+
+func (p *testSOCKSProxy) serve(conn net.Conn) {
+	defer conn.Close()
+	buf := make([]byte, 512)
+
+	// Greeting, preferring user name and password authentication
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return
+	}
+	methods := buf[2 : 2+buf[1]]
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return
+	}
+	method := byte(0)
+	for _, m := range methods {
+		if m == 2 {
+			method = 2
+		}
+	}
+	conn.Write([]byte{5, method})
+	user := ""
+	if method == 2 {
+		if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+			return
+		}
+		userBytes := make([]byte, buf[1])
+		if _, err := io.ReadFull(conn, userBytes); err != nil {
+			return
+		}
+		if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+			return
+		}
+		if _, err := io.ReadFull(conn, buf[:buf[0]]); err != nil {
+			return
+		}
+		user = string(userBytes)
+		conn.Write([]byte{1, 0})
+	}
+
+	// Request, with the address given as a domain name
+	if _, err := io.ReadFull(conn, buf[:5]); err != nil || buf[3] != 3 {
+		return
+	}
+	command := buf[1]
+	host := make([]byte, buf[4])
+	if _, err := io.ReadFull(conn, host); err != nil {
+		return
+	}
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return
+	}
+	port := binary.BigEndian.Uint16(buf[:2])
+
+	p.mtx.Lock()
+	p.users = append(p.users, user)
+	p.mtx.Unlock()
+	switch command {
+	case torResolveCommand:
+		p.mtx.Lock()
+		p.resolved = append(p.resolved, string(host))
+		p.mtx.Unlock()
+		ip, ok := p.hosts[string(host)]
+		if !ok {
+			conn.Write([]byte{5, 4, 0, 1, 0, 0, 0, 0, 0, 0})
+			return
+		}
+		conn.Write(append(append([]byte{5, 0, 0, 1}, ip.To4()...), 0, 0))
+
+	case 1:
+		address := net.JoinHostPort(string(host), strconv.Itoa(int(port)))
+		p.mtx.Lock()
+		p.connected = append(p.connected, address)
+		p.mtx.Unlock()
+		target, err := net.Dial("tcp", address)
+		if err != nil {
+			conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+			return
+		}
+		defer target.Close()
+		conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+		go io.Copy(target, conn)
+		io.Copy(conn, target)
+
+	default:
+		conn.Write([]byte{5, 7, 0, 1, 0, 0, 0, 0, 0, 0})
+	}
+}
+
+func TestPeerDialerLookup(t *testing.T) {
+	proxy := startTestSOCKSProxy(t, map[string]net.IP{
+		"seed.example.org":     net.IPv4(192, 0, 2, 1),
+		"exampleonion.onion":   net.IPv4(192, 0, 2, 2),
+		"other.example.org":    net.IPv4(192, 0, 2, 3),
+		"isolated.example.org": net.IPv4(192, 0, 2, 4),
+	})
+	proxyAddress := proxy.listener.Addr().String()
+
+	tests := []struct {
+		name   string
+		dialer *peerDialer
+		host   string
+		want   net.IP
+	}{
+		{"host through Tor", newPeerDialer(proxyAddress, "", "", "", false, false), "seed.example.org",
+			net.IPv4(192, 0, 2, 1)},
+		{"onion host through Tor", newPeerDialer(proxyAddress, "", "", "", false, false), "exampleonion.onion",
+			net.IPv4(192, 0, 2, 2)},
+		{"onion host through the onion proxy", newPeerDialer("", "", "", proxyAddress, false, false),
+			"exampleonion.onion", net.IPv4(192, 0, 2, 2)},
+		{"onion host without a proxy", newPeerDialer("", "", "", "", false, false), "exampleonion.onion", nil},
+		{"onion host with onion disabled", newPeerDialer(proxyAddress, "", "", "", true, false),
+			"exampleonion.onion", nil},
+		{"unknown host", newPeerDialer(proxyAddress, "", "", "", false, false), "unknown.example.org", nil},
+		{"IP address", newPeerDialer(proxyAddress, "", "", "", false, false), "192.0.2.5",
+			net.IPv4(192, 0, 2, 5)},
+	}
+	for _, test := range tests {
+		ips, err := test.dialer.lookupIP(test.host)
+		if test.want == nil {
+			if err == nil {
+				t.Fatalf("%s: expected an error, got %v", test.name, ips)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: lookupIP: %s", test.name, err)
+		}
+		if len(ips) != 1 || !ips[0].Equal(test.want) {
+			t.Fatalf("%s: expected %s, got %v", test.name, test.want, ips)
+		}
+	}
+	if len(proxy.resolved) != 4 {
+		t.Fatalf("expected 4 lookups through the proxy, got %v", proxy.resolved)
+	}
+
+	// Names are not sent to a proxy that is not Tor.
+	proxy.resolved = nil
+	newPeerDialer(proxyAddress, "", "", "", true, false).lookupIP("localhost")
+	if len(proxy.resolved) != 0 {
+		t.Fatalf("expected no lookups through the proxy with onion disabled, got %v", proxy.resolved)
+	}
+
+	// Each lookup gets a circuit of its own with Tor isolation.
+	proxy.users = nil
+	dialer := newPeerDialer(proxyAddress, "user", "pass", "", false, true)
+	for i := 0; i < 2; i++ {
+		_, err := dialer.lookupIP("isolated.example.org")
+		if err != nil {
+			t.Fatalf("lookupIP: %s", err)
+		}
+	}
+	if len(proxy.users) != 2 || proxy.users[0] == "" || proxy.users[0] == proxy.users[1] {
+		t.Fatalf("expected two different random user names, got %v", proxy.users)
+	}
+}
+
+func TestCrawlerThroughProxy(t *testing.T) {
+	proxy := startTestSOCKSProxy(t, nil)
+	_, peerAddress := startTestPeer(t, []*appmessage.NetAddress{
+		appmessage.NewNetAddressIPPort(net.IPv4(192, 0, 2, 1), testPort),
+		appmessage.NewNetAddressIPPort(net.IPv4(192, 0, 2, 2), testPort),
+	})
+
+	dialer := newPeerDialer(proxy.listener.Addr().String(), "", "", "", false, true)
+	netAdapter, err := newCrawlerNetAdapter(testCrawlerConfig, dialer)
+	if err != nil {
+		t.Fatalf("newCrawlerNetAdapter: %s", err)
+	}
+	for i := 0; i < 2; i++ {
+		deadline := time.Now().Add(10 * time.Second)
+		conn, err := netAdapter.Connect(peerAddress, deadline)
+		if err != nil {
+			t.Fatalf("Connect: %s", err)
+		}
+		if conn.version.UserAgent != "/test-peer/" {
+			t.Fatalf("expected the peer's version message, got %+v", conn.version)
+		}
+		addresses, err := conn.requestAddresses(deadline)
+		conn.Disconnect()
+		if err != nil {
+			t.Fatalf("requestAddresses: %s", err)
+		}
+		if len(addresses) != 2 {
+			t.Fatalf("expected the peer's 2 addresses, got %d", len(addresses))
+		}
+	}
+
+	if len(proxy.connected) != 2 || proxy.connected[0] != peerAddress {
+		t.Fatalf("expected both connections to go through the proxy, got %v", proxy.connected)
+	}
+	if proxy.users[0] == "" || proxy.users[0] == proxy.users[1] {
+		t.Fatalf("expected the connections to be isolated, got user names %v", proxy.users)
+	}
+
+	// Connections fail rather than bypass a proxy that cannot be reached.
+	dialer = newPeerDialer("127.0.0.1:1", "", "", "", false, false)
+	netAdapter, err = newCrawlerNetAdapter(testCrawlerConfig, dialer)
+	if err != nil {
+		t.Fatalf("newCrawlerNetAdapter: %s", err)
+	}
+	_, err = netAdapter.Connect(peerAddress, time.Now().Add(time.Second))
+	if err == nil {
+		t.Fatalf("expected the connection to fail without the proxy")
+	}
+}
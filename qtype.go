@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// answerPolicy describes how queries of a type are answered at the names
+// that exist in a zone. Names that do not exist are answered with NXDOMAIN
+// whatever the type.
+type answerPolicy int
+
+const (
+	// answerNoData answers with NODATA: the name exists but has no
+	// records of the type.
+	answerNoData answerPolicy = iota
+
+	// answerAddresses answers with peer addresses at the apex, the
+	// filter names and the peer target names.
+	answerAddresses
+
+	// answerSRV answers with SRV records at the SRV names.
+	answerSRV
+
+	// answerNS, answerSOA and answerDNSKEY answer at the apex only, and
+	// answerDNSKEY only if the zone is signed.
+	answerNS
+	answerSOA
+	answerDNSKEY
+
+	// answerTXT answers with the seeder metadata at the metadata names.
+	answerTXT
+
+	// answerMinimalANY answers with a single synthesized HINFO record
+	// instead of all the records at the name, as RFC 8482 suggests.
+	answerMinimalANY
+)
+
+// answerPolicies maps query types to how they are answered. Types that are
+// not listed are answered with NODATA. Zone transfers are handled before
+// the policy is consulted.
+var answerPolicies = map[uint16]answerPolicy{
+	dns.TypeA:      answerAddresses,
+	dns.TypeAAAA:   answerAddresses,
+	dns.TypeSRV:    answerSRV,
+	dns.TypeNS:     answerNS,
+	dns.TypeSOA:    answerSOA,
+	dns.TypeDNSKEY: answerDNSKEY,
+	dns.TypeTXT:    answerTXT,
+	dns.TypeANY:    answerMinimalANY,
+}
+
+// queryAnswerPolicy returns how queries of qtype are answered
+func queryAnswerPolicy(qtype uint16) answerPolicy {
+	policy, ok := answerPolicies[qtype]
+	if !ok {
+		return answerNoData
+	}
+	return policy
+}
+
+// buildMinimalANYResponse answers an ANY query with the HINFO record of RFC
+// 8482, which tells the client that the seeder does not list all the
+// records at a name.
+func (d *DNSServer) buildMinimalANYResponse(addr net.Addr, zone *dnsZone, dnsMsg *dns.Msg,
+	isTCP bool) ([]byte, error) {
+
+	respMsg := newDNSResponse(dnsMsg, dns.RcodeSuccess)
+	respMsg.Answer = append(respMsg.Answer, &dns.HINFO{
+		Hdr: dns.RR_Header{Name: dnsMsg.Question[0].Name, Rrtype: dns.TypeHINFO, Class: dns.ClassINET,
+			Ttl: zone.authority.Hdr.Ttl},
+		Cpu: "RFC8482",
+		Os:  "",
+	})
+	respMsg.Ns = append(respMsg.Ns, zone.authority)
+
+	return d.finishResponse(addr, zone, dnsMsg, respMsg, nil, isTCP)
+}
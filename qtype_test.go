@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/kaspanet/kaspad/app/appmessage"
+	"github.com/miekg/dns"
+)
+
+func TestAnswerPolicies(t *testing.T) {
+	signed := setupSignedDNSServer(t)
+	unsigned := NewDNSServer(testDNSServerConfig(), []*DNSZoneConfig{{Hostname: testZone, Nameserver: "ns.example.org", Manager: signed.zones[0].amgr}}, nil)
+
+	srvName := srvServiceName + "." + testZone
+	peerTarget := signed.zones[0].peerTarget(appmessage.NewNetAddressIPPort(net.IP{203, 105, 20, 21}, testPort))
+	tests := []struct {
+		name   string
+		qtype  uint16
+		signed bool
+		rcode  int
+		answer uint16 // the type of the answer records, or zero for NODATA
+	}{
+		{testZone, dns.TypeA, false, dns.RcodeSuccess, dns.TypeA},
+		{testZone, dns.TypeAAAA, false, dns.RcodeSuccess, 0},
+		{testZone, dns.TypeNS, false, dns.RcodeSuccess, dns.TypeNS},
+		{testZone, dns.TypeSOA, false, dns.RcodeSuccess, dns.TypeSOA},
+		{testZone, dns.TypeANY, false, dns.RcodeSuccess, dns.TypeHINFO},
+		{testZone, dns.TypeDNSKEY, false, dns.RcodeSuccess, 0},
+		{testZone, dns.TypeDNSKEY, true, dns.RcodeSuccess, dns.TypeDNSKEY},
+		{testZone, dns.TypeTXT, false, dns.RcodeSuccess, 0},
+		{testZone, dns.TypeSRV, false, dns.RcodeSuccess, 0},
+		{testZone, dns.TypeMX, false, dns.RcodeSuccess, 0},
+		{testZone, dns.TypeCAA, false, dns.RcodeSuccess, 0},
+		{testZone, dns.TypeHINFO, false, dns.RcodeSuccess, 0},
+		{testZone, dns.TypeRRSIG, true, dns.RcodeSuccess, 0},
+		{srvName, dns.TypeSRV, false, dns.RcodeSuccess, dns.TypeSRV},
+		{srvName, dns.TypeA, false, dns.RcodeSuccess, 0},
+		{srvName, dns.TypeANY, false, dns.RcodeSuccess, dns.TypeHINFO},
+		{"_info." + testZone, dns.TypeTXT, false, dns.RcodeSuccess, dns.TypeTXT},
+		{"_info." + testZone, dns.TypeANY, false, dns.RcodeSuccess, dns.TypeHINFO},
+		{"_info." + testZone, dns.TypeSOA, false, dns.RcodeSuccess, 0},
+		{peerTarget, dns.TypeA, false, dns.RcodeSuccess, dns.TypeA},
+		{peerTarget, dns.TypeAAAA, false, dns.RcodeSuccess, 0},
+		{peerTarget, dns.TypeANY, false, dns.RcodeSuccess, dns.TypeHINFO},
+		{"v1." + testZone, dns.TypeNS, false, dns.RcodeSuccess, 0},
+		{"v1." + testZone, dns.TypeANY, false, dns.RcodeSuccess, dns.TypeHINFO},
+		{srvProtocolName + "." + testZone, dns.TypeSRV, false, dns.RcodeSuccess, 0},
+		{srvProtocolName + "." + testZone, dns.TypeA, false, dns.RcodeSuccess, 0},
+		{srvProtocolName + "." + testZone, dns.TypeANY, false, dns.RcodeSuccess, 0},
+		{srvProtocolName + "." + testZone, dns.TypeSRV, true, dns.RcodeSuccess, 0},
+		{srvProtocolName + ".v1." + testZone, dns.TypeSRV, false, dns.RcodeSuccess, 0},
+		{srvProtocolName + ".vx." + testZone, dns.TypeSRV, false, dns.RcodeNameError, 0},
+		{"_udp." + testZone, dns.TypeSRV, false, dns.RcodeNameError, 0},
+		{"_other." + testZone, dns.TypeANY, false, dns.RcodeNameError, 0},
+	}
+	for _, test := range tests {
+		d := unsigned
+		if test.signed {
+			d = signed
+		}
+		resp := queryDNSServer(t, d, test.name, test.qtype)
+		if resp.Rcode != test.rcode {
+			t.Fatalf("%s %s: expected rcode %s, got:\n%s", test.name, dns.TypeToString[test.qtype],
+				dns.RcodeToString[test.rcode], resp)
+		}
+		if test.answer == 0 {
+			if len(resp.Answer) != 0 || (test.rcode == dns.RcodeSuccess &&
+				(len(resp.Ns) != 1 || resp.Ns[0].Header().Rrtype != dns.TypeSOA)) {
+				t.Fatalf("%s %s: expected NODATA, got:\n%s", test.name, dns.TypeToString[test.qtype], resp)
+			}
+			continue
+		}
+		if len(resp.Answer) == 0 {
+			t.Fatalf("%s %s: expected an answer, got:\n%s", test.name, dns.TypeToString[test.qtype], resp)
+		}
+		for _, rr := range resp.Answer {
+			if rr.Header().Rrtype != test.answer {
+				t.Fatalf("%s %s: expected %s records, got:\n%s", test.name, dns.TypeToString[test.qtype],
+					dns.TypeToString[test.answer], resp)
+			}
+		}
+	}
+
+	resp := queryDNSServer(t, unsigned, testZone, dns.TypeANY)
+	if hinfo := resp.Answer[0].(*dns.HINFO); len(resp.Answer) != 1 || hinfo.Cpu != "RFC8482" || hinfo.Os != "" {
+		t.Fatalf("expected the HINFO record of RFC 8482, got:\n%s", resp)
+	}
+}
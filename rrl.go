@@ -0,0 +1,203 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// rrlIPv4PrefixLength and rrlIPv6PrefixLength are the lengths of the
+	// client prefixes that share a response budget.
+	rrlIPv4PrefixLength = 24
+	rrlIPv6PrefixLength = 56
+
+	// rrlCleanupInterval is the interval in which idle buckets are
+	// removed and the limiter's counters are logged.
+	rrlCleanupInterval = time.Minute
+)
+
+// rrlAction is the decision of the response rate limiter about a response
+type rrlAction int
+
+const (
+	rrlAllow rrlAction = iota
+	rrlSlip
+	rrlDrop
+)
+
+// rrlKey identifies the budget a response is charged to. Clients that sent
+// a valid server cookie are charged by address rather than by prefix.
+type rrlKey struct {
+	prefix   [net.IPv6len]byte
+	negative bool
+	cookie   bool
+}
+
+// tokenBucket holds the remaining response budget of a client prefix
+type tokenBucket struct {
+	tokens  float64
+	last    time.Time
+	limited uint64
+}
+
+// responseRateLimiter implements response rate limiting (RRL) to keep the
+// seeder from being used as a DNS amplification reflector. Responses to
+// each client prefix are limited by token buckets, with separate budgets
+// for positive and negative answers. Of the responses over budget, every
+// slip-th one is sent as a minimal truncated response, so legitimate
+// clients can retry over TCP, and the rest are dropped. Clients that sent a
+// valid server cookie have proven their address, so they are given a laxer
+// budget of their own instead.
+type responseRateLimiter struct {
+	rate         float64
+	negativeRate float64
+	cookieRate   float64
+	slip         uint64
+
+	mtx         sync.Mutex
+	buckets     map[rrlKey]*tokenBucket
+	lastCleanup time.Time
+
+	dropped       uint64
+	slipped       uint64
+	loggedDropped uint64
+	loggedSlipped uint64
+}
+
+// newResponseRateLimiter returns a response rate limiter allowing rate
+// positive and negativeRate negative responses per second to each client
+// prefix, and cookieRate responses per second to each client address with
+// a valid server cookie. A zero slip drops all responses over budget.
+func newResponseRateLimiter(rate, negativeRate, cookieRate float64, slip uint64) *responseRateLimiter {
+	return &responseRateLimiter{
+		rate:         rate,
+		negativeRate: negativeRate,
+		cookieRate:   cookieRate,
+		slip:         slip,
+		buckets:      make(map[rrlKey]*tokenBucket),
+		lastCleanup:  time.Now(),
+	}
+}
+
+// rrlPrefix returns the client prefix ip belongs to
+func rrlPrefix(ip net.IP) [net.IPv6len]byte {
+	var prefix [net.IPv6len]byte
+	if ip4 := ip.To4(); ip4 != nil {
+		copy(prefix[:], ip4.Mask(net.CIDRMask(rrlIPv4PrefixLength, 8*net.IPv4len)))
+	} else {
+		copy(prefix[:], ip.Mask(net.CIDRMask(rrlIPv6PrefixLength, 8*net.IPv6len)))
+	}
+	return prefix
+}
+
+// check charges a response to ip's prefix, or to ip itself if the client
+// sent a valid server cookie, and returns whether it should be sent,
+// slipped or dropped.
+func (r *responseRateLimiter) check(ip net.IP, negative, validCookie bool, now time.Time) rrlAction {
+	rate := r.rate
+	key := rrlKey{prefix: rrlPrefix(ip), negative: negative}
+	switch {
+	case validCookie:
+		rate = r.cookieRate
+		key = rrlKey{cookie: true}
+		copy(key.prefix[:], ip.To16())
+	case negative:
+		rate = r.negativeRate
+	}
+	if rate <= 0 {
+		return rrlAllow
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if now.Sub(r.lastCleanup) > rrlCleanupInterval {
+		r.cleanup(now)
+	}
+
+	bucket, ok := r.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: rate, last: now}
+		r.buckets[key] = bucket
+	}
+	bucket.tokens += now.Sub(bucket.last).Seconds() * rate
+	if bucket.tokens > rate {
+		bucket.tokens = rate
+	}
+	bucket.last = now
+
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return rrlAllow
+	}
+
+	bucket.limited++
+	if r.slip > 0 && bucket.limited%r.slip == 0 {
+		atomic.AddUint64(&r.slipped, 1)
+		return rrlSlip
+	}
+	atomic.AddUint64(&r.dropped, 1)
+	return rrlDrop
+}
+
+// cleanup removes the buckets that have refilled completely, and logs the
+// limiter's counters if they changed. It must be called with mtx held.
+func (r *responseRateLimiter) cleanup(now time.Time) {
+	for key, bucket := range r.buckets {
+		if now.Sub(bucket.last) > time.Second {
+			delete(r.buckets, key)
+		}
+	}
+	r.lastCleanup = now
+
+	dropped, slipped := r.counts()
+	if dropped != r.loggedDropped || slipped != r.loggedSlipped {
+		log.Infof("Response rate limiting: %d responses dropped, %d slipped in total", dropped, slipped)
+		r.loggedDropped, r.loggedSlipped = dropped, slipped
+	}
+}
+
+// counts returns the number of responses dropped and slipped so far
+func (r *responseRateLimiter) counts() (dropped, slipped uint64) {
+	return atomic.LoadUint64(&r.dropped), atomic.LoadUint64(&r.slipped)
+}
+
+// isNegativeResponse returns whether the packed response carries an error
+// code or no answers.
+func isNegativeResponse(response []byte) bool {
+	if len(response) < dnsHeaderSize {
+		return true
+	}
+	rcode := response[3] & 0xF
+	answerCount := uint16(response[6])<<8 | uint16(response[7])
+	return rcode != dns.RcodeSuccess || answerCount == 0
+}
+
+// slipResponse turns the packed response into a minimal one with the TC flag
+// set, so the client retries over TCP. A client that sent a DNS cookie is
+// instead answered with BADCOOKIE, so it can retry over UDP with the fresh
+// server cookie carried by the response.
+func slipResponse(response []byte) ([]byte, error) {
+	respMsg := new(dns.Msg)
+	err := respMsg.Unpack(response)
+	if err != nil {
+		return nil, err
+	}
+	if hasCookie(respMsg) {
+		respMsg.Rcode = dns.RcodeBadCookie
+	} else {
+		respMsg.Truncated = true
+	}
+	respMsg.Answer = nil
+	respMsg.Ns = nil
+	if opt := respMsg.IsEdns0(); opt != nil {
+		respMsg.Extra = []dns.RR{opt}
+	} else {
+		respMsg.Extra = nil
+	}
+	return respMsg.Pack()
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestResponseRateLimiter(t *testing.T) {
+	r := newResponseRateLimiter(5, 2, 20, 2)
+	now := time.Now()
+
+	client := net.IPv4(192, 0, 2, 1)
+	neighbour := net.IPv4(192, 0, 2, 200)
+	for i := 0; i < 5; i++ {
+		if action := r.check(client, false, false, now); action != rrlAllow {
+			t.Fatalf("response %d within budget was not allowed: %d", i, action)
+		}
+	}
+
+	// The neighbour shares the client's /24 and thus its budget. Over
+	// budget, every second response is slipped and the rest are dropped.
+	actions := []rrlAction{
+		r.check(neighbour, false, false, now),
+		r.check(client, false, false, now),
+		r.check(client, false, false, now),
+		r.check(client, false, false, now),
+	}
+	expectedActions := []rrlAction{rrlDrop, rrlSlip, rrlDrop, rrlSlip}
+	for i := range actions {
+		if actions[i] != expectedActions[i] {
+			t.Fatalf("response %d over budget: expected action %d, got %d", i, expectedActions[i], actions[i])
+		}
+	}
+	dropped, slipped := r.counts()
+	if dropped != 2 || slipped != 2 {
+		t.Fatalf("expected 2 dropped and 2 slipped responses, got %d and %d", dropped, slipped)
+	}
+
+	// Negative responses have a separate budget.
+	for i := 0; i < 2; i++ {
+		if action := r.check(client, true, false, now); action != rrlAllow {
+			t.Fatalf("negative response %d within budget was not allowed: %d", i, action)
+		}
+	}
+	if action := r.check(client, true, false, now); action == rrlAllow {
+		t.Fatalf("negative response over budget was allowed")
+	}
+
+	// Other prefixes are not affected, and the budget refills over time.
+	if action := r.check(net.IPv4(192, 0, 3, 1), false, false, now); action != rrlAllow {
+		t.Fatalf("response to another prefix was not allowed: %d", action)
+	}
+	if action := r.check(client, false, false, now.Add(time.Second)); action != rrlAllow {
+		t.Fatalf("response after the budget refilled was not allowed: %d", action)
+	}
+
+	// IPv6 clients are grouped by /56.
+	if rrlPrefix(net.ParseIP("2001:db8:0:1::1")) != rrlPrefix(net.ParseIP("2001:db8:0:ff::2")) {
+		t.Fatalf("addresses in the same /56 have different prefixes")
+	}
+	if rrlPrefix(net.ParseIP("2001:db8:0:1::1")) == rrlPrefix(net.ParseIP("2001:db8:0:100::1")) {
+		t.Fatalf("addresses in different /56 prefixes have the same prefix")
+	}
+}
+
+func TestResponseRateLimiterCookieTier(t *testing.T) {
+	r := newResponseRateLimiter(5, 2, 20, 2)
+	now := time.Now()
+
+	// Exhaust the budget of the client's prefix.
+	client := net.IPv4(192, 0, 2, 1)
+	for i := 0; i < 5; i++ {
+		r.check(client, false, false, now)
+	}
+	if action := r.check(client, false, false, now); action == rrlAllow {
+		t.Fatalf("response over the prefix budget was allowed")
+	}
+
+	// With a valid cookie, the client has a laxer budget of its own, for
+	// positive and negative responses alike.
+	for i := 0; i < 20; i++ {
+		if action := r.check(client, i%2 == 0, true, now); action != rrlAllow {
+			t.Fatalf("cookie response %d within budget was not allowed: %d", i, action)
+		}
+	}
+	if action := r.check(client, false, true, now); action == rrlAllow {
+		t.Fatalf("cookie response over budget was allowed")
+	}
+
+	// A neighbour with a valid cookie does not share it.
+	if action := r.check(net.IPv4(192, 0, 2, 2), false, true, now); action != rrlAllow {
+		t.Fatalf("cookie response to a neighbour was not allowed: %d", action)
+	}
+
+	// A zero cookie rate leaves cookie clients unlimited.
+	r = newResponseRateLimiter(5, 2, 0, 2)
+	for i := 0; i < 100; i++ {
+		if action := r.check(client, false, true, now); action != rrlAllow {
+			t.Fatalf("cookie response %d was not allowed without a cookie rate: %d", i, action)
+		}
+	}
+}
+
+func TestSlipResponse(t *testing.T) {
+	respMsg := new(dns.Msg)
+	respMsg.SetQuestion("seed.example.org.", dns.TypeA)
+	respMsg.Response = true
+	respMsg.Answer = append(respMsg.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: "seed.example.org.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: defaultTTL},
+		A:   net.IPv4(203, 0, 113, 1),
+	})
+	response, err := respMsg.Pack()
+	if err != nil {
+		t.Fatalf("Pack: %s", err)
+	}
+	if isNegativeResponse(response) {
+		t.Fatalf("response with an answer considered negative")
+	}
+
+	slipped, err := slipResponse(response)
+	if err != nil {
+		t.Fatalf("slipResponse: %s", err)
+	}
+	slippedMsg := new(dns.Msg)
+	err = slippedMsg.Unpack(slipped)
+	if err != nil {
+		t.Fatalf("Unpack: %s", err)
+	}
+	if !slippedMsg.Truncated || len(slippedMsg.Answer) != 0 || len(slippedMsg.Question) != 1 {
+		t.Fatalf("expected a truncated response without answers, got:\n%s", slippedMsg)
+	}
+}
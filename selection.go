@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bufio"
+	"math"
+	"math/rand"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// netgroupIPv4PrefixLength and netgroupIPv6PrefixLength are the
+	// lengths of the prefixes that group peers likely to be run by the
+	// same operator.
+	netgroupIPv4PrefixLength = 16
+	netgroupIPv6PrefixLength = 32
+
+	// minSelectionWeight is the weight of a node with no uptime record,
+	// so that newly discovered nodes still get picked.
+	minSelectionWeight = 0.05
+
+	// samplingAttemptsPerAddress bounds the number of weighted draws per
+	// requested address before the remaining addresses are filled by a
+	// scan of the pool.
+	samplingAttemptsPerAddress = 4
+)
+
+// randSource is the source of randomness used for peer selection. Tests
+// inject a seeded *rand.Rand to make the selection deterministic.
+type randSource interface {
+	Float64() float64
+	Intn(n int) int
+}
+
+// globalRand is a randSource backed by the goroutine-safe top-level
+// functions of math/rand.
+type globalRand struct{}
+
+func (globalRand) Float64() float64 { return rand.Float64() }
+func (globalRand) Intn(n int) int   { return rand.Intn(n) }
+
+// peerSelector picks the nodes returned in answers. Nodes are drawn at
+// random, weighted by their rank, with at most netgroupCap nodes from the
+// same IPv4 /16 or IPv6 /32 and, if an ASN table is loaded, at most asnCap
+// nodes from the same autonomous system per answer. A cap of 0 disables it.
+// If a GeoIP database is loaded, answers for clients of a known location are
+// filled with nodes of the same country or continent first, leaving a
+// globalShare of each answer to nodes from anywhere.
+type peerSelector struct {
+	netgroupCap int
+	asnCap      int
+	asns        *asnTable
+	geo         geoLocator
+	globalShare float64
+	rng         randSource
+}
+
+// newPeerSelector returns a new peerSelector. asns and geo may be nil, in
+// which case nodes are not grouped by autonomous system or location.
+func newPeerSelector(netgroupCap, asnCap int, asns *asnTable, geo geoLocator, globalShare float64,
+	rng randSource) *peerSelector {
+
+	return &peerSelector{
+		netgroupCap: netgroupCap,
+		asnCap:      asnCap,
+		asns:        asns,
+		geo:         geo,
+		globalShare: globalShare,
+		rng:         rng,
+	}
+}
+
+// locate returns the location of ip, or nil if it is unknown or no GeoIP
+// database is loaded.
+func (s *peerSelector) locate(ip net.IP) *geoLocation {
+	if s.geo == nil || ip == nil {
+		return nil
+	}
+	location, _ := s.geo.locate(ip)
+	return location
+}
+
+// netgroup returns the key of the netgroup ip belongs to
+func netgroup(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return string(ip4[:netgroupIPv4PrefixLength/8])
+	}
+	return string(ip.To16()[:netgroupIPv6PrefixLength/8])
+}
+
+// selectionWeight returns the weight node is drawn with
+func selectionWeight(node *Node) float64 {
+	return math.Max(node.rank(), minSelectionWeight)
+}
+
+// selection is an answer being assembled by a peerSelector
+type selection struct {
+	selector  *peerSelector
+	filter    *AddressFilter
+	entries   []*poolEntry
+	visited   map[*poolEntry]struct{}
+	netgroups map[string]int
+	asns      map[uint32]int
+}
+
+// consider adds entry to the answer unless it was considered before, does
+// not match the filter or is over a cap. Each of these conditions stays
+// true for the rest of the selection, so every entry only needs to be
+// considered once.
+func (sel *selection) consider(entry *poolEntry) {
+	if _, ok := sel.visited[entry]; ok {
+		return
+	}
+	sel.visited[entry] = struct{}{}
+
+	if !sel.filter.matches(entry.node) {
+		return
+	}
+	if sel.selector.netgroupCap > 0 && sel.netgroups[entry.netgroup] >= sel.selector.netgroupCap {
+		return
+	}
+	if sel.selector.asnCap > 0 && entry.asn != 0 && sel.asns[entry.asn] >= sel.selector.asnCap {
+		return
+	}
+	sel.netgroups[entry.netgroup]++
+	if entry.asn != 0 {
+		sel.asns[entry.asn]++
+	}
+	sel.entries = append(sel.entries, entry)
+}
+
+// draw adds entries of pool to the answer until it holds maxAddresses
+// entries or pool is exhausted.
+func (sel *selection) draw(pool *answerPool, maxAddresses int) {
+	n := len(pool.entries)
+	if n == 0 || len(sel.entries) >= maxAddresses {
+		return
+	}
+
+	totalWeight := pool.cumulativeWeights[n-1]
+	for attempt := 0; attempt < samplingAttemptsPerAddress*(maxAddresses-len(sel.entries)) &&
+		len(sel.entries) < maxAddresses && len(sel.visited) < n; attempt++ {
+
+		i := sort.SearchFloat64s(pool.cumulativeWeights, sel.selector.rng.Float64()*totalWeight)
+		if i < n {
+			sel.consider(pool.entries[i])
+		}
+	}
+
+	// Weighted draws mostly hit entries that were already considered,
+	// which happens when the filter or the caps rule out most of the
+	// pool. Fill the rest of the answer by scanning from a random offset.
+	if len(sel.entries) < maxAddresses {
+		offset := sel.selector.rng.Intn(n)
+		for j := 0; j < n && len(sel.entries) < maxAddresses; j++ {
+			sel.consider(pool.entries[(offset+j)%n])
+		}
+	}
+}
+
+// sample returns up to maxAddresses distinct entries matching filter, drawn
+// without replacement proportionally to their weight while respecting the
+// selector's caps. All but the global share of the answer is drawn from
+// localPools first, nearest region first; the rest is drawn from pool.
+func (s *peerSelector) sample(pool *answerPool, localPools []*answerPool, filter *AddressFilter,
+	maxAddresses int) []*poolEntry {
+
+	n := len(pool.entries)
+	if n == 0 || maxAddresses <= 0 {
+		return nil
+	}
+	if maxAddresses > n {
+		maxAddresses = n
+	}
+
+	sel := &selection{
+		selector:  s,
+		filter:    filter,
+		entries:   make([]*poolEntry, 0, maxAddresses),
+		visited:   make(map[*poolEntry]struct{}, maxAddresses),
+		netgroups: make(map[string]int, maxAddresses),
+		asns:      make(map[uint32]int),
+	}
+	if len(localPools) > 0 {
+		localAddresses := maxAddresses - int(math.Round(s.globalShare*float64(maxAddresses)))
+		for _, localPool := range localPools {
+			sel.draw(localPool, localAddresses)
+		}
+	}
+	sel.draw(pool, maxAddresses)
+	return sel.entries
+}
+
+// asnTable maps IP prefixes to the autonomous systems announcing them
+type asnTable struct {
+	// prefixes maps each prefix length, in bits of the 16-byte IP
+	// representation, to the ASNs of the prefixes of that length.
+	prefixes map[int]map[string]uint32
+	// lengths lists the keys of prefixes, longest first.
+	lengths []int
+}
+
+// loadASNTable reads an ASN table from path. Each line holds a prefix in
+// CIDR notation and the number of the autonomous system announcing it,
+// optionally prefixed with "AS". Empty lines and lines starting with '#'
+// are ignored.
+func loadASNTable(path string) (*asnTable, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer f.Close()
+
+	t := &asnTable{prefixes: make(map[int]map[string]uint32)}
+	count := 0
+	scanner := bufio.NewScanner(f)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, errors.Errorf("%s:%d: expected a prefix and an ASN", path, lineNumber)
+		}
+		_, ipNet, err := net.ParseCIDR(fields[0])
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s:%d", path, lineNumber)
+		}
+		asn, err := strconv.ParseUint(strings.TrimPrefix(strings.ToUpper(fields[1]), "AS"), 10, 32)
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s:%d", path, lineNumber)
+		}
+		t.add(ipNet, uint32(asn))
+		count++
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	log.Infof("Loaded %d ASN prefixes from %s", count, path)
+	return t, nil
+}
+
+// add records that ipNet is announced by asn
+func (t *asnTable) add(ipNet *net.IPNet, asn uint32) {
+	ones, bits := ipNet.Mask.Size()
+	if bits == 8*net.IPv4len {
+		ones += 8 * (net.IPv6len - net.IPv4len)
+	}
+	byLength, ok := t.prefixes[ones]
+	if !ok {
+		byLength = make(map[string]uint32)
+		t.prefixes[ones] = byLength
+		t.lengths = append(t.lengths, ones)
+		sort.Sort(sort.Reverse(sort.IntSlice(t.lengths)))
+	}
+	byLength[string(ipNet.IP.To16().Mask(net.CIDRMask(ones, 8*net.IPv6len)))] = asn
+}
+
+// lookup returns the ASN of the longest prefix containing ip, or 0 if there
+// is none.
+func (t *asnTable) lookup(ip net.IP) uint32 {
+	if t == nil {
+		return 0
+	}
+	ip = ip.To16()
+	if ip == nil {
+		return 0
+	}
+	for _, length := range t.lengths {
+		asn, ok := t.prefixes[length][string(ip.Mask(net.CIDRMask(length, 8*net.IPv6len)))]
+		if ok {
+			return asn
+		}
+	}
+	return 0
+}
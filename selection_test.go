@@ -0,0 +1,160 @@
+package main
+
+import (
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kaspanet/kaspad/app/appmessage"
+	"github.com/miekg/dns"
+)
+
+func addGoodTestNodes(m *Manager, ips ...string) {
+	for _, s := range ips {
+		ip := net.ParseIP(s)
+		m.AddAddresses([]*appmessage.NetAddress{appmessage.NewNetAddressIPPort(ip, testPort)})
+		m.Good(ip, nil)
+	}
+	m.refreshAnswerPools()
+}
+
+func TestPeerSelectorNetgroupCap(t *testing.T) {
+	m := setupAnswerPoolManager(t, 0, newPeerSelector(1, 0, nil, nil, 0, rand.New(rand.NewSource(1))))
+	addGoodTestNodes(m, "1.2.0.1", "1.2.0.2", "1.2.255.3", "1.3.0.1", "5.6.7.8",
+		"2001:db8::1", "2001:db8:ffff::1", "2001:db9::1")
+
+	tests := []struct {
+		qtype uint16
+		want  int
+	}{
+		{dns.TypeA, 3},
+		{dns.TypeAAAA, 2},
+	}
+	for _, test := range tests {
+		for i := 0; i < 100; i++ {
+			entries := m.sampleAnswerPool(test.qtype, &AddressFilter{}, nil, 16)
+			if len(entries) != test.want {
+				t.Fatalf("qtype %d: expected %d entries, got %d", test.qtype, test.want, len(entries))
+			}
+			netgroups := make(map[string]bool)
+			for _, entry := range entries {
+				if netgroups[entry.netgroup] {
+					t.Fatalf("qtype %d: two entries from the netgroup of %s", test.qtype, entry.node.Addr.IP)
+				}
+				netgroups[entry.netgroup] = true
+			}
+		}
+	}
+}
+
+func TestPeerSelectorASNCap(t *testing.T) {
+	asns := &asnTable{prefixes: make(map[int]map[string]uint32)}
+	for _, prefix := range []string{"1.0.0.0/8", "2.0.0.0/8"} {
+		_, ipNet, _ := net.ParseCIDR(prefix)
+		asns.add(ipNet, 64500)
+	}
+	m := setupAnswerPoolManager(t, 0, newPeerSelector(1, 2, asns, nil, 0, rand.New(rand.NewSource(1))))
+	addGoodTestNodes(m, "1.1.0.1", "1.2.0.1", "2.1.0.1", "2.2.0.1", "3.1.0.1", "4.1.0.1")
+
+	entries := m.sampleAnswerPool(dns.TypeA, &AddressFilter{}, nil, 16)
+	if len(entries) != 4 {
+		t.Fatalf("expected 2 entries from AS64500 and 2 from unknown systems, got %d", len(entries))
+	}
+	count := 0
+	for _, entry := range entries {
+		if entry.asn == 64500 {
+			count++
+		}
+	}
+	if count != 2 {
+		t.Fatalf("expected 2 entries from AS64500, got %d", count)
+	}
+}
+
+func TestPeerSelectorWeighting(t *testing.T) {
+	m := setupAnswerPoolManager(t, 0, newPeerSelector(0, 0, nil, nil, 0, rand.New(rand.NewSource(1))))
+	addGoodTestNodes(m, "1.1.0.1", "2.1.0.1")
+	for i, threshold := range uptimeThresholds {
+		m.nodes["1.1.0.1"].Uptime[i] = UptimeStat{Reliability: 1, Count: threshold.count}
+	}
+	m.refreshAnswerPools()
+
+	reliable := 0
+	const draws = 1000
+	for i := 0; i < draws; i++ {
+		entries := m.sampleAnswerPool(dns.TypeA, &AddressFilter{}, nil, 1)
+		if entries[0].node.Addr.IP.Equal(net.ParseIP("1.1.0.1")) {
+			reliable++
+		}
+	}
+	// The reliable node has 20 times the weight of the other one.
+	if reliable < draws*9/10 {
+		t.Fatalf("expected the reliable node to be picked most of the time, got %d of %d", reliable, draws)
+	}
+}
+
+func TestPeerSelectorDeterministic(t *testing.T) {
+	sample := func() []string {
+		m := setupAnswerPoolManager(t, 200, newPeerSelector(1, 0, nil, nil, 0, rand.New(rand.NewSource(42))))
+		var ips []string
+		for i := 0; i < 5; i++ {
+			for _, entry := range m.sampleAnswerPool(dns.TypeA, &AddressFilter{}, nil, 8) {
+				ips = append(ips, entry.node.Addr.IP.String())
+			}
+		}
+		return ips
+	}
+	first, second := sample(), sample()
+	if len(first) != 40 || len(first) != len(second) {
+		t.Fatalf("unexpected sample sizes %d and %d", len(first), len(second))
+	}
+	for i := range first {
+		if first[i] != second[i] {
+			t.Fatalf("samples with the same seed differ at %d: %s != %s", i, first[i], second[i])
+		}
+	}
+}
+
+func TestLoadASNTable(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "asn.txt")
+	data := "# prefix asn\n" +
+		"1.0.0.0/8 64500\n" +
+		"1.2.0.0/16 AS64501\n" +
+		"\n" +
+		"2001:db8::/32 64502\n"
+	err := os.WriteFile(path, []byte(data), 0600)
+	if err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+	asns, err := loadASNTable(path)
+	if err != nil {
+		t.Fatalf("loadASNTable: %s", err)
+	}
+
+	tests := []struct {
+		ip   string
+		want uint32
+	}{
+		{"1.1.1.1", 64500},
+		{"1.2.3.4", 64501},
+		{"2001:db8::1", 64502},
+		{"2001:db9::1", 0},
+		{"3.3.3.3", 0},
+	}
+	for _, test := range tests {
+		if got := asns.lookup(net.ParseIP(test.ip)); got != test.want {
+			t.Errorf("lookup(%s): got %d, want %d", test.ip, got, test.want)
+		}
+	}
+
+	err = os.WriteFile(path, []byte("1.0.0.0/8\n"), 0600)
+	if err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+	_, err = loadASNTable(path)
+	if err == nil {
+		t.Fatalf("expected an error for a line without an ASN")
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// uptimeWindows are the time constants a node's reliability is tracked
+// over, as in the Bitcoin seeder: 2 hours, 8 hours, a day, a week and a
+// month.
+var uptimeWindows = [...]time.Duration{
+	2 * time.Hour,
+	8 * time.Hour,
+	24 * time.Hour,
+	7 * 24 * time.Hour,
+	30 * 24 * time.Hour,
+}
+
+// uptimeThresholds are the reliability a node must exceed over the window
+// of the same index, with more than the given decayed number of attempts,
+// to be handed out. Longer windows need more attempts but tolerate more
+// failures.
+var uptimeThresholds = [len(uptimeWindows)]struct {
+	reliability float64
+	count       float64
+}{
+	{0.85, 2},
+	{0.70, 4},
+	{0.55, 8},
+	{0.45, 16},
+	{0.35, 32},
+}
+
+const (
+	// newNodeMaxAttempts is the number of connection attempts up to which
+	// a node is handed out if at least half of them succeeded, before its
+	// uptime statistics are meaningful.
+	newNodeMaxAttempts = 3
+
+	// latencyHistogramCap is the number of samples at which a latency
+	// histogram is halved, so that it follows the node's recent latency.
+	latencyHistogramCap = 256
+
+	// referenceLatency is the handshake latency up to which a node is
+	// ranked by its uptime alone. Slower nodes are ranked down in
+	// proportion to their median latency.
+	referenceLatency = 250 * time.Millisecond
+)
+
+// UptimeStat is the exponentially decayed record of a node's connection
+// attempts over one of the uptimeWindows
+type UptimeStat struct {
+	// Reliability is the decayed share of successful attempts, Count
+	// the decayed number of attempts, and Weight the share of the window
+	// covered by attempts.
+	Reliability float64
+	Count       float64
+	Weight      float64
+}
+
+// update records an attempt made age after the previous one
+func (s *UptimeStat) update(success bool, age, window time.Duration) {
+	f := math.Exp(-age.Seconds() / window.Seconds())
+	s.Reliability *= f
+	if success {
+		s.Reliability += 1 - f
+	}
+	s.Count = s.Count*f + 1
+	s.Weight = s.Weight*f + 1 - f
+}
+
+// latencyBuckets are the upper bounds of the buckets of a latency
+// histogram. The last bucket holds the samples above the largest bound.
+var latencyBuckets = [...]time.Duration{
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+}
+
+// LatencyHistogram counts a node's latency samples by latencyBuckets
+type LatencyHistogram struct {
+	Counts [len(latencyBuckets) + 1]uint32
+}
+
+// add records a latency sample
+func (h *LatencyHistogram) add(latency time.Duration) {
+	var total uint32
+	for _, count := range h.Counts {
+		total += count
+	}
+	if total >= latencyHistogramCap {
+		for i := range h.Counts {
+			h.Counts[i] /= 2
+		}
+	}
+
+	bucket := len(latencyBuckets)
+	for i, bound := range latencyBuckets {
+		if latency <= bound {
+			bucket = i
+			break
+		}
+	}
+	h.Counts[bucket]++
+}
+
+// median returns the upper bound of the bucket holding the median sample,
+// twice the largest bound for the last bucket, and false if there are no
+// samples.
+func (h *LatencyHistogram) median() (time.Duration, bool) {
+	var total uint32
+	for _, count := range h.Counts {
+		total += count
+	}
+	if total == 0 {
+		return 0, false
+	}
+	var seen uint32
+	for i, count := range h.Counts {
+		seen += count
+		if 2*seen >= total && i < len(latencyBuckets) {
+			return latencyBuckets[i], true
+		}
+	}
+	return 2 * latencyBuckets[len(latencyBuckets)-1], true
+}
+
+// isReliable returns whether node has been up enough to be handed out.
+// Nodes with only a few attempts qualify if at least half of them
+// succeeded, and others if their reliability passes the threshold of any
+// of the uptime windows.
+func (node *Node) isReliable() bool {
+	if node.Attempts <= newNodeMaxAttempts && 2*node.Successes >= node.Attempts {
+		return true
+	}
+	for i, threshold := range uptimeThresholds {
+		if node.Uptime[i].Reliability > threshold.reliability && node.Uptime[i].Count > threshold.count {
+			return true
+		}
+	}
+	return false
+}
+
+// rank returns node's rank among the good nodes, between 0 and 1. It is the
+// node's average reliability over the uptime windows, where each window
+// counts in proportion to how many of the attempts its threshold requires
+// were made, so that a node that answered once ranks below one that has
+// been up for long. Nodes with a median handshake latency above
+// referenceLatency are ranked down.
+func (node *Node) rank() float64 {
+	var rank float64
+	for i, threshold := range uptimeThresholds {
+		rank += node.Uptime[i].Reliability * math.Min(1, node.Uptime[i].Count/threshold.count)
+	}
+	rank /= float64(len(uptimeThresholds))
+
+	if latency, ok := node.HandshakeLatency.median(); ok && latency > referenceLatency {
+		rank *= float64(referenceLatency) / float64(latency)
+	}
+	return rank
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"math"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// simulateAttempts records the outcomes of polls made every interval on
+// node, of which the ones success returns true for succeeded. As in
+// Manager.Attempt, each outcome is recorded by the attempt after it, and the
+// first attempt of a node has none.
+func simulateAttempts(node *Node, attempts int, interval time.Duration, success func(i int) bool) {
+	if node.Attempts == 0 {
+		for w, window := range uptimeWindows {
+			node.Uptime[w].update(false, math.MaxInt64, window)
+		}
+		node.Attempts++
+	}
+	for i := 0; i < attempts; i++ {
+		for w, window := range uptimeWindows {
+			node.Uptime[w].update(success(i), interval, window)
+		}
+		node.Attempts++
+		if success(i) {
+			node.Successes++
+		}
+	}
+}
+
+func TestNodeUptime(t *testing.T) {
+	always := func(int) bool { return true }
+	tests := []struct {
+		name     string
+		attempts int
+		interval time.Duration
+		success  func(i int) bool
+		reliable bool
+	}{
+		{"new node", 1, time.Hour, always, true},
+		{"new node that never answered", 2, time.Hour, func(int) bool { return false }, false},
+		{"flapping node", 48, 30 * time.Minute, func(i int) bool { return i%3 == 0 }, false},
+		{"failing node", 10, time.Hour, func(i int) bool { return i < 5 }, false},
+		{"long-lived node", 500, time.Hour, always, true},
+		{"long-lived node with outages", 500, time.Hour, func(i int) bool { return i%5 != 0 }, true},
+	}
+	for _, test := range tests {
+		node := &Node{}
+		simulateAttempts(node, test.attempts, test.interval, test.success)
+		if node.isReliable() != test.reliable {
+			t.Fatalf("%s: expected reliable=%t, got uptime %+v", test.name, test.reliable, node.Uptime)
+		}
+	}
+
+	once, longLived := &Node{}, &Node{}
+	simulateAttempts(once, 1, time.Hour, always)
+	simulateAttempts(longLived, 1000, time.Hour, always)
+	if once.rank() >= longLived.rank()/2 || longLived.rank() < 0.9 {
+		t.Fatalf("expected a node that answered once to rank well below a long-lived one, got %f and %f",
+			once.rank(), longLived.rank())
+	}
+	slow := *longLived
+	for i := 0; i < 10; i++ {
+		slow.HandshakeLatency.add(time.Second)
+	}
+	if rank := slow.rank(); rank > longLived.rank()/2 {
+		t.Fatalf("expected a slow node to be ranked down, got %f", rank)
+	}
+}
+
+func TestLatencyHistogram(t *testing.T) {
+	var h LatencyHistogram
+	if _, ok := h.median(); ok {
+		t.Fatalf("expected no median without samples")
+	}
+	for _, latency := range []time.Duration{
+		10 * time.Millisecond, 80 * time.Millisecond, 90 * time.Millisecond, 300 * time.Millisecond, time.Minute,
+	} {
+		h.add(latency)
+	}
+	if median, _ := h.median(); median != 100*time.Millisecond {
+		t.Fatalf("expected a median of 100ms, got %s", median)
+	}
+
+	// Old samples fade out as new ones come in.
+	for i := 0; i < 2*latencyHistogramCap; i++ {
+		h.add(time.Minute)
+	}
+	if median, _ := h.median(); median != 2*latencyBuckets[len(latencyBuckets)-1] {
+		t.Fatalf("expected the median to follow the recent samples, got %s", median)
+	}
+	var total uint32
+	for _, count := range h.Counts {
+		total += count
+	}
+	if total > latencyHistogramCap {
+		t.Fatalf("expected at most %d samples, got %d", latencyHistogramCap, total)
+	}
+}
+
+func TestGoodAddressesUptimeThreshold(t *testing.T) {
+	m := setupAnswerPoolManager(t, 0, newPeerSelector(0, 0, nil, nil, 0, globalRand{}))
+	addGoodTestNodes(m, "1.0.0.1", "1.0.0.2")
+	simulateAttempts(m.nodes["1.0.0.2"], 10, time.Hour, func(i int) bool { return i%2 == 0 })
+	m.refreshAnswerPools()
+
+	addrs := m.GoodAddresses(dns.TypeA, &AddressFilter{IncludeAllSubnetworks: true}, nil, defaultMaxAddresses)
+	if len(addrs) != 1 || !addrs[0].IP.Equal(net.IP{1, 0, 0, 1}) {
+		t.Fatalf("expected only the reliable node, got %v", addrs)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/tls"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// certificateCheckInterval is the minimum interval between two checks of
+// whether the certificate or key file changed.
+const certificateCheckInterval = 10 * time.Second
+
+// certificateLoader serves a TLS certificate and key loaded from files, and
+// reloads them once either file changes, so that renewed certificates are
+// picked up without restarting the seeder.
+type certificateLoader struct {
+	certFile string
+	keyFile  string
+
+	mtx         sync.Mutex
+	certificate *tls.Certificate
+	certModTime time.Time
+	keyModTime  time.Time
+	lastCheck   time.Time
+}
+
+// newCertificateLoader loads the certificate and key in certFile and
+// keyFile.
+func newCertificateLoader(certFile, keyFile string) (*certificateLoader, error) {
+	l := &certificateLoader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	err := l.load(time.Now())
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// modTimes returns the modification times of the certificate and key file
+func (l *certificateLoader) modTimes() (certModTime, keyModTime time.Time, err error) {
+	certInfo, err := os.Stat(l.certFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, errors.Wrap(err, "Stat")
+	}
+	keyInfo, err := os.Stat(l.keyFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, errors.Wrap(err, "Stat")
+	}
+	return certInfo.ModTime(), keyInfo.ModTime(), nil
+}
+
+// load reads the certificate and key files. It must be called with mtx held.
+func (l *certificateLoader) load(now time.Time) error {
+	l.lastCheck = now
+	certModTime, keyModTime, err := l.modTimes()
+	if err != nil {
+		return err
+	}
+	certificate, err := tls.LoadX509KeyPair(l.certFile, l.keyFile)
+	if err != nil {
+		return errors.Wrap(err, "LoadX509KeyPair")
+	}
+	l.certificate = &certificate
+	l.certModTime = certModTime
+	l.keyModTime = keyModTime
+	return nil
+}
+
+// reloadIfChanged reloads the certificate and key if either file changed
+// since they were last loaded. If reloading fails, the previous certificate
+// stays in use.
+func (l *certificateLoader) reloadIfChanged(now time.Time) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	if now.Sub(l.lastCheck) < certificateCheckInterval {
+		return
+	}
+	l.lastCheck = now
+	certModTime, keyModTime, err := l.modTimes()
+	if err != nil {
+		log.Warnf("Failed to check the TLS certificate: %v", err)
+		return
+	}
+	if certModTime.Equal(l.certModTime) && keyModTime.Equal(l.keyModTime) {
+		return
+	}
+	err = l.load(now)
+	if err != nil {
+		log.Warnf("Failed to reload the TLS certificate: %v", err)
+		return
+	}
+	log.Infof("Reloaded the TLS certificate from %s", l.certFile)
+}
+
+// GetCertificate returns the current certificate. It is meant to be used as
+// tls.Config.GetCertificate.
+func (l *certificateLoader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	l.reloadIfChanged(time.Now())
+
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	return l.certificate, nil
+}
+
+// tlsConfig returns a TLS configuration serving the loader's certificate
+// and offering the given application protocols.
+func (l *certificateLoader) tlsConfig(nextProtos ...string) *tls.Config {
+	return &tls.Config{
+		GetCertificate: l.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+		NextProtos:     nextProtos,
+	}
+}
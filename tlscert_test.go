@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCertificate writes a self-signed certificate for commonName and
+// its key to certFile and keyFile.
+func writeTestCertificate(t *testing.T, certFile, keyFile, commonName string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate: %s", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("MarshalECPrivateKey: %s", err)
+	}
+	err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	if err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+	err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	if err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+}
+
+func certificateCommonName(t *testing.T, l *certificateLoader) string {
+	certificate, err := l.GetCertificate(nil)
+	if err != nil {
+		t.Fatalf("GetCertificate: %s", err)
+	}
+	parsed, err := x509.ParseCertificate(certificate.Certificate[0])
+	if err != nil {
+		t.Fatalf("ParseCertificate: %s", err)
+	}
+	return parsed.Subject.CommonName
+}
+
+func TestCertificateLoaderReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeTestCertificate(t, certFile, keyFile, "first")
+
+	l, err := newCertificateLoader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("newCertificateLoader: %s", err)
+	}
+	if name := certificateCommonName(t, l); name != "first" {
+		t.Fatalf("expected the first certificate, got %s", name)
+	}
+
+	writeTestCertificate(t, certFile, keyFile, "second")
+	modTime := time.Now().Add(time.Minute)
+	for _, file := range []string{certFile, keyFile} {
+		err = os.Chtimes(file, modTime, modTime)
+		if err != nil {
+			t.Fatalf("Chtimes: %s", err)
+		}
+	}
+	if name := certificateCommonName(t, l); name != "first" {
+		t.Fatalf("expected the files not to be checked again right away, got %s", name)
+	}
+
+	l.reloadIfChanged(time.Now().Add(certificateCheckInterval))
+	if name := certificateCommonName(t, l); name != "second" {
+		t.Fatalf("expected the changed certificate to be reloaded, got %s", name)
+	}
+
+	// A broken key must not replace the working certificate.
+	err = os.WriteFile(keyFile, []byte("garbage"), 0600)
+	if err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+	modTime = modTime.Add(time.Minute)
+	err = os.Chtimes(keyFile, modTime, modTime)
+	if err != nil {
+		t.Fatalf("Chtimes: %s", err)
+	}
+	l.reloadIfChanged(time.Now().Add(2 * certificateCheckInterval))
+	if name := certificateCommonName(t, l); name != "second" {
+		t.Fatalf("expected the previous certificate to stay in use, got %s", name)
+	}
+}
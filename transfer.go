@@ -0,0 +1,498 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"hash/fnv"
+	"net"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+const (
+	// transferHistorySize is the number of zone versions kept to answer
+	// IXFR queries with the differences to the current one.
+	transferHistorySize = 16
+
+	// transferMessageSize is the size up to which the messages of a zone
+	// transfer are filled, leaving room for a TSIG record.
+	transferMessageSize = dns.MaxMsgSize - 512
+
+	// tsigFudge is the permitted clock skew, in seconds, of TSIG signed
+	// messages sent by the seeder.
+	tsigFudge = 300
+
+	// notifyTimeout and notifyAttempts bound the time waited for a
+	// secondary to acknowledge a NOTIFY message and the number of times
+	// it is sent.
+	notifyTimeout  = 5 * time.Second
+	notifyAttempts = 3
+)
+
+// tsigKey is a shared secret authenticating zone transfers and NOTIFY
+// messages
+type tsigKey struct {
+	name      string
+	algorithm string
+	secret    string
+}
+
+// parseTSIGKey parses a TSIG key given as [algorithm:]name:secret, where
+// secret is base64 encoded and algorithm defaults to hmac-sha256.
+func parseTSIGKey(s string) (*tsigKey, error) {
+	fields := strings.Split(s, ":")
+	if len(fields) == 2 {
+		fields = append([]string{"hmac-sha256"}, fields...)
+	}
+	if len(fields) != 3 || fields[1] == "" {
+		return nil, errors.Errorf("Invalid TSIG key %s: expected [algorithm:]name:secret", s)
+	}
+	key := &tsigKey{
+		algorithm: dns.Fqdn(strings.ToLower(fields[0])),
+		name:      dns.Fqdn(strings.ToLower(fields[1])),
+		secret:    fields[2],
+	}
+	switch key.algorithm {
+	case dns.HmacSHA1, dns.HmacSHA256, dns.HmacSHA512:
+	default:
+		return nil, errors.Errorf("Invalid TSIG key %s: unsupported algorithm %s", s, fields[0])
+	}
+	if _, err := base64.StdEncoding.DecodeString(key.secret); err != nil {
+		return nil, errors.Errorf("Invalid TSIG key %s: the secret is not base64 encoded", s)
+	}
+	return key, nil
+}
+
+// TransferConfig holds the settings of zone transfers to secondary
+// nameservers
+type TransferConfig struct {
+	// TSIGKeys are the keys transfer requests may be signed with. If it
+	// is not empty, requests must be signed with one of them, and NOTIFY
+	// messages are signed with the first one.
+	TSIGKeys []*tsigKey
+
+	// Allow holds the networks transfer requests are accepted from. If
+	// it is empty, requests are accepted from anywhere.
+	Allow []*net.IPNet
+
+	// Notify holds the addresses of the secondaries notified whenever a
+	// zone changes.
+	Notify []string
+}
+
+// zoneVersion is the content of a zone at one serial
+type zoneVersion struct {
+	serial uint32
+	// records holds all records of the zone except for its SOA, in a
+	// fixed order.
+	records []dns.RR
+}
+
+// zoneVersions holds the recent versions of a zone, oldest first
+type zoneVersions []*zoneVersion
+
+// current returns the current version
+func (v zoneVersions) current() *zoneVersion {
+	return v[len(v)-1]
+}
+
+// find returns the version with the given serial, or nil if it is not kept
+func (v zoneVersions) find(serial uint32) *zoneVersion {
+	for _, version := range v {
+		if version.serial == serial {
+			return version
+		}
+	}
+	return nil
+}
+
+// versions returns the recent versions of the zone, or nil if the zone is
+// not transferred
+func (z *dnsZone) versions() zoneVersions {
+	versions, _ := z.zoneVersions.Load().(zoneVersions)
+	return versions
+}
+
+// currentSOA returns the zone's SOA record carrying the current serial
+func (z *dnsZone) currentSOA() *dns.SOA {
+	versions := z.versions()
+	if versions == nil {
+		return z.soa
+	}
+	soa := *z.soa
+	soa.Serial = versions.current().serial
+	return &soa
+}
+
+// transferOrder returns the key the entries of a pool are ordered by when
+// choosing the ones included in zone transfers. Hashing the address keeps
+// the choice stable while the good nodes stay the same, without favoring
+// any address range.
+func transferOrder(entry *poolEntry) uint64 {
+	h := fnv.New64a()
+	h.Write(entry.node.Addr.IP.To16())
+	var port [2]byte
+	binary.BigEndian.PutUint16(port[:], entry.node.Addr.Port)
+	h.Write(port[:])
+	return h.Sum64()
+}
+
+// transferEntries returns up to maxAddresses entries of pool in transfer
+// order
+func transferEntries(pool *answerPool, maxAddresses int) []*poolEntry {
+	entries := append([]*poolEntry(nil), pool.entries...)
+	sort.Slice(entries, func(i, j int) bool {
+		return transferOrder(entries[i]) < transferOrder(entries[j])
+	})
+	if len(entries) > maxAddresses {
+		entries = entries[:maxAddresses]
+	}
+	return entries
+}
+
+// buildZoneRecords builds the records of the zone, except for its SOA, from
+// a snapshot of its good nodes. The zone lists as many addresses and SRV
+// records as a 512 byte answer does.
+func (d *DNSServer) buildZoneRecords(zone *dnsZone, pools *answerPools) []dns.RR {
+	records := []dns.RR{zone.authority}
+	filter := &AddressFilter{IncludeAllSubnetworks: true}
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		for _, entry := range transferEntries(pools.pool(qtype, filter, ""), d.maxAddresses) {
+			records = append(records, entry.record(zone.hostname, d.answerTTL))
+		}
+	}
+	srvName := srvServiceName + "." + zone.hostname
+	for _, entry := range transferEntries(pools.pool(dns.TypeSRV, filter, ""), d.maxAddresses/4) {
+		target := zone.peerTarget(entry.node.Addr)
+		records = append(records, &dns.SRV{
+			Hdr:    dns.RR_Header{Name: srvName, Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: d.answerTTL},
+			Port:   entry.node.Addr.Port,
+			Target: target,
+		}, entry.record(target, d.answerTTL))
+	}
+
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].String() < records[j].String()
+	})
+	return records
+}
+
+// sameRecords returns whether a and b, both in the order returned by
+// buildZoneRecords, hold the same records
+func sameRecords(a, b []dns.RR) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].String() != b[i].String() {
+			return false
+		}
+	}
+	return true
+}
+
+// updateZoneVersion records a new version of zone if its good nodes changed
+// since the last version, and notifies the secondaries of it.
+func (d *DNSServer) updateZoneVersion(zone *dnsZone) {
+	pools := zone.amgr.AnswerPools()
+	if pools == zone.lastTransferPools {
+		return
+	}
+	zone.lastTransferPools = pools
+
+	records := d.buildZoneRecords(zone, pools)
+	versions := zone.versions()
+	if versions != nil && sameRecords(versions.current().records, records) {
+		return
+	}
+
+	serial := zone.soa.Serial
+	if versions != nil {
+		serial = versions.current().serial + 1
+	}
+	newVersions := append(zoneVersions{}, versions...)
+	newVersions = append(newVersions, &zoneVersion{serial: serial, records: records})
+	if len(newVersions) > transferHistorySize {
+		newVersions = newVersions[len(newVersions)-transferHistorySize:]
+	}
+	zone.zoneVersions.Store(newVersions)
+
+	if versions != nil {
+		log.Infof("Zone %s changed, serial is now %d", zone.hostname, serial)
+		d.notifySecondaries(zone)
+	}
+}
+
+// transferLoop keeps the versions of the zones up to date with their good
+// nodes until system shutdown is requested.
+func (d *DNSServer) transferLoop() {
+	defer wg.Done()
+
+	ticker := time.NewTicker(answerPoolRefreshInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if atomic.LoadInt32(&systemShutdown) != 0 {
+			return
+		}
+		for _, zone := range d.zones {
+			d.updateZoneVersion(zone)
+		}
+	}
+}
+
+// isTransferQuery returns whether the query in b asks for a zone transfer.
+// Only the question's type is looked at, so that other queries are not
+// unpacked twice.
+func isTransferQuery(b []byte) bool {
+	if len(b) < dnsHeaderSize || binary.BigEndian.Uint16(b[4:]) != 1 {
+		return false
+	}
+	_, offset, err := dns.UnpackDomainName(b, dnsHeaderSize)
+	if err != nil || len(b) < offset+2 {
+		return false
+	}
+	qtype := binary.BigEndian.Uint16(b[offset:])
+	return qtype == dns.TypeAXFR || qtype == dns.TypeIXFR
+}
+
+// authorizeTransfer checks whether the transfer request dnsMsg, received
+// as b from addr, is allowed. It returns the key the request is signed
+// with, if any, and a response code other than dns.RcodeSuccess if the
+// request is refused.
+func (d *DNSServer) authorizeTransfer(addr net.Addr, b []byte, dnsMsg *dns.Msg) (*tsigKey, int) {
+	if d.transfer == nil {
+		log.Infof("%s: refusing zone transfer: transfers are disabled", addr)
+		return nil, dns.RcodeRefused
+	}
+
+	if len(d.transfer.Allow) > 0 {
+		ip := addrIP(addr)
+		allowed := false
+		for _, ipNet := range d.transfer.Allow {
+			if ip != nil && ipNet.Contains(ip) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			log.Infof("%s: refusing zone transfer: address not allowed", addr)
+			return nil, dns.RcodeRefused
+		}
+	}
+
+	if len(d.transfer.TSIGKeys) == 0 {
+		return nil, dns.RcodeSuccess
+	}
+	tsig := dnsMsg.IsTsig()
+	if tsig == nil {
+		log.Infof("%s: refusing zone transfer: request is not signed", addr)
+		return nil, dns.RcodeRefused
+	}
+	for _, key := range d.transfer.TSIGKeys {
+		if key.name != strings.ToLower(tsig.Hdr.Name) || key.algorithm != strings.ToLower(tsig.Algorithm) {
+			continue
+		}
+		err := dns.TsigVerify(b, key.secret, "", false)
+		if err != nil {
+			log.Infof("%s: refusing zone transfer: %v", addr, err)
+			return nil, dns.RcodeNotAuth
+		}
+		return key, dns.RcodeSuccess
+	}
+	log.Infof("%s: refusing zone transfer: unknown key %s", addr, tsig.Hdr.Name)
+	return nil, dns.RcodeNotAuth
+}
+
+// transferRecords returns the records answering an AXFR query, or an IXFR
+// query from a secondary at clientSerial, as described in RFC 5936 and RFC
+// 1995. Differences between the client's version and the current one are
+// sent as a single condensed step.
+func transferRecords(versions zoneVersions, soa *dns.SOA, qtype uint16, clientSerial uint32) []dns.RR {
+	current := versions.current()
+	if qtype == dns.TypeIXFR {
+		if clientSerial == current.serial {
+			return []dns.RR{soa}
+		}
+		if old := versions.find(clientSerial); old != nil {
+			oldSOA := *soa
+			oldSOA.Serial = old.serial
+			deleted, added := diffRecords(old.records, current.records)
+			records := []dns.RR{soa, &oldSOA}
+			records = append(records, deleted...)
+			records = append(records, soa)
+			records = append(records, added...)
+			return append(records, soa)
+		}
+	}
+
+	records := []dns.RR{soa}
+	records = append(records, current.records...)
+	return append(records, soa)
+}
+
+// diffRecords returns the records of old missing in current and those of
+// current missing in old
+func diffRecords(old, current []dns.RR) (deleted, added []dns.RR) {
+	oldSet := make(map[string]struct{}, len(old))
+	for _, rr := range old {
+		oldSet[rr.String()] = struct{}{}
+	}
+	currentSet := make(map[string]struct{}, len(current))
+	for _, rr := range current {
+		currentSet[rr.String()] = struct{}{}
+		if _, ok := oldSet[rr.String()]; !ok {
+			added = append(added, rr)
+		}
+	}
+	for _, rr := range old {
+		if _, ok := currentSet[rr.String()]; !ok {
+			deleted = append(deleted, rr)
+		}
+	}
+	return deleted, added
+}
+
+// handleTransferRequest answers an AXFR or IXFR query. Over stream
+// transports the transfer is split into as many messages as needed, while
+// over UDP an IXFR query is only answered with the current SOA record,
+// prompting the secondary to retry over TCP if it is out of date, and AXFR
+// queries are rejected.
+func (d *DNSServer) handleTransferRequest(addr net.Addr, b []byte, isStream bool) ([][]byte, error) {
+	dnsMsg, zone, domainName, rcode, err := d.validateDNSRequest(addr, b)
+	if err != nil {
+		return nil, err
+	}
+	qtype := dns.TypeAXFR
+	if dnsMsg.Question != nil {
+		qtype = dnsMsg.Question[0].Qtype
+	}
+	if rcode == dns.RcodeSuccess && zone.versions() == nil {
+		rcode = dns.RcodeRefused
+	}
+	var key *tsigKey
+	if rcode == dns.RcodeSuccess {
+		key, rcode = d.authorizeTransfer(addr, b, dnsMsg)
+	}
+	if rcode == dns.RcodeSuccess && domainName != zone.hostname {
+		log.Infof("%s: refusing zone transfer of %s: not a zone", addr, domainName)
+		rcode = dns.RcodeNotAuth
+	}
+	if rcode == dns.RcodeSuccess && qtype == dns.TypeAXFR && !isStream {
+		log.Infof("%s: refusing AXFR over UDP", addr)
+		rcode = dns.RcodeFormatError
+	}
+	var clientSerial uint32
+	if rcode == dns.RcodeSuccess && qtype == dns.TypeIXFR {
+		clientSOA, ok := firstSOA(dnsMsg.Ns)
+		if ok {
+			clientSerial = clientSOA.Serial
+		} else {
+			log.Infof("%s: IXFR query without SOA record", addr)
+			rcode = dns.RcodeFormatError
+		}
+	}
+	if rcode != dns.RcodeSuccess {
+		sendBytes, err := d.buildErrorResponse(addr, zone, dnsMsg, rcode, isStream)
+		if err != nil {
+			return nil, err
+		}
+		return [][]byte{sendBytes}, nil
+	}
+
+	versions := zone.versions()
+	soa := zone.currentSOA()
+	records := []dns.RR{soa}
+	if isStream {
+		records = transferRecords(versions, soa, qtype, clientSerial)
+	}
+	log.Infof("%s: transferring %s at serial %d in %d records", addr, zone.hostname, soa.Serial, len(records))
+
+	var responses [][]byte
+	requestMAC := ""
+	if tsig := dnsMsg.IsTsig(); tsig != nil {
+		requestMAC = tsig.MAC
+	}
+	for len(records) > 0 || len(responses) == 0 {
+		respMsg := newDNSResponse(dnsMsg, dns.RcodeSuccess)
+		for len(records) > 0 && (len(respMsg.Answer) == 0 || respMsg.Len() < transferMessageSize) {
+			respMsg.Answer = append(respMsg.Answer, records[0])
+			records = records[1:]
+		}
+		if respMsg.Len() > transferMessageSize && len(respMsg.Answer) > 1 {
+			records = append([]dns.RR{respMsg.Answer[len(respMsg.Answer)-1]}, records...)
+			respMsg.Answer = respMsg.Answer[:len(respMsg.Answer)-1]
+		}
+
+		var sendBytes []byte
+		if key != nil {
+			respMsg.SetTsig(key.name, key.algorithm, tsigFudge, time.Now().Unix())
+			sendBytes, requestMAC, err = dns.TsigGenerate(respMsg, key.secret, requestMAC, len(responses) > 0)
+			if err != nil {
+				log.Infof("%s: failed to sign response: %v", addr, err)
+				return nil, err
+			}
+		} else {
+			sendBytes, err = packDNSResponse(addr, respMsg)
+			if err != nil {
+				return nil, err
+			}
+		}
+		responses = append(responses, sendBytes)
+	}
+	return responses, nil
+}
+
+// firstSOA returns the first SOA record in section
+func firstSOA(section []dns.RR) (*dns.SOA, bool) {
+	for _, rr := range section {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return soa, true
+		}
+	}
+	return nil, false
+}
+
+// notifySecondaries tells the secondaries that zone changed, as described
+// in RFC 1996.
+func (d *DNSServer) notifySecondaries(zone *dnsZone) {
+	soa := zone.currentSOA()
+	for _, secondary := range d.transfer.Notify {
+		secondary := secondary
+		spawn("DNSServer.notifySecondaries-DNSServer.notify", func() { d.notify(zone, soa, secondary) })
+	}
+}
+
+// notify sends a NOTIFY message for zone at the given SOA to secondary,
+// until it is acknowledged or notifyAttempts were made.
+func (d *DNSServer) notify(zone *dnsZone, soa *dns.SOA, secondary string) {
+	client := &dns.Client{Net: "udp", Timeout: notifyTimeout}
+	var key *tsigKey
+	if len(d.transfer.TSIGKeys) > 0 {
+		key = d.transfer.TSIGKeys[0]
+		client.TsigSecret = map[string]string{key.name: key.secret}
+	}
+
+	var err error
+	for attempt := 0; attempt < notifyAttempts; attempt++ {
+		msg := new(dns.Msg).SetNotify(zone.hostname)
+		msg.Answer = []dns.RR{soa}
+		if key != nil {
+			msg.SetTsig(key.name, key.algorithm, tsigFudge, time.Now().Unix())
+		}
+		var resp *dns.Msg
+		resp, _, err = client.Exchange(msg, secondary)
+		if err == nil && resp.Rcode != dns.RcodeSuccess {
+			err = errors.Errorf("secondary answered %s", dns.RcodeToString[resp.Rcode])
+		}
+		if err == nil {
+			log.Debugf("Notified %s of %s serial %d", secondary, zone.hostname, soa.Serial)
+			return
+		}
+	}
+	log.Warnf("Failed to notify %s of %s serial %d: %v", secondary, zone.hostname, soa.Serial, err)
+}
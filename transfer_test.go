@@ -0,0 +1,283 @@
+package main
+
+import (
+	"encoding/base64"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+var testTSIGKey = &tsigKey{
+	name:      "xfr.example.org.",
+	algorithm: dns.HmacSHA256,
+	secret:    base64.StdEncoding.EncodeToString([]byte("zone transfer test secret")),
+}
+
+// transferZone transfers testZone from d over an in-memory connection
+// from 127.0.0.1, signing the request with key if it is not nil. An IXFR
+// is requested if serial is not zero.
+func transferZone(t *testing.T, d *DNSServer, key *tsigKey, serial uint32) ([]dns.RR, error) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	wg.Add(1)
+	go d.handleTCPConnection(&pipeConn{Conn: serverConn, remoteAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}})
+
+	query := new(dns.Msg)
+	transfer := &dns.Transfer{Conn: &dns.Conn{Conn: clientConn}}
+	if serial == 0 {
+		query.SetAxfr(testZone)
+	} else {
+		query.SetIxfr(testZone, serial, "ns.example.org.", "hostmaster."+testZone)
+	}
+	if key != nil {
+		query.SetTsig(key.name, key.algorithm, tsigFudge, time.Now().Unix())
+		transfer.TsigSecret = map[string]string{key.name: key.secret}
+	}
+	envelopes, err := transfer.In(query, "")
+	if err != nil {
+		t.Fatalf("In: %s", err)
+	}
+	var records []dns.RR
+	for envelope := range envelopes {
+		if envelope.Error != nil {
+			return nil, envelope.Error
+		}
+		records = append(records, envelope.RR...)
+	}
+	return records, nil
+}
+
+// pipeConn is a net.Pipe connection with a remote address that a DNS server
+// can tell clients apart by
+type pipeConn struct {
+	net.Conn
+	remoteAddr net.Addr
+}
+
+func (c *pipeConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+func setupTransferServer(t *testing.T, m *Manager, transfer *TransferConfig) *DNSServer {
+	cfg := testDNSServerConfig()
+	cfg.SOASerial = 100
+	cfg.Transfer = transfer
+	return NewDNSServer(cfg, []*DNSZoneConfig{{Hostname: testZone, Nameserver: "ns.example.org", Manager: m}}, nil)
+}
+
+func countRecords(records []dns.RR, rrtype uint16) int {
+	count := 0
+	for _, rr := range records {
+		if rr.Header().Rrtype == rrtype {
+			count++
+		}
+	}
+	return count
+}
+
+func TestZoneTransfer(t *testing.T) {
+	m := setupAnswerPoolManager(t, 0, newPeerSelector(0, 0, nil, nil, 0, globalRand{}))
+	addGoodTestNodes(m, "1.0.0.1", "1.0.0.2", "2001:db8::1")
+	d := setupTransferServer(t, m, &TransferConfig{
+		TSIGKeys: []*tsigKey{testTSIGKey},
+		Allow:    []*net.IPNet{{IP: net.IPv4(127, 0, 0, 0), Mask: net.CIDRMask(8, 32)}},
+	})
+
+	records, err := transferZone(t, d, testTSIGKey, 0)
+	if err != nil {
+		t.Fatalf("AXFR: %s", err)
+	}
+	if records[0].(*dns.SOA).Serial != 100 || records[len(records)-1].(*dns.SOA).Serial != 100 {
+		t.Fatalf("expected the zone to be enclosed in SOA records with serial 100, got %v", records)
+	}
+	if countRecords(records, dns.TypeNS) != 1 || countRecords(records, dns.TypeA) != 2+2 ||
+		countRecords(records, dns.TypeAAAA) != 1+1 || countRecords(records, dns.TypeSRV) != 3 {
+		t.Fatalf("unexpected zone content: %v", records)
+	}
+
+	_, err = transferZone(t, d, nil, 0)
+	if err == nil {
+		t.Fatalf("expected an unsigned transfer request to be refused")
+	}
+	wrongKey := *testTSIGKey
+	wrongKey.secret = base64.StdEncoding.EncodeToString([]byte("wrong secret"))
+	_, err = transferZone(t, d, &wrongKey, 0)
+	if err == nil {
+		t.Fatalf("expected a transfer request with a wrong signature to be refused")
+	}
+
+	// Rebuilding the zone without changes keeps its serial.
+	m.refreshAnswerPools()
+	d.updateZoneVersion(d.zones[0])
+	if serial := d.zones[0].currentSOA().Serial; serial != 100 {
+		t.Fatalf("expected the serial to stay at 100, got %d", serial)
+	}
+
+	addGoodTestNodes(m, "1.0.0.3")
+	d.updateZoneVersion(d.zones[0])
+	resp := queryDNSServer(t, d, testZone, dns.TypeSOA)
+	if len(resp.Answer) != 1 || resp.Answer[0].(*dns.SOA).Serial != 101 {
+		t.Fatalf("expected the serial to be incremented, got:\n%s", resp)
+	}
+
+	records, err = transferZone(t, d, testTSIGKey, 100)
+	if err != nil {
+		t.Fatalf("IXFR: %s", err)
+	}
+	if len(records) != 7 || records[1].(*dns.SOA).Serial != 100 || records[2].(*dns.SOA).Serial != 101 {
+		t.Fatalf("expected an incremental transfer adding the new node, got %v", records)
+	}
+	if countRecords(records, dns.TypeA) != 2 || countRecords(records, dns.TypeSRV) != 1 {
+		t.Fatalf("expected an A, an SRV and a glue record to be added, got %v", records)
+	}
+
+	records, err = transferZone(t, d, testTSIGKey, 101)
+	if err != nil {
+		t.Fatalf("IXFR: %s", err)
+	}
+	if len(records) != 1 || records[0].(*dns.SOA).Serial != 101 {
+		t.Fatalf("expected only the SOA record for an up to date secondary, got %v", records)
+	}
+
+	records, err = transferZone(t, d, testTSIGKey, 42)
+	if err != nil {
+		t.Fatalf("IXFR: %s", err)
+	}
+	if countRecords(records, dns.TypeNS) != 1 || countRecords(records, dns.TypeSOA) != 2 {
+		t.Fatalf("expected a full transfer for an unknown serial, got %v", records)
+	}
+
+	// Transfers are only allowed from the configured networks.
+	query := new(dns.Msg).SetAxfr(testZone)
+	b, err := query.Pack()
+	if err != nil {
+		t.Fatalf("Pack: %s", err)
+	}
+	d.transfer.TSIGKeys = nil
+	responses, err := d.handleTransferRequest(&net.TCPAddr{IP: net.IPv4(10, 0, 0, 1)}, b, true)
+	if err != nil {
+		t.Fatalf("handleTransferRequest: %s", err)
+	}
+	resp = new(dns.Msg)
+	err = resp.Unpack(responses[0])
+	if err != nil {
+		t.Fatalf("Unpack: %s", err)
+	}
+	if len(responses) != 1 || resp.Rcode != dns.RcodeRefused {
+		t.Fatalf("expected a transfer from outside the allowed networks to be refused, got:\n%s", resp)
+	}
+}
+
+func TestZoneTransferIXFRWithoutSOA(t *testing.T) {
+	m := setupAnswerPoolManager(t, 2, newPeerSelector(0, 0, nil, nil, 0, globalRand{}))
+	d := setupTransferServer(t, m, &TransferConfig{
+		Allow: []*net.IPNet{{IP: net.IPv4(10, 0, 0, 0), Mask: net.CIDRMask(8, 32)}},
+	})
+
+	query := new(dns.Msg).SetQuestion(testZone, dns.TypeIXFR)
+	b, err := query.Pack()
+	if err != nil {
+		t.Fatalf("Pack: %s", err)
+	}
+	for _, isStream := range []bool{false, true} {
+		responses, err := d.handleTransferRequest(&net.UDPAddr{IP: net.IPv4(10, 0, 0, 1)}, b, isStream)
+		if err != nil {
+			t.Fatalf("handleTransferRequest: %s", err)
+		}
+		resp := new(dns.Msg)
+		err = resp.Unpack(responses[0])
+		if err != nil {
+			t.Fatalf("Unpack: %s", err)
+		}
+		if len(responses) != 1 || resp.Rcode != dns.RcodeFormatError {
+			t.Fatalf("expected an IXFR without SOA record to be answered with FORMERR, got:\n%s", resp)
+		}
+	}
+}
+
+func TestZoneTransferDisabled(t *testing.T) {
+	m := setupAnswerPoolManager(t, 2, newPeerSelector(0, 0, nil, nil, 0, globalRand{}))
+	d := setupTransferServer(t, m, nil)
+
+	resp := queryDNSServer(t, d, testZone, dns.TypeIXFR)
+	if resp.Rcode != dns.RcodeRefused {
+		t.Fatalf("expected transfers to be refused, got:\n%s", resp)
+	}
+	resp = queryDNSServer(t, d, testZone, dns.TypeSOA)
+	if len(resp.Answer) != 1 || resp.Answer[0].(*dns.SOA).Serial != 100 {
+		t.Fatalf("expected the configured serial, got:\n%s", resp)
+	}
+}
+
+func TestNotifySecondaries(t *testing.T) {
+	secondary, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket: %s", err)
+	}
+	defer secondary.Close()
+
+	m := setupAnswerPoolManager(t, 2, newPeerSelector(0, 0, nil, nil, 0, globalRand{}))
+	d := setupTransferServer(t, m, &TransferConfig{
+		TSIGKeys: []*tsigKey{testTSIGKey},
+		Notify:   []string{secondary.LocalAddr().String()},
+	})
+
+	notifications := make(chan *dns.Msg, 1)
+	go func() {
+		b := make([]byte, dns.MaxMsgSize)
+		n, addr, err := secondary.ReadFrom(b)
+		if err != nil {
+			close(notifications)
+			return
+		}
+		msg := new(dns.Msg)
+		err = msg.Unpack(b[:n])
+		if err != nil || msg.IsTsig() == nil || dns.TsigVerify(b[:n], testTSIGKey.secret, "", false) != nil {
+			close(notifications)
+			return
+		}
+		notifications <- msg
+		resp := new(dns.Msg).SetReply(msg)
+		resp.SetTsig(testTSIGKey.name, testTSIGKey.algorithm, tsigFudge, time.Now().Unix())
+		respBytes, _, err := dns.TsigGenerate(resp, testTSIGKey.secret, msg.IsTsig().MAC, false)
+		if err == nil {
+			secondary.WriteTo(respBytes, addr)
+		}
+	}()
+
+	d.notify(d.zones[0], d.zones[0].currentSOA(), secondary.LocalAddr().String())
+	msg, ok := <-notifications
+	if !ok {
+		t.Fatalf("expected a signed NOTIFY message")
+	}
+	if msg.Opcode != dns.OpcodeNotify || msg.Question[0].Name != testZone ||
+		len(msg.Answer) != 1 || msg.Answer[0].(*dns.SOA).Serial != 100 {
+		t.Fatalf("unexpected NOTIFY message:\n%s", msg)
+	}
+}
+
+func TestParseTSIGKey(t *testing.T) {
+	tests := []struct {
+		key       string
+		valid     bool
+		name      string
+		algorithm string
+	}{
+		{"XFR.example.org:c2VjcmV0", true, "xfr.example.org.", dns.HmacSHA256},
+		{"hmac-sha512:xfr:c2VjcmV0", true, "xfr.", dns.HmacSHA512},
+		{"hmac-md5:xfr:c2VjcmV0", false, "", ""},
+		{"xfr:not base64", false, "", ""},
+		{"c2VjcmV0", false, "", ""},
+	}
+	for _, test := range tests {
+		key, err := parseTSIGKey(test.key)
+		if (err == nil) != test.valid {
+			t.Fatalf("%s: expected valid=%t, got error %v", test.key, test.valid, err)
+		}
+		if test.valid && (key.name != test.name || key.algorithm != test.algorithm) {
+			t.Fatalf("%s: unexpected key %+v", test.key, key)
+		}
+	}
+}